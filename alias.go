@@ -0,0 +1,184 @@
+package waddell
+
+import (
+	"fmt"
+	"time"
+)
+
+// Aliases
+//
+// To spare small deployments from exchanging peer ids out of band, clients can
+// register a short, human-friendly alias with the server (see
+// ClientConfig.Alias) by which other peers can then reach them (see
+// Client.SendToAlias). Aliases are unique per server and ephemeral: they're
+// released as soon as the peer that registered them disconnects, and have to be
+// registered again on every connection.
+//
+// IMPORTANT - aliases aren't authenticated. Any client can claim any alias
+// that isn't currently taken, so aliases are a convenience for peers that
+// trust each other, not a way to establish identity.
+//
+// Registering an alias uses a control frame consisting of aliasRequest
+// followed by the alias, which the server answers with an aliasFrame. Messages
+// sent by alias are addressed to aliasId and carry the alias ahead of the body:
+//
+//   aliasId | topic | 8-bit alias length | alias | body
+//
+// The server resolves the alias and relays the message like any other, so
+// recipients can't tell whether a message was addressed by id or by alias.
+
+const (
+	// MaxAliasLength is the maximum length of an alias in bytes. It keeps
+	// alias requests shorter than any regular message (which is at least
+	// WaddellHeaderLength bytes long), so the server can tell them apart.
+	MaxAliasLength = 16
+
+	aliasRegistered = byte(0)
+	aliasTaken      = byte(1)
+	aliasInvalid    = byte(2)
+)
+
+var (
+	// ErrAliasTaken is returned when connecting with an alias that another
+	// peer has already registered.
+	ErrAliasTaken = fmt.Errorf("Alias already taken")
+
+	// aliasId is the reserved PeerId to which messages addressed by alias
+	// are sent.
+	aliasId = reservedId(0xaa)
+
+	aliasRequest = []byte{'a'}
+)
+
+// SendToAlias sends a message on the given topic to the peer that registered
+// the given alias (see ClientConfig.Alias). Like messages sent on Out topics,
+// messages to aliases that nobody has registered are silently dropped.
+func (c *Client) SendToAlias(id TopicId, alias string, body ...[]byte) error {
+	if c.isClosed() {
+		return closedError
+	}
+	if c.Mode == ReceiveOnly {
+		return fmt.Errorf("Unable to send on receive only client")
+	}
+	err := checkTopic(id)
+	if err != nil {
+		return err
+	}
+	err = validateAlias(alias)
+	if err != nil {
+		return err
+	}
+	body, ok := c.intercept(PeerId{}, body)
+	if !ok {
+		return nil
+	}
+	length := bodyLength(body)
+	err = checkSize(length, MaxDataLength-1-len(alias))
+	if err != nil {
+		return err
+	}
+
+	info := c.getConnInfo()
+	if info.err != nil {
+		return info.err
+	}
+	if info.version < 4 {
+		return fmt.Errorf("Server doesn't support aliases")
+	}
+	pieces := make([][]byte, 0, 4+len(body))
+	pieces = append(pieces, aliasId.toBytes(), id.toBytes(), []byte{byte(len(alias))}, []byte(alias))
+	pieces = append(pieces, body...)
+	err = info.write(pieces...)
+	if err != nil {
+		c.connError(info, err)
+		return err
+	}
+	c.sent.add(time.Now(), length)
+	return nil
+}
+
+func validateAlias(alias string) error {
+	if len(alias) == 0 || len(alias) > MaxAliasLength {
+		return fmt.Errorf("Alias must be between 1 and %d bytes long", MaxAliasLength)
+	}
+	return nil
+}
+
+// registerAlias registers the given alias for this connection, which must not
+// be used for anything else until it returns.
+func (info *connInfo) registerAlias(alias string) error {
+	if info.version < 4 {
+		return fmt.Errorf("Server doesn't support aliases")
+	}
+	err := info.writeNow(aliasRequest, []byte(alias))
+	if err != nil {
+		return err
+	}
+	msg, err := info.receive()
+	if err != nil {
+		return err
+	}
+	if msg.From != serverId || msg.topic != aliasFrame || len(msg.Body) != 1 {
+		return fmt.Errorf("Unexpected response to alias registration")
+	}
+	switch msg.Body[0] {
+	case aliasRegistered:
+		return nil
+	case aliasTaken:
+		return ErrAliasTaken
+	default:
+		return fmt.Errorf("Server rejected alias %q", alias)
+	}
+}
+
+// registerAlias answers a peer's request to register the given alias.
+func (p *peer) registerAlias(alias string) bool {
+	status := p.server.addAlias(p, alias)
+	if status != aliasRegistered {
+		log.Debugf("Not registering alias %q for %s: %d", alias, p.server.logId(p.id), status)
+	}
+	return p.sendSystemFrame(aliasFrame, []byte{status}) == nil
+}
+
+func (server *Server) addAlias(p *peer, alias string) byte {
+	if validateAlias(alias) != nil {
+		return aliasInvalid
+	}
+	server.peersMutex.Lock()
+	defer server.peersMutex.Unlock()
+	if p.alias != "" {
+		// Only one alias per connection
+		return aliasInvalid
+	}
+	if server.aliases[alias] != nil {
+		return aliasTaken
+	}
+	server.aliases[alias] = p
+	p.alias = alias
+	return aliasRegistered
+}
+
+// resolveAlias resolves the alias of a message addressed to aliasId, rewriting
+// msg in place into a regular message addressed to the peer that registered
+// the alias.
+func (p *peer) resolveAlias(msg []byte) (PeerId, []byte, bool) {
+	if len(msg) < WaddellHeaderLength+1 {
+		return PeerId{}, nil, false
+	}
+	aliasLength := int(msg[WaddellHeaderLength])
+	bodyStart := WaddellHeaderLength + 1 + aliasLength
+	if len(msg) < bodyStart {
+		return PeerId{}, nil, false
+	}
+	alias := msg[WaddellHeaderLength+1 : bodyStart]
+	p.server.peersMutex.RLock()
+	recipient := p.server.aliases[string(alias)]
+	p.server.peersMutex.RUnlock()
+	if recipient == nil {
+		return PeerId{}, nil, false
+	}
+	n := copy(msg[WaddellHeaderLength:], msg[bodyStart:])
+	msg = msg[:WaddellHeaderLength+n]
+	copy(msg, recipient.id.toBytes())
+	return recipient.id, msg, true
+}
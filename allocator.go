@@ -0,0 +1,37 @@
+package waddell
+
+import (
+	"fmt"
+)
+
+// Allocator allocates peer ids on behalf of a Server, see Server.Allocator.
+// Implementations need to be safe for concurrent use.
+//
+// A PeerId is just 16 bytes, so allocators are free to lay them out as they
+// like, e.g. to coordinate with other instances so that ids are unique across
+// a cluster, or to embed bits identifying the instance that owns the peer so
+// that ids are self-routing. Reserved ids (see IsReserved) are never assigned
+// to peers, the server treats them like ids that are already taken.
+type Allocator interface {
+	// Allocate allocates a new peer id. If it returns an error, the
+	// connection that needed the id is rejected.
+	Allocate() (PeerId, error)
+}
+
+// allocateId allocates a candidate id for a new peer using the Allocator, the
+// RandSource or crypto/rand, in that order of preference.
+func (server *Server) allocateId() (PeerId, error) {
+	if server.Allocator != nil {
+		id, err := server.Allocator.Allocate()
+		if err != nil {
+			return PeerId{}, fmt.Errorf("Unable to allocate peer id: %w", err)
+		}
+		return id, nil
+	}
+	if server.RandSource != nil {
+		server.randMutex.Lock()
+		defer server.randMutex.Unlock()
+		return randomPeerIdFrom(server.RandSource)
+	}
+	return randomPeerId(), nil
+}
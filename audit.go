@@ -0,0 +1,120 @@
+package waddell
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// AuditEventType identifies the kind of connection lifecycle event recorded in
+// an AuditEvent.
+type AuditEventType int
+
+const (
+	// AuditConnect: a peer was admitted and assigned an id
+	AuditConnect = AuditEventType(0)
+
+	// AuditDisconnect: an admitted peer disconnected
+	AuditDisconnect = AuditEventType(1)
+
+	// AuditReject: a connection was rejected before being admitted
+	AuditReject = AuditEventType(2)
+)
+
+func (t AuditEventType) String() string {
+	switch t {
+	case AuditConnect:
+		return "connect"
+	case AuditDisconnect:
+		return "disconnect"
+	case AuditReject:
+		return "reject"
+	default:
+		return "unknown"
+	}
+}
+
+// AuditEvent records a connection lifecycle event, see Server.RecentEvents.
+type AuditEvent struct {
+	Type AuditEventType
+	Time time.Time
+
+	// Id: the peer's id, or the zero PeerId for connections that were
+	// rejected before being assigned an id
+	Id PeerId
+
+	RemoteAddr net.Addr
+
+	// ServerName: see PeerInfo.ServerName
+	ServerName string
+
+	// Reason: for disconnects, the CloseReason with which the server closed
+	// the connection (CloseNetwork if the peer went away on its own)
+	Reason CloseReason
+
+	// Rejection: for rejections, why the connection was rejected
+	Rejection *RejectedError
+}
+
+// auditLog is a fixed-size ring buffer of AuditEvents.
+type auditLog struct {
+	events []AuditEvent
+	next   int  // index at which to record the next event
+	full   bool // whether events has wrapped around
+	mutex  sync.Mutex
+}
+
+func (l *auditLog) add(size int, event AuditEvent) {
+	if size <= 0 {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.events == nil {
+		l.events = make([]AuditEvent, size)
+	}
+	l.events[l.next] = event
+	l.next++
+	if l.next == len(l.events) {
+		l.next = 0
+		l.full = true
+	}
+}
+
+func (l *auditLog) recent(n int) []AuditEvent {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	available := l.next
+	if l.full {
+		available = len(l.events)
+	}
+	if n > available {
+		n = available
+	}
+	if n < 0 {
+		n = 0
+	}
+	result := make([]AuditEvent, n)
+	for i := 0; i < n; i++ {
+		idx := (l.next - n + i + len(l.events)) % len(l.events)
+		result[i] = l.events[idx]
+	}
+	return result
+}
+
+// RecentEvents returns up to the n most recent connection lifecycle events
+// (connects, disconnects and rejections), oldest first. Only the last
+// AuditEvents events are kept, so this returns nothing if AuditEvents isn't
+// set.
+func (server *Server) RecentEvents(n int) []AuditEvent {
+	return server.audit.recent(n)
+}
+
+// recordEvent adds an event to the audit log, if enabled.
+func (server *Server) recordEvent(event AuditEvent) {
+	if server.AuditEvents <= 0 {
+		return
+	}
+	event.Time = time.Now()
+	server.audit.add(server.AuditEvents, event)
+}
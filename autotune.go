@@ -0,0 +1,119 @@
+package waddell
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// autoTuneInterval is how often AutoTune looks at the server's Stats.
+	autoTuneInterval = 10 * time.Second
+
+	// autoCoalesceWindow is the CoalesceWindow that AutoTune uses for busy
+	// servers.
+	autoCoalesceWindow = time.Millisecond
+
+	// autoCoalesceRate is the rate of relayed messages per connection and
+	// second above which AutoTune coalesces writes.
+	autoCoalesceRate = 10
+
+	// autoMaxDropRate is the fraction of messages that may be dropped before
+	// AutoTune stops coalescing writes.
+	autoMaxDropRate = 0.01
+
+	// autoMinReadBuffer and autoMaxMinReadBuffer bound the MinReadBuffer that
+	// AutoTune picks.
+	autoMinReadBuffer    = 512
+	autoMaxMinReadBuffer = 16384
+)
+
+// autoTuner adjusts the server's CoalesceWindow and MinReadBuffer to its
+// traffic, see Server.AutoTune.
+type autoTuner struct {
+	server        *Server
+	coalesce      int64 // current CoalesceWindow in nanoseconds
+	minReadBuffer int64 // current MinReadBuffer
+	last          Stats
+}
+
+func (server *Server) newAutoTuner() *autoTuner {
+	return &autoTuner{
+		server:        server,
+		coalesce:      int64(server.CoalesceWindow),
+		minReadBuffer: int64(server.MinReadBuffer),
+	}
+}
+
+// run tunes the server every autoTuneInterval until it shuts down.
+func (at *autoTuner) run() {
+	at.last = at.server.Stats()
+	ticker := time.NewTicker(autoTuneInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if atomic.LoadInt32(&at.server.shutdown) == 1 {
+			return
+		}
+		stats := at.server.Stats()
+		at.tune(stats, autoTuneInterval)
+		at.last = stats
+	}
+}
+
+// tune adjusts the knobs based on what happened between the last Stats and
+// the given ones, which were taken the given time apart.
+func (at *autoTuner) tune(stats Stats, elapsed time.Duration) {
+	relayed := stats.MessagesRelayed - at.last.MessagesRelayed
+	dropped := stats.Dropped - at.last.Dropped
+	if relayed+dropped == 0 {
+		// Nothing to go by
+		return
+	}
+
+	// Coalesce writes while connections are busy enough for bursts to be
+	// likely, unless recipients are falling behind already (as indicated by
+	// drops), in which case delaying writes only makes it worse.
+	connections := stats.Connections
+	if connections < 1 {
+		connections = 1
+	}
+	rate := float64(relayed) / elapsed.Seconds() / float64(connections)
+	dropRate := float64(dropped) / float64(relayed+dropped)
+	coalesce := time.Duration(0)
+	if rate >= autoCoalesceRate && dropRate <= autoMaxDropRate {
+		coalesce = autoCoalesceWindow
+	}
+	if old := time.Duration(atomic.SwapInt64(&at.coalesce, int64(coalesce))); old != coalesce {
+		log.Debugf("AutoTune: %.1f messages per connection and second, %.1f%% dropped, changing CoalesceWindow from %v to %v", rate, 100*dropRate, old, coalesce)
+	}
+
+	// Size new connections' read buffers to fit the average message
+	if relayed > 0 {
+		average := int((stats.BytesRelayed-at.last.BytesRelayed)/relayed) + WaddellHeaderLength
+		minReadBuffer := autoMinReadBuffer
+		for minReadBuffer < average && minReadBuffer < autoMaxMinReadBuffer {
+			minReadBuffer *= 2
+		}
+		if at.server.BufferBytes > 0 && minReadBuffer > at.server.BufferBytes {
+			minReadBuffer = at.server.BufferBytes
+		}
+		if old := int(atomic.SwapInt64(&at.minReadBuffer, int64(minReadBuffer))); old != minReadBuffer {
+			log.Debugf("AutoTune: average message of %d bytes, changing MinReadBuffer from %d to %d", average, old, minReadBuffer)
+		}
+	}
+}
+
+// coalesceWindow returns the CoalesceWindow currently in effect.
+func (server *Server) coalesceWindow() time.Duration {
+	if server.tuner != nil {
+		return time.Duration(atomic.LoadInt64(&server.tuner.coalesce))
+	}
+	return server.CoalesceWindow
+}
+
+// minReadBuffer returns the MinReadBuffer currently in effect.
+func (server *Server) minReadBuffer() int {
+	if server.tuner != nil {
+		return int(atomic.LoadInt64(&server.tuner.minReadBuffer))
+	}
+	return server.MinReadBuffer
+}
@@ -1,13 +1,16 @@
 package waddell
 
 import (
+	"bytes"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/getlantern/framed"
 	"github.com/getlantern/keyman"
 )
 
@@ -15,7 +18,61 @@ var (
 	maxReconnectDelay      = 5 * time.Second
 	reconnectDelayInterval = 100 * time.Millisecond
 
-	closedError = fmt.Errorf("Client closed")
+	bufferPool = sync.Pool{
+		New: func() interface{} {
+			return make([]byte, framed.MaxFrameLength)
+		},
+	}
+
+	messagePool = sync.Pool{
+		New: func() interface{} {
+			return &MessageIn{}
+		},
+	}
+
+	defaultBreakerProbeInterval = 30 * time.Second
+	defaultIdTimeout            = 30 * time.Second
+	defaultCreditTimeout        = 30 * time.Second
+
+	echoTimeout      = 10 * time.Second
+	heartbeatTimeout = 10 * time.Second
+	closeTimeout     = 5 * time.Second
+
+	// ErrNoIdAssigned is returned when the waddell server accepts a connection
+	// but doesn't assign a peer id within ClientConfig.IdTimeout.
+	ErrNoIdAssigned = fmt.Errorf("No peer id assigned")
+
+	// ErrCircuitOpen is returned while the client's circuit breaker is open,
+	// see ClientConfig.BreakerThreshold.
+	ErrCircuitOpen = fmt.Errorf("Circuit breaker open")
+
+	// ErrConnectionClosed is the error reported (e.g. to
+	// ClientConfig.OnDisconnect, wrapped in a DisconnectedError) when the
+	// waddell server closed the connection cleanly without giving a reason.
+	// Other failures to read from the server, like connections being reset,
+	// are reported as errors wrapping the underlying network error, so
+	// errors.Is(err, ErrConnectionClosed) tells the two apart.
+	ErrConnectionClosed = fmt.Errorf("Connection closed by server")
+
+	// ErrTruncated is reported instead of ErrConnectionClosed when a TLS
+	// connection to the server ended without the server sending close_notify,
+	// which could mean that an attacker cut the connection short.
+	ErrTruncated = fmt.Errorf("TLS connection closed without close_notify, possibly truncated")
+
+	// ErrMessageTooLarge is wrapped by the errors returned when trying to send
+	// a message whose body doesn't fit into a single frame. Nothing is written
+	// to the connection in that case. Bodies may be at most MaxDataLength bytes
+	// long, less any additional overhead of the particular way of sending
+	// (e.g. SendWithReceipt); the error message states the exact limit.
+	ErrMessageTooLarge = fmt.Errorf("Message too large")
+
+	// ErrClientClosed is returned by operations on a Client that has been
+	// closed, including receives (e.g. Session.Receive) that were blocked
+	// while it was closed.
+	ErrClientClosed = fmt.Errorf("Client closed")
+
+	closedError        = ErrClientClosed
+	reconnectRequested = fmt.Errorf("Reconnect requested")
 )
 
 type ClientConfig struct {
@@ -27,17 +84,234 @@ type ClientConfig struct {
 	// connection will be made plain-text.
 	ServerCert string
 
-	// ReconnectAttempts specifies how many consecutive times to try
-	// reconnecting in the event of a connection failure.
+	// GetClientCertificate optionally specifies a callback that supplies the
+	// certificate with which to authenticate this client to the waddell server
+	// when connecting with TLS (see tls.Config.GetClientCertificate). Since
+	// it's called on every TLS handshake, it can be used to rotate client
+	// certificates without recreating the client. Existing connections keep
+	// using the certificate with which they were established until they
+	// reconnect (see Reconnect).
+	GetClientCertificate func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+
+	// TLSConfig: optional TLS configuration with which to connect to the
+	// waddell server, e.g. to require TLS 1.3 (MinVersion) or restrict
+	// CipherSuites. If specified, the client connects with TLS even without
+	// a ServerCert, authenticating the server using RootCAs (or the system's
+	// roots). If ServerCert is also specified, it's used as the root and
+	// server name unless TLSConfig sets those itself. MinVersion defaults to
+	// TLS 1.2. The given config isn't modified.
+	TLSConfig *tls.Config
+
+	// InsecureFallbackDial: DANGEROUS - if specified along with ServerCert,
+	// the client falls back to connecting in plaintext using this function
+	// whenever the TLS handshake with the waddell server fails. This is meant
+	// for networks where TLS is blocked or intercepted by corporate proxies.
+	//
+	// Threat model: falling back to plaintext means that anyone who can
+	// interfere with the TLS handshake (which includes any on-path attacker)
+	// can force the client to connect without encryption or server
+	// authentication. Such an attacker can then read and modify all messages,
+	// impersonate the server and assign arbitrary peer ids. Only enable the
+	// fallback if messages are protected end-to-end by other means, and use
+	// Client.Info to check whether a given connection is actually secure
+	// before sending anything sensitive over it. Off (nil) by default.
+	InsecureFallbackDial DialFunc
+
+	// ReconnectAttempts specifies how many consecutive times to retry dialing
+	// after a failed attempt whenever the client connects, including when it
+	// first connects. 0 (the default) means that the client dials only once,
+	// a positive number N means that it dials up to N+1 times, with
+	// increasing delays in between. Negative values are treated like 0.
+	//
+	// Note - independently of ReconnectAttempts, when a client loses an
+	// established connection, it connects again the next time it's used,
+	// unless NoReconnect is set.
 	//
 	// Note - when auto reconnecting is enabled, the client will never resend
 	// messages, it will simply reopen the connection.
 	ReconnectAttempts int
 
+	// NoReconnect: if true, the client never reconnects on its own. It dials
+	// only once (ignoring ReconnectAttempts) and, if that fails, returns the
+	// dialing error as is. Once it loses its connection (including when the
+	// server redirects it), the client closes itself, and the error that
+	// caused it to lose the connection is available from OnDisconnect. This
+	// is for applications that manage the connection lifecycle themselves.
+	// Explicit calls to Reconnect still work.
+	NoReconnect bool
+
 	// OnId allows optionally registering a callback to be notified whenever a
 	// PeerId is assigned to this client (i.e. on each successful connection to
 	// the waddell server).
 	OnId func(id PeerId)
+
+	// DialRedirect, if specified, allows the client to follow redirects from
+	// the waddell server (see Server.Migrate). When redirected, the client
+	// drops its current connection and reconnects by calling DialRedirect with
+	// the address of the new server. If DialRedirect is nil, redirects are not
+	// followed.
+	DialRedirect func(addr string) (net.Conn, error)
+
+	// OnRedirect allows optionally registering a callback to be notified
+	// whenever the waddell server asks this client to reconnect to a different
+	// server, whether or not the redirect is followed.
+	OnRedirect func(addr string, reason string)
+
+	// OnDisconnect allows optionally registering a callback to be notified
+	// whenever the client's connection to the waddell server is lost. The
+	// error is a *DisconnectedError whose Reason tells whether the server
+	// closed the connection on purpose (e.g. because it's shutting down or
+	// because it kicked the client) or whether the connection was lost due to
+	// a network error. This isn't called when the client itself closes or
+	// reconnects. The client reconnects on next use regardless.
+	OnDisconnect func(err error)
+
+	// OnReconnect allows optionally registering a callback to be notified
+	// whenever the client has successfully reconnected to the waddell server
+	// (i.e. on every successful connection but the first), with the number of
+	// the reconnect (see ReconnectCount) and the client's new id. Frequent
+	// reconnects indicate an unstable network, which applications may want
+	// to react to, e.g. by backing off or switching servers.
+	OnReconnect func(attempt int, newId PeerId)
+
+	// OnIntroduction allows optionally registering a callback to be notified
+	// with the id of every peer that introduces itself to this client or that
+	// answers this client's introduction (see Client.Introduce).
+	OnIntroduction func(peer PeerId)
+
+	// InBufferSize optionally specifies how many received messages to buffer
+	// on each in topic before the client stops reading from the server. If 0,
+	// in topics are unbuffered.
+	InBufferSize int
+
+	// ReuseBuffers enables reusing the buffers into which messages are read,
+	// which reduces garbage collection pressure at high throughput.
+	//
+	// IMPORTANT - when reusing buffers, the Body of a received message is only
+	// valid until the application reads the next message from the same in
+	// topic. Applications that need to retain the Body for longer have to copy
+	// it.
+	ReuseBuffers bool
+
+	// PoolMessages enables taking received messages and the buffers into
+	// which they're read from a pool, so that receiving doesn't allocate. It
+	// takes precedence over ReuseBuffers and, unlike it, leaves the decision
+	// of when a message can be reused to the application.
+	//
+	// IMPORTANT - when pooling messages, the application has to call Release
+	// on every message it receives once it's done with it, and mustn't use the
+	// message (or its Body) afterwards. Messages that are never released are
+	// simply garbage collected.
+	PoolMessages bool
+
+	// FlowControl: if true, the client honors flow control credits that peers
+	// grant it (see Client.GrantCredits), waiting to send to a peer while that
+	// peer's credits are used up. Otherwise, credits are ignored, so peers
+	// can't slow down sending. See "Flow control credits".
+	FlowControl bool
+
+	// CreditTimeout: how long to wait for a peer to grant more credits before
+	// assuming that it's gone, forgetting its balance and failing the sends
+	// that are waiting for its credits (see FlowControl). Defaults to 30
+	// seconds.
+	CreditTimeout time.Duration
+
+	// Alias: optional short, human-friendly alias to register with the server
+	// on every connection, by which other peers can reach this client (see
+	// SendToAlias). Connecting fails with ErrAliasTaken if another peer already
+	// registered the alias. Aliases are at most MaxAliasLength bytes long.
+	//
+	// IMPORTANT - aliases aren't authenticated. Any client can claim any
+	// alias that isn't currently taken, so don't rely on them to identify
+	// peers.
+	Alias string
+
+	// LogId: optional function that determines how peer ids appear in the
+	// client's logs, for example to shorten them or to keep raw ids out of
+	// logs altogether. Defaults to PeerId.String.
+	LogId func(id PeerId) string
+
+	// Compress: if true, the client asks the waddell server to compress the
+	// connection with flate, which falls back to an uncompressed connection if
+	// the server doesn't support compression. Compressing the whole stream
+	// works well for peers that exchange many similar small messages, at the
+	// cost of some CPU and memory per connection. Since each frame is flushed
+	// immediately, compression doesn't add latency beyond that CPU time
+	// (unless FlushInterval is set).
+	Compress bool
+
+	// Intercept: optional function through which the client passes the body
+	// of every message that the application sends (on Out topics, Sessions
+	// or with the Send functions, including goodbyes) before framing it,
+	// with the id of the recipient (the zero PeerId for messages sent to
+	// aliases). Intercept returns the body to send instead, or false to drop
+	// the message, which allows e.g. signing or encrypting messages end to
+	// end. Intercept must not modify body in place and should return
+	// promptly, since it runs on the sending goroutine.
+	//
+	// Intercept sees whole messages, before any compression (see Compress)
+	// is applied to the connection, so bodies that it encrypts won't
+	// compress. Dropped messages are treated as sent, except by
+	// SendWithReceipt, which fails. SendFrom reads the whole body into
+	// memory before intercepting it instead of streaming it. Messages that
+	// the client sends on its own (receipts, credits, introductions,
+	// keepalives and echoes) aren't intercepted.
+	Intercept func(to PeerId, body []byte) ([]byte, bool)
+
+	// KeepAliveIdle: if greater than 0, the client automatically sends a
+	// keepalive to the server whenever it hasn't sent anything for this long,
+	// which keeps NAT mappings and idle timeouts along the way from closing
+	// the connection. Since any message sent resets the timer, connections
+	// that regularly carry messages never need keepalives, so this adds no
+	// overhead to busy connections. Disabled by default.
+	KeepAliveIdle time.Duration
+
+	// KeepAliveTarget: by default (the zero PeerId), keepalives are sent as
+	// single byte control frames. If set, keepalives are instead sent as
+	// empty messages addressed to this id, for servers that recognize
+	// keepalives by a reserved id (like KeepAliveId). To keep keepalives from
+	// ever being relayed to a peer, the target must be a reserved id (see
+	// IsReserved) other than ones that have another meaning, like EchoId.
+	// Servers that don't recognize the target drop keepalives sent to it
+	// (counting them as dropped, see DropRecipientNotConnected).
+	KeepAliveTarget PeerId
+
+	// FlushInterval: by default (0), every message is flushed to the network
+	// as soon as it's sent, which gives the lowest latency and suits
+	// signaling. If greater than 0, messages are instead buffered and flushed
+	// at most FlushInterval after being sent (or sooner, once enough of them
+	// accumulate), which coalesces bursts of messages into fewer syscalls and
+	// packets at the cost of adding up to FlushInterval of latency. This
+	// suits bulk transfers. Heartbeats and SendAndClose always flush right
+	// away, and Close flushes whatever is still buffered.
+	FlushInterval time.Duration
+
+	// IdTimeout: how long to wait for the waddell server to assign a peer id
+	// after connecting before giving up with ErrNoIdAssigned. This guards
+	// against servers that accept connections but never complete the
+	// handshake. Defaults to 30 seconds.
+	IdTimeout time.Duration
+
+	// Mode: optionally restricts the client to only sending (SendOnly) or only
+	// receiving (ReceiveOnly) messages, which guards against accidental misuse
+	// in asymmetric workloads like pure publishers. Defaults to Both.
+	Mode Mode
+
+	// BreakerThreshold: if greater than 0, enables a circuit breaker that
+	// opens after this many consecutive failed attempts to connect to the
+	// waddell server. While the circuit is open, the client only tries to
+	// connect once per BreakerProbeInterval and in between fails fast with
+	// ErrCircuitOpen instead of dialing. Rather than closing itself once it
+	// runs out of ReconnectAttempts, the client keeps probing until it either
+	// connects successfully (which closes the circuit) or is closed.
+	//
+	// Note - messages sent on Out topics while the circuit is open are
+	// dropped.
+	BreakerThreshold int
+
+	// BreakerProbeInterval: how long to wait between attempts to connect
+	// while the circuit breaker is open. Defaults to 30 seconds.
+	BreakerProbeInterval time.Duration
 }
 
 // Client is a client of a waddell server
@@ -45,13 +319,47 @@ type Client struct {
 	*ClientConfig
 
 	connInfoChs    chan chan *connInfo
-	connErrCh      chan error
+	connErrCh      chan *connError
 	topicsOut      map[TopicId]*topic
 	topicsOutMutex sync.Mutex
 	topicsIn       map[TopicId]chan *MessageIn
 	topicsInMutex  sync.Mutex
 	currentId      PeerId
+	welcome        []byte
+	info           ConnectionInfo
 	currentIdMutex sync.RWMutex
+	dialMutex      sync.RWMutex
+	echoCh         chan *MessageIn
+	echoMutex      sync.Mutex
+	pongCh         chan uint64
+	heartbeatSeq   uint64
+	heartbeatMutex sync.Mutex
+	failures       int       // consecutive failed attempts to connect
+	lastAttempt    time.Time // time of most recent attempt to connect
+	breakerMutex   sync.Mutex
+	disconnectErr  error // only accessed on stayConnected goroutine
+	receipts       map[receiptKey]chan error
+	receiptsMutex  sync.Mutex
+	receiptSeq     uint64
+	credits        map[PeerId]*creditBalance
+	handles        []*Handle // copied on write, see Dup
+	handlesMutex   sync.RWMutex
+	creditsMutex   sync.Mutex
+	sent           rateCounter
+	received       rateCounter
+	done           chan struct{} // closed once the client is closed
+	stopped        chan struct{} // closed once stayConnected has closed the connection
+	inboundDone    chan struct{} // closed once processInbound has returned
+	closeErr       error         // error closing the connection, set before stopped is closed
+	insClosed      bool          // whether in topics have been closed, protected by topicsInMutex
+	resumed        chan struct{} // closed unless paused
+	pauseMutex     sync.Mutex
+	filter         atomic.Value // func(*MessageIn) bool, see SetFilter
+	goodbye        *goodbye
+	goodbyeMutex   sync.Mutex
+	filtered       int64
+	connections    int64 // number of successful connections, see ReconnectCount
+	state          int32
 	closed         int32
 }
 
@@ -69,6 +377,16 @@ type DialFunc func() (net.Conn, error)
 // Note - if the client automatically reconnects, its peer ID will change. You
 // can obtain the new id through providing an OnId callback to the client.
 //
+// Note - none of the transports (TCP, TLS, Unix domain sockets and HTTP/2)
+// survive a change of the client's IP address, e.g. when a mobile device roams
+// from WiFi to cellular. The connection breaks and the client reconnects with
+// a new id, which it has to share with its correspondents again. Applications
+// on roaming devices should call Reconnect when they see the network change,
+// so as not to wait for the broken connection to time out. An Alias gives
+// correspondents a stable way to reach the client across reconnects, though it
+// only becomes available again once the server has noticed that the old
+// connection is gone.
+//
 // Note - whether or not auto reconnecting is enabled, this method doesn't
 // return until a connection has been established or we've failed trying.
 func NewClient(cfg *ClientConfig) (*Client, error) {
@@ -76,23 +394,72 @@ func NewClient(cfg *ClientConfig) (*Client, error) {
 		ClientConfig: cfg,
 	}
 	var err error
-	if c.ServerCert != "" {
-		c.Dial, err = secured(c.Dial, c.ServerCert)
+	if c.Alias != "" {
+		err = validateAlias(c.Alias)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = validateKeepAliveTarget(c.KeepAliveTarget)
+	if err != nil {
+		return nil, err
+	}
+	if c.usesTLS() {
+		c.Dial, err = c.secured(c.Dial, c.InsecureFallbackDial)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	c.connInfoChs = make(chan chan *connInfo)
-	c.connErrCh = make(chan error)
+	c.connErrCh = make(chan *connError)
 	c.topicsOut = make(map[TopicId]*topic)
 	c.topicsIn = make(map[TopicId]chan *MessageIn)
+	c.echoCh = make(chan *MessageIn, 1)
+	c.pongCh = make(chan uint64, 1)
+	c.receipts = make(map[receiptKey]chan error)
+	c.credits = make(map[PeerId]*creditBalance)
+	c.resumed = make(chan struct{})
+	close(c.resumed)
+	c.done = make(chan struct{})
+	c.stopped = make(chan struct{})
+	c.inboundDone = make(chan struct{})
 	go c.stayConnected()
 	go c.processInbound()
 	info := c.getConnInfo()
+	if info.err == nil && c.KeepAliveIdle > 0 {
+		go c.keepAlive()
+	}
 	return c, info.err
 }
 
+// keepAlive sends keepalives whenever the client has been idle for
+// KeepAliveIdle.
+func (c *Client) keepAlive() {
+	for {
+		wait := c.KeepAliveIdle
+		if c.State() == Connected {
+			info := c.getConnInfo()
+			if info.err == nil {
+				idleFor := info.idleFor()
+				if idleFor >= c.KeepAliveIdle {
+					err := c.SendKeepAlive()
+					if err != nil {
+						log.Tracef("Unable to send keepalive: %s", err)
+					}
+				} else {
+					wait = c.KeepAliveIdle - idleFor
+				}
+			}
+		}
+		select {
+		case <-c.done:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
 // CurrentId returns the current id (from most recent connection to waddell).
 // To be notified about changes to the id, use the OnId handler.
 func (c *Client) CurrentId() PeerId {
@@ -101,9 +468,218 @@ func (c *Client) CurrentId() PeerId {
 	return c.currentId
 }
 
-func (c *Client) setCurrentId(id PeerId) {
+// Pending returns the number of received messages that are currently buffered
+// on this client's in topics (including those of its Handles) and haven't yet
+// been read by the application. This can be used to detect that the
+// application is falling behind.
+//
+// Note - if InBufferSize is 0, in topics are unbuffered and Pending always
+// returns 0. In that case, a slow reader simply causes the client to stop
+// reading from the server.
+func (c *Client) Pending() int {
+	pending := 0
+	for _, ch := range c.allIns() {
+		pending += len(ch)
+	}
+	return pending
+}
+
+// DrainPending discards all received messages that are currently buffered on
+// this client's in topics and those of its Handles (see Pending) without
+// waiting for new ones, and
+// returns the number of messages that it discarded. This is useful for skipping
+// stale messages that accumulated while the application was busy, e.g. obsolete
+// ICE candidates. Drained messages are released (see MessageIn.Release).
+//
+// Note - this doesn't affect messages that are still in flight, including the
+// message that the client may be blocked on delivering to a full in topic.
+func (c *Client) DrainPending() int {
+	drained := 0
+	for _, ch := range c.allIns() {
+	drain:
+		for {
+			select {
+			case msg, open := <-ch:
+				if !open {
+					break drain
+				}
+				msg.Release()
+				drained++
+			default:
+				break drain
+			}
+		}
+	}
+	return drained
+}
+
+// allIns returns a snapshot of this client's in topics and those of its
+// Handles.
+func (c *Client) allIns() []chan *MessageIn {
+	c.topicsInMutex.Lock()
+	ins := make([]chan *MessageIn, 0, len(c.topicsIn))
+	for _, ch := range c.topicsIn {
+		ins = append(ins, ch)
+	}
+	c.topicsInMutex.Unlock()
+
+	c.handlesMutex.RLock()
+	handles := c.handles
+	c.handlesMutex.RUnlock()
+	for _, h := range handles {
+		h.topicsInMutex.Lock()
+		for _, ch := range h.topicsIn {
+			ins = append(ins, ch)
+		}
+		h.topicsInMutex.Unlock()
+	}
+	return ins
+}
+
+// Pause stops the client from reading messages from the waddell server until
+// Resume is called, e.g. while the application is busy processing a heavy
+// message. Since the client stops reading from the connection, the server
+// ends up unable to write to it, which pushes back on the server (and, if the
+// server applies Backpressure, on the peers sending to this client) instead
+// of having messages pile up in the client's in topics.
+//
+// A message that's already being read when Pause is called is still
+// delivered, but no further messages are read. Readers of in topics (and
+// Session.Receive) simply block until the client is resumed. While paused,
+// the client doesn't see any responses from the server either, so Heartbeat
+// and Echo time out, and a dead connection is only noticed when writing to it.
+// Closing the client also ends the pause.
+func (c *Client) Pause() {
+	c.pauseMutex.Lock()
+	defer c.pauseMutex.Unlock()
+	select {
+	case <-c.resumed:
+		c.resumed = make(chan struct{})
+	default:
+		// already paused
+	}
+}
+
+// Resume resumes reading messages after a call to Pause.
+func (c *Client) Resume() {
+	c.pauseMutex.Lock()
+	defer c.pauseMutex.Unlock()
+	select {
+	case <-c.resumed:
+		// not paused
+	default:
+		close(c.resumed)
+	}
+}
+
+// waitUntilResumed blocks for as long as the client is paused.
+func (c *Client) waitUntilResumed() {
+	c.pauseMutex.Lock()
+	resumed := c.resumed
+	c.pauseMutex.Unlock()
+	<-resumed
+}
+
+// SetFilter sets a predicate that's applied to every message received from
+// other peers before it's delivered to its in topic. Messages for which filter
+// returns false are discarded (and counted, see Filtered) without the
+// application ever seeing them, e.g. to ignore peers that the application isn't
+// interested in. The filter can be replaced at any time, including while
+// connected, and passing nil removes it.
+//
+// The filter runs on the goroutine that reads from the server, so it needs to
+// be fast. Senders of discarded messages that asked for a receipt don't get
+// one.
+func (c *Client) SetFilter(filter func(msg *MessageIn) bool) {
+	c.filter.Store(filter)
+}
+
+// Filtered returns the number of messages discarded by the filter set with
+// SetFilter.
+func (c *Client) Filtered() int64 {
+	return atomic.LoadInt64(&c.filtered)
+}
+
+// accepts checks whether the given message passes the filter set with
+// SetFilter, counting it if not.
+func (c *Client) accepts(msg *MessageIn) bool {
+	filter, _ := c.filter.Load().(func(msg *MessageIn) bool)
+	if filter == nil || filter(msg) {
+		return true
+	}
+	atomic.AddInt64(&c.filtered, 1)
+	return false
+}
+
+func (c *Client) getDial() DialFunc {
+	c.dialMutex.RLock()
+	defer c.dialMutex.RUnlock()
+	return c.Dial
+}
+
+// redirect handles a request from the server to reconnect to the server at the
+// given addr.
+func (c *Client) redirect(info *connInfo, addr string, reason string) {
+	log.Debugf("Redirected to %s: %s", addr, reason)
+	if c.OnRedirect != nil {
+		go c.OnRedirect(addr, reason)
+	}
+	if c.DialRedirect == nil {
+		return
+	}
+
+	var dial DialFunc = func() (net.Conn, error) {
+		return c.DialRedirect(addr)
+	}
+	if c.usesTLS() {
+		// When falling back to plaintext, do so with the new server
+		var fallback DialFunc
+		if c.InsecureFallbackDial != nil {
+			fallback = dial
+		}
+		var err error
+		dial, err = c.secured(dial, fallback)
+		if err != nil {
+			log.Errorf("Unable to follow redirect to %s: %s", addr, err)
+			return
+		}
+	}
+	c.dialMutex.Lock()
+	c.Dial = dial
+	c.dialMutex.Unlock()
+	c.connError(info, &DisconnectedError{Reason: CloseRedirected, Message: fmt.Sprintf("Redirected to %s: %s", addr, reason)})
+}
+
+// Welcome returns the payload that the waddell server sent this client when it
+// most recently connected (see Server.Welcome), or nil if the server didn't
+// send one.
+func (c *Client) Welcome() []byte {
+	c.currentIdMutex.RLock()
+	defer c.currentIdMutex.RUnlock()
+	return c.welcome
+}
+
+// setConnected records the details of a newly established connection.
+func (c *Client) setConnected(info *connInfo) {
+	_, secure := info.conn.(*tls.Conn)
+	if hc, ok := info.conn.(*httpClientConn); ok {
+		secure = hc.secure
+	}
 	c.currentIdMutex.Lock()
-	c.currentId = id
+	c.currentId = info.id
+	c.welcome = info.welcome
+	if len(c.welcome) == 0 {
+		c.welcome = nil
+	}
+	c.info = ConnectionInfo{
+		Id:              info.id,
+		ProtocolVersion: info.version,
+		Secure:          secure,
+		RemoteAddr:      info.conn.RemoteAddr(),
+		Compression:     info.compression,
+		ConnectedAt:     time.Now(),
+		Welcome:         c.welcome,
+	}
 	c.currentIdMutex.Unlock()
 }
 
@@ -118,13 +694,353 @@ func (c *Client) SendKeepAlive() error {
 	if info.err != nil {
 		return info.err
 	}
-	_, err := info.writer.Write(keepAlive)
+	var err error
+	if c.KeepAliveTarget == serverId {
+		err = info.write(keepAlive)
+	} else {
+		err = info.write(c.KeepAliveTarget.toBytes(), UnknownTopic.toBytes())
+	}
 	if err != nil {
-		c.connError(err)
+		c.connError(info, err)
 	}
 	return err
 }
 
+// validateKeepAliveTarget checks that keepalives sent to the given target (see
+// KeepAliveTarget) can't end up being relayed to a peer or being mistaken for
+// something else.
+func validateKeepAliveTarget(target PeerId) error {
+	if target == serverId {
+		return nil
+	}
+	if !IsReserved(target) {
+		return fmt.Errorf("KeepAliveTarget %s isn't reserved and could be a peer", target)
+	}
+	if target == EchoId || target == aliasId {
+		return fmt.Errorf("KeepAliveTarget %s is reserved for other uses", target)
+	}
+	return nil
+}
+
+// intercept passes the body of a message to the given peer through Intercept,
+// if set, returning the body to send instead or false if the message should be
+// dropped.
+func (c *Client) intercept(to PeerId, body [][]byte) ([][]byte, bool) {
+	if c.Intercept == nil {
+		return body, true
+	}
+	joined := make([]byte, 0, bodyLength(body))
+	for _, piece := range body {
+		joined = append(joined, piece...)
+	}
+	intercepted, ok := c.Intercept(to, joined)
+	if !ok {
+		log.Tracef("Intercept dropped message to %s", c.logId(to))
+		return nil, false
+	}
+	return [][]byte{intercepted}, true
+}
+
+// send writes a single message to the given peer on the given topic, like
+// processOut does for messages sent on Out channels, but returns an error
+// rather than panicking or blocking once the client is closed.
+func (c *Client) send(id TopicId, to PeerId, body [][]byte) error {
+	if c.isClosed() {
+		return closedError
+	}
+	if c.Mode == ReceiveOnly {
+		return fmt.Errorf("Unable to send on receive only client")
+	}
+	err := checkTopic(id)
+	if err != nil {
+		return err
+	}
+	body, ok := c.intercept(to, body)
+	if !ok {
+		return nil
+	}
+	size := bodyLength(body)
+	err = checkSize(size, MaxDataLength)
+	if err != nil {
+		return err
+	}
+	err = c.awaitCredit(to)
+	if err != nil {
+		return err
+	}
+	info := c.getConnInfo()
+	if info.err != nil {
+		return info.err
+	}
+	return c.writeMessage(info, id, to, body, size)
+}
+
+// writeMessage writes a message with the given body (of the given size) to the
+// given peer on the given topic, dropping the connection if that fails.
+func (c *Client) writeMessage(info *connInfo, id TopicId, to PeerId, body [][]byte, size int) error {
+	pieces := make([][]byte, 0, 2+len(body))
+	pieces = append(pieces, to.toBytes(), id.toBytes())
+	pieces = append(pieces, body...)
+	err := info.write(pieces...)
+	if err != nil {
+		c.connError(info, err)
+		return err
+	}
+	c.sent.add(time.Now(), size)
+	return nil
+}
+
+// SendFrom sends a message with the given length to the given peer on the
+// given topic, streaming its body directly from r onto the connection rather
+// than buffering it first. This is useful for relays and proxies that forward
+// data that's already available from a reader (e.g. another connection).
+//
+// SendFrom reads exactly length bytes from r, leaving any additional data in r
+// unread. If r yields fewer than length bytes, the frame can't be completed, so
+// the client drops its connection (it reconnects on next use) and returns an
+// error. Since SendFrom writes directly to the connection, messages sent with
+// it aren't ordered with respect to messages sent on the Out channel for the
+// same topic.
+func (c *Client) SendFrom(id TopicId, to PeerId, r io.Reader, length int) error {
+	if c.isClosed() {
+		return closedError
+	}
+	if c.Mode == ReceiveOnly {
+		return fmt.Errorf("Unable to send on receive only client")
+	}
+	err := checkTopic(id)
+	if err != nil {
+		return err
+	}
+	err = checkSize(length, MaxDataLength)
+	if err != nil {
+		return err
+	}
+	if c.Intercept != nil {
+		b := make([]byte, length)
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return err
+		}
+		body, ok := c.intercept(to, [][]byte{b})
+		if !ok {
+			return nil
+		}
+		r, length = bytes.NewReader(body[0]), len(body[0])
+		err = checkSize(length, MaxDataLength)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.awaitCredit(to)
+	if err != nil {
+		return err
+	}
+
+	info := c.getConnInfo()
+	if info.err != nil {
+		return info.err
+	}
+	err = info.writeFrom(to, id, r, length)
+	if err != nil {
+		c.connError(info, err)
+		return err
+	}
+	c.sent.add(time.Now(), length)
+	return nil
+}
+
+// SendBatch sends the given messages on the given topic, in order, flushing them
+// to the network in one go rather than one at a time, which saves syscalls when
+// sending bursts of messages (e.g. to many different peers). Messages that can't
+// be sent (e.g. because they're too big) are skipped without affecting the
+// rest of the batch. If any of the messages couldn't be sent, SendBatch returns
+// a *BatchError identifying which.
+func (c *Client) SendBatch(id TopicId, msgs []*MessageOut) error {
+	if c.isClosed() {
+		return closedError
+	}
+	if c.Mode == ReceiveOnly {
+		return fmt.Errorf("Unable to send on receive only client")
+	}
+	err := checkTopic(id)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, len(msgs))
+	failed := false
+	frames := make([][][]byte, 0, len(msgs))
+	sizes := make([]int, 0, len(msgs))
+	for i, msg := range msgs {
+		body, ok := c.intercept(msg.To, msg.Body)
+		if !ok {
+			continue
+		}
+		length := bodyLength(body)
+		err := checkSize(length, MaxDataLength)
+		if err != nil {
+			errs[i] = err
+			failed = true
+			continue
+		}
+		err = c.awaitCredit(msg.To)
+		if err != nil {
+			errs[i] = err
+			failed = true
+			continue
+		}
+		pieces := make([][]byte, 0, 2+len(body))
+		pieces = append(pieces, msg.To.toBytes(), id.toBytes())
+		pieces = append(pieces, body...)
+		frames = append(frames, pieces)
+		sizes = append(sizes, length)
+	}
+
+	if len(frames) > 0 {
+		info := c.getConnInfo()
+		err := info.err
+		if err == nil {
+			err = info.writeBatch(frames)
+			if err != nil {
+				c.connError(info, err)
+			}
+		}
+		if err != nil {
+			// We don't know which messages made it, so fail all of them
+			for i := range errs {
+				if errs[i] == nil {
+					errs[i] = err
+				}
+			}
+			return &BatchError{errs}
+		}
+		now := time.Now()
+		for _, size := range sizes {
+			c.sent.add(now, size)
+		}
+	}
+
+	if failed {
+		return &BatchError{errs}
+	}
+	return nil
+}
+
+// BatchError is the error returned by SendBatch when some of the messages in
+// the batch couldn't be sent.
+type BatchError struct {
+	// Errs: for each message in the batch, the error sending it, or nil if it
+	// was sent
+	Errs []error
+}
+
+func (e *BatchError) Error() string {
+	failed := 0
+	var first error
+	for _, err := range e.Errs {
+		if err != nil {
+			failed++
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return fmt.Sprintf("Unable to send %d of %d messages: %s", failed, len(e.Errs), first)
+}
+
+// Heartbeat pings the waddell server and waits for it to answer, which confirms
+// that the connection is alive end-to-end. It returns the round trip time to
+// the server. Unlike SendKeepAlive, this requires a server that speaks protocol
+// version 2 or later.
+func (c *Client) Heartbeat() (time.Duration, error) {
+	if c.isClosed() {
+		return 0, closedError
+	}
+
+	c.heartbeatMutex.Lock()
+	defer c.heartbeatMutex.Unlock()
+	info := c.getConnInfo()
+	if info.err != nil {
+		return 0, info.err
+	}
+	if info.version < 2 {
+		return 0, fmt.Errorf("Server protocol version %d doesn't support heartbeats", info.version)
+	}
+
+	c.heartbeatSeq++
+	seq := make([]byte, 8)
+	endianness.PutUint64(seq, c.heartbeatSeq)
+	start := time.Now()
+	err := info.writeNow(ping, seq)
+	if err != nil {
+		c.connError(info, err)
+		return 0, err
+	}
+	timeout := time.After(heartbeatTimeout)
+	for {
+		select {
+		case pong := <-c.pongCh:
+			if pong == c.heartbeatSeq {
+				return time.Since(start), nil
+			}
+			// Late answer to a previous heartbeat, keep waiting
+		case <-timeout:
+			return 0, fmt.Errorf("No heartbeat received within %s", heartbeatTimeout)
+		}
+	}
+}
+
+// Echo sends the given body to the waddell server's echo service and waits for
+// it to be echoed back, which is useful for verifying round-trip connectivity
+// to the server. The server needs to have Echo enabled, otherwise this times
+// out.
+func (c *Client) Echo(body []byte) (*MessageIn, error) {
+	if c.isClosed() {
+		return nil, closedError
+	}
+
+	c.echoMutex.Lock()
+	defer c.echoMutex.Unlock()
+	// Discard any late response to a previous echo
+	select {
+	case <-c.echoCh:
+	default:
+	}
+
+	info := c.getConnInfo()
+	if info.err != nil {
+		return nil, info.err
+	}
+	err := info.write(EchoId.toBytes(), UnknownTopic.toBytes(), body)
+	if err != nil {
+		c.connError(info, err)
+		return nil, err
+	}
+	select {
+	case msg := <-c.echoCh:
+		return msg, nil
+	case <-time.After(echoTimeout):
+		return nil, fmt.Errorf("No echo received within %s", echoTimeout)
+	}
+}
+
+// Reconnect closes this client's current connection to the waddell server and
+// establishes a new one, which yields a new PeerId (reported via OnId). This is
+// useful for periodically rotating ids. Messages continue to be received on
+// the same in topics, but any messages sent to the old id are lost.
+func (c *Client) Reconnect() error {
+	if c.isClosed() {
+		return closedError
+	}
+
+	info := c.getConnInfo()
+	if info.err == nil {
+		c.connError(info, reconnectRequested)
+	}
+	return c.getConnInfo().err
+}
+
 // Close closes this client, its topics and associated resources.
 //
 // WARNING - Close() closes the out topic channels. Attempts to write to these
@@ -139,48 +1055,391 @@ func (c *Client) Close() error {
 	if !justClosed {
 		return nil
 	}
+	c.Resume()
+	err := c.sayGoodbye(nil)
+	if err != nil {
+		log.Debugf("Unable to say goodbye: %s", err)
+	}
+	return c.doClose()
+}
 
-	var err error
+// checkSize returns an error wrapping ErrMessageTooLarge if a message body of
+// the given length exceeds the given maximum.
+func checkSize(length int, max int) error {
+	if length > max {
+		return fmt.Errorf("%w: body of %d bytes exceeds maximum of %d", ErrMessageTooLarge, length, max)
+	}
+	return nil
+}
+
+// bodyLength returns the total length of the given body pieces.
+func bodyLength(body [][]byte) int {
+	length := 0
+	for _, piece := range body {
+		length += len(piece)
+	}
+	return length
+}
+
+// goodbye is a message to send when closing the client, see SetGoodbye.
+type goodbye struct {
+	topic TopicId
+	to    PeerId
+	body  [][]byte
+}
+
+// SetGoodbye sets a final message to send on the given topic to the given peer
+// when the client is closed, so that the peer learns that this client is going
+// away (e.g. to hang up a call). Like SendAndClose, Close then waits for the
+// server to read the message before closing the connection. Saying goodbye is
+// best-effort: if the client isn't connected or the goodbye can't be sent
+// within a few seconds, Close closes the connection regardless. Calling
+// SetGoodbye again replaces the goodbye, see also ClearGoodbye.
+func (c *Client) SetGoodbye(id TopicId, to PeerId, body ...[]byte) {
+	c.goodbyeMutex.Lock()
+	c.goodbye = &goodbye{id, to, body}
+	c.goodbyeMutex.Unlock()
+}
+
+// ClearGoodbye removes the goodbye set with SetGoodbye.
+func (c *Client) ClearGoodbye() {
+	c.goodbyeMutex.Lock()
+	c.goodbye = nil
+	c.goodbyeMutex.Unlock()
+}
+
+// sayGoodbye sends the goodbye set with SetGoodbye, if any, and waits for the
+// server to read it. It uses the connection described by info or, if info is
+// nil, the current connection. Given a connection, it waits for the server to
+// read everything sent on it even without a goodbye, returning an error if
+// the server may not have.
+func (c *Client) sayGoodbye(info *connInfo) error {
+	c.goodbyeMutex.Lock()
+	g := c.goodbye
+	c.goodbye = nil
+	c.goodbyeMutex.Unlock()
+	if g == nil && info == nil {
+		return nil
+	}
+	if info == nil {
+		info = c.getConnInfo()
+		if info.err != nil {
+			log.Debugf("Not connected, unable to say goodbye to %s: %s", c.logId(g.to), info.err)
+			return nil
+		}
+	}
+	if g != nil {
+		body, ok := c.intercept(g.to, g.body)
+		if ok {
+			pieces := make([][]byte, 0, 2+len(body))
+			pieces = append(pieces, g.to.toBytes(), g.topic.toBytes())
+			pieces = append(pieces, body...)
+			info.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+			err := info.writeNow(pieces...)
+			if err != nil {
+				log.Debugf("Unable to say goodbye to %s: %s", c.logId(g.to), err)
+			}
+		}
+	}
+	return c.awaitServerClose(info)
+}
+
+// SendAndClose sends a single message to the given peer on the given topic and
+// then closes this client, making sure that the message made it to the server
+// before closing the connection. This supports short-lived clients that connect
+// only to send one message. It returns an error if the message may not have
+// made it to the server. Like Close, SendAndClose says goodbye (see
+// SetGoodbye), right after sending the message.
+//
+// To make sure that the server has read the message, SendAndClose shuts down
+// the sending side of the connection (if the connection supports it, like TCP,
+// TLS and Unix domain socket connections do) and waits for the server to close
+// the connection in turn.
+func (c *Client) SendAndClose(id TopicId, to PeerId, body ...[]byte) error {
+	if c.isClosed() {
+		return closedError
+	}
+	if c.Mode == ReceiveOnly {
+		return fmt.Errorf("Unable to send on receive only client")
+	}
+	err := checkTopic(id)
+	if err != nil {
+		return err
+	}
+	body, ok := c.intercept(to, body)
+	if !ok {
+		return c.Close()
+	}
+	err = checkSize(bodyLength(body), MaxDataLength)
+	if err != nil {
+		return err
+	}
+	err = c.awaitCredit(to)
+	if err != nil {
+		return err
+	}
+	info := c.getConnInfo()
+	if info.err != nil {
+		c.Close()
+		return info.err
+	}
+	pieces := make([][]byte, 0, 2+len(body))
+	pieces = append(pieces, to.toBytes(), id.toBytes())
+	pieces = append(pieces, body...)
+	err = info.writeNow(pieces...)
+	if err != nil {
+		c.Close()
+		return err
+	}
+
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return closedError
+	}
+	// Close like Close does, but make sure that the server read our message.
+	// We need to read in order to see the server closing the connection.
+	c.Resume()
+	err = c.sayGoodbye(info)
+	c.doClose()
+	return err
+}
+
+// awaitServerClose shuts down the sending side of the connection described by
+// info (if the connection supports it) and waits up to closeTimeout for the
+// server to close the connection in turn, which it does once it has read
+// everything that was sent.
+func (c *Client) awaitServerClose(info *connInfo) error {
+	cw, ok := info.conn.(interface{ CloseWrite() error })
+	if !ok {
+		return nil
+	}
+	err := cw.CloseWrite()
+	if err != nil {
+		return err
+	}
+	select {
+	case <-info.done:
+		return nil
+	case <-time.After(closeTimeout):
+		return fmt.Errorf("Server didn't close connection within %v", closeTimeout)
+	}
+}
+
+// doClose shuts down the client once it has been marked as closed. Closing
+// c.done stops stayConnected, which closes the connection. That ends any read
+// in progress, so processInbound returns, closing the in topics on its way out.
+// Since processInbound is the only goroutine that sends on the in topics, it
+// never sends on a closed channel, and receives that are blocked on the in
+// topics end once doClose returns.
+func (c *Client) doClose() error {
 	log.Trace("Closing client")
-	c.topicsInMutex.Lock()
-	defer c.topicsInMutex.Unlock()
+	close(c.done)
+	c.closeHandles()
 	c.topicsOutMutex.Lock()
-	defer c.topicsOutMutex.Unlock()
 	for _, t := range c.topicsOut {
 		close(t.out)
 	}
+	c.topicsOutMutex.Unlock()
+	<-c.stopped
+	<-c.inboundDone
+	return c.closeErr
+}
+
+// closeIns closes all in topics. Topics requested after this are closed right
+// away.
+func (c *Client) closeIns() {
+	c.topicsInMutex.Lock()
+	defer c.topicsInMutex.Unlock()
+	c.insClosed = true
 	for _, ch := range c.topicsIn {
 		close(ch)
 	}
-	info := c.getConnInfo()
-	if info.conn != nil {
-		err = info.conn.Close()
-		log.Trace("Closed client connection")
-	}
-	close(c.connInfoChs)
-	return err
+}
+
+func (c *Client) usesTLS() bool {
+	return c.ServerCert != "" || c.TLSConfig != nil
 }
 
 // secured wraps the given dial function with TLS support, authenticating the
-// waddell server using the supplied cert (assumed to be PEM encoded).
-func secured(dial DialFunc, cert string) (DialFunc, error) {
-	c, err := keyman.LoadCertificateFromPEMBytes([]byte(cert))
-	if err != nil {
-		return nil, err
+// waddell server using the TLSConfig and/or ServerCert (assumed to be PEM
+// encoded). If fallback
+// is non-nil, it's used to connect in plaintext if the TLS handshake fails.
+func (c *Client) secured(dial DialFunc, fallback DialFunc) (DialFunc, error) {
+	tlsConfig := &tls.Config{}
+	if c.TLSConfig != nil {
+		tlsConfig = c.TLSConfig.Clone()
+	}
+	if tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = tls.VersionTLS12
 	}
-	tlsConfig := &tls.Config{
-		RootCAs:    c.PoolContainingCert(),
-		ServerName: c.X509().Subject.CommonName,
+	if c.ServerCert != "" {
+		cert, err := keyman.LoadCertificateFromPEMBytes([]byte(c.ServerCert))
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig.RootCAs == nil {
+			tlsConfig.RootCAs = cert.PoolContainingCert()
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = cert.X509().Subject.CommonName
+		}
+	}
+	if c.GetClientCertificate != nil {
+		tlsConfig.GetClientCertificate = c.GetClientCertificate
 	}
 	return func() (net.Conn, error) {
 		conn, err := dial()
 		if err != nil {
 			return nil, err
 		}
-		return tls.Client(conn, tlsConfig), nil
+		tlsConn := tls.Client(&eofConn{Conn: conn}, tlsConfig)
+		if fallback == nil {
+			return tlsConn, nil
+		}
+		// Handshake now so that we know whether to fall back
+		conn.SetDeadline(time.Now().Add(c.idTimeout()))
+		err = tlsConn.Handshake()
+		if err == nil {
+			conn.SetDeadline(time.Time{})
+			return tlsConn, nil
+		}
+		tlsConn.Close()
+		log.Errorf("TLS handshake failed, falling back to INSECURE plaintext connection: %s", err)
+		return fallback()
 	}, nil
 }
 
+// ConnectionInfo describes a Client's connection to the waddell server.
+type ConnectionInfo struct {
+	// Id: the peer id assigned by the server
+	Id PeerId
+
+	// ProtocolVersion: the protocol version spoken by the server
+	ProtocolVersion int
+
+	// Secure: whether the connection is secured with TLS (including HTTP/2
+	// connections over TLS, see DialHTTP2). This is false for plaintext
+	// connections, including when falling back to plaintext (see
+	// ClientConfig.InsecureFallbackDial).
+	Secure bool
+
+	// RemoteAddr: the address of the server
+	RemoteAddr net.Addr
+
+	// Compression: the algorithm with which the connection is compressed
+	// (currently only "flate"), or empty if it isn't compressed. This is empty
+	// unless ClientConfig.Compress is set and the server agreed to compress,
+	// so it's a handy way to verify that compression actually engaged.
+	Compression string
+
+	// ConnectedAt: when the connection was established
+	ConnectedAt time.Time
+
+	// Welcome: the welcome payload, see Client.Welcome
+	Welcome []byte
+}
+
+// Info returns information about this client's most recent connection to the
+// waddell server. It's recorded once the connection is established, so calling
+// Info is cheap. The zero ConnectionInfo is returned if the client never
+// connected.
+func (c *Client) Info() ConnectionInfo {
+	c.currentIdMutex.RLock()
+	defer c.currentIdMutex.RUnlock()
+	return c.info
+}
+
+// Mode specifies whether a Client sends messages, receives them or both.
+type Mode int
+
+const (
+	// Both: the client sends and receives messages
+	Both = Mode(0)
+
+	// SendOnly: the client only sends messages. Messages that other peers send
+	// to it are discarded.
+	SendOnly = Mode(1)
+
+	// ReceiveOnly: the client only receives messages
+	ReceiveOnly = Mode(2)
+)
+
+func (m Mode) String() string {
+	switch m {
+	case SendOnly:
+		return "send only"
+	case ReceiveOnly:
+		return "receive only"
+	default:
+		return "both"
+	}
+}
+
+// State describes the state of a Client's connection to the waddell server.
+type State int32
+
+const (
+	// Disconnected: the client isn't currently connected and will connect
+	// on next use
+	Disconnected = State(0)
+
+	// Connected: the client is connected
+	Connected = State(1)
+
+	// CircuitOpen: the client's circuit breaker is open, see
+	// ClientConfig.BreakerThreshold
+	CircuitOpen = State(2)
+
+	// Closed: the client has been closed
+	Closed = State(3)
+)
+
+func (s State) String() string {
+	switch s {
+	case Connected:
+		return "connected"
+	case CircuitOpen:
+		return "circuit open"
+	case Closed:
+		return "closed"
+	default:
+		return "disconnected"
+	}
+}
+
+// ReconnectCount returns how many times this client has successfully
+// reconnected to the waddell server since it was created, for whatever reason
+// (e.g. lost connections, redirects or calls to Reconnect). Since this counts
+// over the client's whole lifetime, it complements State, which only tells
+// about the current connection.
+func (c *Client) ReconnectCount() int {
+	connections := atomic.LoadInt64(&c.connections)
+	if connections == 0 {
+		return 0
+	}
+	return int(connections - 1)
+}
+
+// State returns the current state of this client's connection to the waddell
+// server.
+func (c *Client) State() State {
+	if c.isClosed() {
+		return Closed
+	}
+	return State(atomic.LoadInt32(&c.state))
+}
+
+func (c *Client) setState(s State) {
+	atomic.StoreInt32(&c.state, int32(s))
+}
+
+// logId returns the given id as it should appear in logs, see LogId.
+func (c *Client) logId(id PeerId) fmt.Stringer {
+	if c.LogId == nil {
+		return id
+	}
+	return idLabel{id, c.LogId}
+}
+
 func (c *Client) isClosed() bool {
-	return c.closed == 1
+	return atomic.LoadInt32(&c.closed) == 1
 }
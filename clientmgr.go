@@ -1,6 +1,7 @@
 package waddell
 
 import (
+	"crypto/tls"
 	"net"
 	"sync"
 )
@@ -16,6 +17,11 @@ type ClientMgr struct {
 	// connection will be made plain-text.
 	ServerCert string
 
+	// GetClientCertificate optionally supplies the certificate with which to
+	// authenticate to waddell servers. See Client.GetClientCertificate for more
+	// information.
+	GetClientCertificate func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+
 	// ReconnectAttempts specifies how many consecutive times to try
 	// reconnecting in the event of a connection failure. See
 	// Client.ReconnectAttempts for more information.
@@ -26,6 +32,10 @@ type ClientMgr struct {
 	// each successful connection to the waddell server at addr).
 	OnId func(addr string, id PeerId)
 
+	// InBufferSize specifies how many received messages to buffer on each in
+	// topic. See Client.InBufferSize for more information.
+	InBufferSize int
+
 	clients      map[string]*Client
 	clientsMutex sync.Mutex
 }
@@ -45,8 +55,10 @@ func (m *ClientMgr) ClientTo(addr string) (*Client, error) {
 			Dial: func() (net.Conn, error) {
 				return m.Dial(addr)
 			},
-			ServerCert:        m.ServerCert,
-			ReconnectAttempts: m.ReconnectAttempts,
+			ServerCert:           m.ServerCert,
+			GetClientCertificate: m.GetClientCertificate,
+			ReconnectAttempts:    m.ReconnectAttempts,
+			InBufferSize:         m.InBufferSize,
 		}
 		if m.OnId != nil {
 			cfg.OnId = func(id PeerId) {
@@ -23,6 +23,7 @@
 //   waddell server -> peer 2 : send newly assigned peer id
 //
 //   (out of band)            : peer 1 lets peer 2 know about its id
+//                              (see Client.Introduce for confirming it)
 //
 //   peer 2 -> waddell server : send message to peer 1
 //
@@ -53,11 +54,23 @@
 //
 //   160+    Message Body    - whatever data the client sent
 //
+// Frames that originate from the waddell server itself (system frames, e.g.
+// redirects) use the all-zero peer id as the sender and use the Topic ID to
+// identify the kind of system frame.
+//
+// Messages that one peer sends to another on the same topic arrive in the order
+// in which they were sent. Clients write each topic from a single goroutine and
+// the server reads each connection on a single goroutine, relaying each message
+// to its recipient before reading the next one. Messages on different topics
+// aren't ordered relative to each other.
+//
 package waddell
 
 import (
+	"encoding/base64"
 	"encoding/binary"
 	"fmt"
+	"io"
 
 	"github.com/getlantern/buuid"
 	"github.com/getlantern/framed"
@@ -71,7 +84,18 @@ const (
 	WaddellOverhead     = framed.FrameHeaderLength + WaddellHeaderLength // bytes of overhead imposed by waddell
 	MaxDataLength       = framed.MaxFrameLength - WaddellOverhead
 
+	compactPeerIdLength = 22 // see PeerId.CompactString
+
 	UnknownTopic = TopicId(0)
+
+	// ProtocolVersion is the version of the waddell protocol spoken by this
+	// package. Servers send it to clients in the topic field of the frame that
+	// assigns the client's id (servers that predate versioning send 0).
+	//
+	// Version 1 added stream compression, version 2 added heartbeats, version
+	// 3 added welcome frames, version 4 added aliases and version 5 only sends
+	// welcome frames to peers that have a welcome payload.
+	ProtocolVersion = 5
 )
 
 var (
@@ -80,6 +104,7 @@ var (
 	endianness = binary.LittleEndian
 
 	keepAlive = []byte{'k'}
+	ping      = []byte{'p'}
 )
 
 // MessageOut is a message to a waddell server
@@ -88,11 +113,37 @@ type MessageOut struct {
 	Body [][]byte
 }
 
-// MessageIn is a message to a waddell server
+// MessageIn is a message from a waddell server
 type MessageIn struct {
+	// From is the id of the sending peer. It is always set by the waddell
+	// server based on the id that it assigned to the sender's connection, so
+	// it can't be forged by the sender.
 	From  PeerId
 	topic TopicId
-	Body  []byte
+
+	// Body is always the complete message as sent. Waddell only runs over
+	// reliable, ordered streams (TCP, TLS or Unix domain sockets) and every
+	// message travels in a single frame, so messages are never lost or
+	// delivered partially. Messages that are too big for the server's buffers
+	// (see Server.BufferBytes) aren't truncated either; instead, the server
+	// disconnects the sender and the message is never delivered.
+	Body []byte
+
+	buf []byte // pooled buffer holding Body, see ClientConfig.PoolMessages
+}
+
+// Release returns a message received by a client with
+// ClientConfig.PoolMessages enabled, along with the buffer holding its Body, to
+// the pool for reuse by later messages. Neither the message nor its Body may be
+// used after calling Release. For messages that weren't pooled, Release does
+// nothing.
+func (msg *MessageIn) Release() {
+	if msg.buf == nil {
+		return
+	}
+	bufferPool.Put(msg.buf)
+	*msg = MessageIn{}
+	messagePool.Put(msg)
 }
 
 // Message builds a new message to the given peer with the given body.
@@ -103,6 +154,17 @@ func Message(to PeerId, body ...[]byte) *MessageOut {
 // PeerId is an identifier for a waddell peer
 type PeerId buuid.ID
 
+// idLabel is a PeerId that's formatted with a custom function, see
+// Server.LogId and ClientConfig.LogId.
+type idLabel struct {
+	id     PeerId
+	format func(id PeerId) string
+}
+
+func (l idLabel) String() string {
+	return l.format(l.id)
+}
+
 // PeerIdFromString constructs a PeerId from the string-encoded version of a
 // uuid.UUID.
 func PeerIdFromString(s string) (PeerId, error) {
@@ -114,6 +176,26 @@ func (id PeerId) String() string {
 	return buuid.ID(id).String()
 }
 
+// CompactString encodes this PeerId as the unpadded base64url encoding of its 16
+// bytes. At 22 characters, this is shorter than String (36 characters), which
+// makes it handier for sharing ids out-of-band, e.g. in URLs or QR codes. The
+// two encodings can be told apart by their length.
+func (id PeerId) CompactString() string {
+	return base64.RawURLEncoding.EncodeToString(id.toBytes())
+}
+
+// PeerIdFromCompactString constructs a PeerId from its CompactString encoding.
+func PeerIdFromCompactString(s string) (PeerId, error) {
+	if len(s) != compactPeerIdLength {
+		return PeerId{}, fmt.Errorf("Compact peer id should be %d characters, not %d", compactPeerIdLength, len(s))
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return PeerId{}, fmt.Errorf("Unable to decode compact peer id: %w", err)
+	}
+	return readPeerId(b)
+}
+
 func readPeerId(b []byte) (PeerId, error) {
 	id, err := buuid.Read(b)
 	return PeerId(id), err
@@ -123,6 +205,19 @@ func randomPeerId() PeerId {
 	return PeerId(buuid.Random())
 }
 
+// randomPeerIdFrom generates a random (type 4 UUID) PeerId using entropy from
+// the given source.
+func randomPeerIdFrom(r io.Reader) (PeerId, error) {
+	b := make([]byte, 16)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return PeerId{}, fmt.Errorf("Unable to read random bytes: %w", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return readPeerId(b)
+}
+
 func (id PeerId) write(b []byte) error {
 	return buuid.ID(id).Write(b)
 }
@@ -132,8 +227,33 @@ func (id PeerId) toBytes() []byte {
 }
 
 // TopicId identifies a topic for messages.
+//
+// Topics are how a pair of peers runs several independent streams of messages
+// (e.g. one per WebRTC connection being negotiated) over a single connection
+// each. The topic travels in the 16-bit Topic ID field of every frame, which
+// the server relays untouched, and each topic gets its own channel on the
+// receiving Client (see Client.In). Messages on the same topic arrive in
+// order, while messages on different topics are independent. Applications
+// that need more streams can add their own stream ids to message bodies.
+//
+// Topics 0xfffe and 0xffff are reserved for delivery receipts (see
+// Client.SendWithReceipt), topic 0xfffd for flow control credits (see
+// Client.GrantCredits) and topic 0xfffc for introductions (see
+// Client.Introduce). Clients refuse to send or receive on reserved topics
+// directly.
 type TopicId uint16
 
+// firstReservedTopic is the lowest reserved topic, see TopicId.
+const firstReservedTopic = TopicId(0xfffc)
+
+// checkTopic returns an error if the given topic is reserved.
+func checkTopic(id TopicId) error {
+	if id >= firstReservedTopic {
+		return fmt.Errorf("Topic %d is reserved", id)
+	}
+	return nil
+}
+
 func readTopicId(b []byte) (TopicId, error) {
 	if len(b) < TopicIdLength {
 		return 0, fmt.Errorf("Insufficient data for decoding 16-bit TopicId")
@@ -0,0 +1,54 @@
+package waddell
+
+import (
+	"compress/flate"
+	"io"
+
+	"github.com/getlantern/framed"
+)
+
+// Stream compression
+//
+// Clients that set ClientConfig.Compress ask servers that speak protocol
+// version 1 or later to compress the whole connection. The exchange looks like
+// this:
+//
+//   client -> server : compress request (single byte 'z', like a keepalive)
+//
+//   server -> client : compression frame (system frame whose body names the
+//                      algorithm, currently "flate", or is empty if the server
+//                      declined)
+//
+// Servers that don't speak protocol version 1, or that don't allow
+// compression, leave the connection uncompressed, as reported by
+// ConnectionInfo.Compression. Clients that don't support the algorithm chosen
+// by the server fail to connect, since the server already compresses what it
+// writes after the compression frame.
+//
+// If the server agreed, each side compresses everything it writes after the
+// compression frame (the client doesn't write anything in between). Each
+// frame is flushed individually, so compression adds no latency beyond the
+// CPU needed to compress and decompress.
+
+const (
+	compressionFlate = "flate"
+)
+
+var (
+	compressRequest = []byte{'z'}
+)
+
+// compressedReader returns a framed.Reader that reads frames from a flate
+// compressed stream.
+func compressedReader(r io.Reader) *framed.Reader {
+	return framed.NewReader(flate.NewReader(r))
+}
+
+// compressedWriter returns a framed.Writer that writes frames to a flate
+// compressed stream, along with the flate.Writer that needs to be flushed after
+// each frame.
+func compressedWriter(w io.Writer) (*framed.Writer, *flate.Writer) {
+	// Error only happens with invalid compression level
+	fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+	return framed.NewWriter(fw), fw
+}
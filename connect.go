@@ -1,61 +1,117 @@
 package waddell
 
 import (
+	"bufio"
+	"compress/flate"
 	"fmt"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/framed"
 )
 
 type connInfo struct {
-	id     PeerId
-	conn   net.Conn
-	reader *framed.Reader
-	writer *framed.Writer
-	err    error
+	id          PeerId
+	version     int // protocol version spoken by the server
+	compression string
+	welcome     []byte
+	done        chan struct{} // closed once the client disconnects
+	conn        net.Conn
+	reader      *framed.Reader
+	writer      *framed.Writer
+	flusher     *flate.Writer // non-nil if writes are compressed
+	buffered    *bufio.Writer // non-nil if writes are coalesced, see FlushInterval
+	interval    time.Duration // see FlushInterval
+	scheduled   bool          // whether a flush is scheduled
+	lastWrite   int64         // unix nanos of most recent write, see touch
+	writeMutex  sync.Mutex
+	err         error
+}
+
+// connError is an error encountered on the connection described by info.
+type connError struct {
+	info *connInfo
+	err  error
 }
 
 func (c *Client) stayConnected() {
 	var info *connInfo
 	for {
 		select {
-		case err := <-c.connErrCh:
-			log.Tracef("Encountered error, disconnecting: %s", err)
-			if info != nil {
-				info.conn.Close()
-				info = nil
+		case <-c.done:
+			if info != nil && info.conn != nil {
+				c.closeErr = info.close()
+				close(info.done)
+			}
+			close(c.stopped)
+			return
+		case e := <-c.connErrCh:
+			if info == nil || info != e.info {
+				log.Tracef("Ignoring error on stale connection: %s", e.err)
+				continue
 			}
-		case infoCh, open := <-c.connInfoChs:
-			if !open {
-				log.Trace("connInfoChs closed, done processing")
-				return
+			log.Tracef("Encountered error, disconnecting: %s", e.err)
+			info.conn.Close()
+			close(info.done)
+			info = nil
+			if c.NoReconnect && e.err != reconnectRequested {
+				c.disconnectErr = e.err
 			}
+			c.setState(Disconnected)
+			c.disconnected(e.err)
+		case infoCh := <-c.connInfoChs:
 			if info == nil {
 				info = c.connect()
+				switch info.err {
+				case nil:
+					c.setState(Connected)
+				case ErrCircuitOpen:
+					c.setState(CircuitOpen)
+				}
 			}
 			infoCh <- info
+			if info.err == ErrCircuitOpen {
+				// Don't hold on to this, so that we probe again once it's time
+				info = nil
+			}
 		}
 	}
 }
 
 func (c *Client) connect() *connInfo {
 	log.Trace("Connecting ...")
+	if c.NoReconnect {
+		return c.connectNoReconnect()
+	}
+	reconnectAttempts := c.ReconnectAttempts
+	if reconnectAttempts < 0 {
+		reconnectAttempts = 0
+	}
 	var lastErr error
-	for consecutiveFailures := 0; consecutiveFailures <= c.ReconnectAttempts; consecutiveFailures++ {
+	for consecutiveFailures := 0; consecutiveFailures <= reconnectAttempts; consecutiveFailures++ {
 		if c.isClosed() {
 			log.Tracef("Connection closed, stop trying to connect")
 			return &connInfo{
 				err: closedError,
 			}
 		}
-		delay := time.Duration(consecutiveFailures) * reconnectDelayInterval
-		if delay > maxReconnectDelay {
-			delay = maxReconnectDelay
+		if c.untilProbe() > 0 {
+			log.Trace("Circuit breaker open, not dialing")
+			return &connInfo{err: ErrCircuitOpen}
+		}
+		if !c.breakerOpen() {
+			delay := time.Duration(consecutiveFailures) * reconnectDelayInterval
+			if delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			log.Tracef("Waiting %s before dialing", delay)
+			time.Sleep(delay)
 		}
-		log.Tracef("Waiting %s before dialing", delay)
-		time.Sleep(delay)
 		info, err := c.connectOnce()
+		c.recordAttempt(err)
 		if err == nil {
 			return info
 		}
@@ -64,40 +120,357 @@ func (c *Client) connect() *connInfo {
 		info = nil
 	}
 
-	err := fmt.Errorf("Unable to connect within %d tries: %s", c.ReconnectAttempts+1, lastErr)
+	err := fmt.Errorf("Unable to connect within %d tries: %w", reconnectAttempts+1, lastErr)
 	log.Trace(err)
 	return &connInfo{err: err}
 }
 
+// connectNoReconnect connects once (if we haven't lost a connection yet) and
+// returns errors unwrapped.
+func (c *Client) connectNoReconnect() *connInfo {
+	if c.isClosed() {
+		return &connInfo{err: closedError}
+	}
+	if c.disconnectErr != nil {
+		return &connInfo{err: c.disconnectErr}
+	}
+	info, err := c.connectOnce()
+	if err != nil {
+		return &connInfo{err: err}
+	}
+	return info
+}
+
+// recordAttempt records the outcome of an attempt to connect for the circuit
+// breaker.
+func (c *Client) recordAttempt(err error) {
+	c.breakerMutex.Lock()
+	defer c.breakerMutex.Unlock()
+	c.lastAttempt = time.Now()
+	if err == nil {
+		c.failures = 0
+	} else {
+		c.failures++
+	}
+}
+
+func (c *Client) breakerOpen() bool {
+	c.breakerMutex.Lock()
+	defer c.breakerMutex.Unlock()
+	return c.BreakerThreshold > 0 && c.failures >= c.BreakerThreshold
+}
+
+// untilProbe returns how long it is until the client may try to connect again
+// while its circuit breaker is open, or 0 if it may connect right away.
+func (c *Client) untilProbe() time.Duration {
+	if !c.breakerOpen() {
+		return 0
+	}
+	interval := c.BreakerProbeInterval
+	if interval <= 0 {
+		interval = defaultBreakerProbeInterval
+	}
+	c.breakerMutex.Lock()
+	defer c.breakerMutex.Unlock()
+	wait := interval - time.Since(c.lastAttempt)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+func (c *Client) idTimeout() time.Duration {
+	if c.IdTimeout <= 0 {
+		return defaultIdTimeout
+	}
+	return c.IdTimeout
+}
+
 func (c *Client) connectOnce() (*connInfo, error) {
-	conn, err := c.Dial()
+	conn, err := c.getDial()()
 	if err != nil {
 		return nil, err
 	}
 	info := &connInfo{
-		conn:   conn,
-		reader: framed.NewReader(conn),
-		writer: framed.NewWriter(conn),
+		done:     make(chan struct{}),
+		conn:     conn,
+		reader:   framed.NewReader(conn),
+		writer:   framed.NewWriter(conn),
+		interval: c.FlushInterval,
+	}
+	info.touch()
+	if info.interval > 0 {
+		info.buffered = bufio.NewWriter(conn)
+		info.writer = framed.NewWriter(info.buffered)
 	}
 	// Read first message to get our PeerId
-	msg, err := info.receive()
+	conn.SetReadDeadline(time.Now().Add(c.idTimeout()))
+	frame, err := info.reader.ReadFrame()
 	if err != nil {
-		return nil, fmt.Errorf("Unable to get peerid: %s", err)
+		conn.Close()
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			err = ErrNoIdAssigned
+		}
+		return nil, fmt.Errorf("Unable to get peerid: %w", err)
+	}
+	msg, err := info.parse(frame)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to get peerid: %w", err)
+	}
+	if msg.From == serverId && msg.topic == rejectFrame {
+		conn.Close()
+		return nil, decodeReject(msg.Body)
 	}
 	info.id = msg.From
+	info.version = int(msg.topic &^ welcomeFlag)
+	// Versions 3 and 4 always send a welcome, later versions flag it
+	if msg.topic&welcomeFlag != 0 || info.version == 3 || info.version == 4 {
+		frame, err = info.reader.ReadFrame()
+		if err == nil {
+			msg, err = info.parse(frame)
+		}
+		if err == nil && (msg.From != serverId || msg.topic != welcomeFrame) {
+			err = fmt.Errorf("Expected welcome frame")
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Unable to get welcome: %w", err)
+		}
+		info.welcome = msg.Body
+	}
+	if c.Compress && info.version >= 1 {
+		err = info.startCompression()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Unable to start compression: %w", err)
+		}
+	}
+	if c.Alias != "" {
+		err = info.registerAlias(c.Alias)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Unable to register alias: %w", err)
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
 	if c.OnId != nil {
 		go c.OnId(info.id)
 	}
-	c.setCurrentId(info.id)
+	c.setConnected(info)
+	// Peers granted any credits to our previous id
+	c.forgetAllCredits()
+	connections := atomic.AddInt64(&c.connections, 1)
+	if connections > 1 && c.OnReconnect != nil {
+		go c.OnReconnect(int(connections-1), info.id)
+	}
 	return info, nil
 }
 
-func (c *Client) connError(err error) {
-	c.connErrCh <- err
+// close flushes anything that's still buffered and closes this connection.
+func (info *connInfo) close() error {
+	info.writeMutex.Lock()
+	err := info.flushNow()
+	info.writeMutex.Unlock()
+	if err != nil {
+		log.Tracef("Unable to flush before closing: %s", err)
+	}
+	err = closeGracefully(info.conn)
+	log.Trace("Closed client connection")
+	return err
+}
+
+// write writes a frame consisting of the given pieces to this connection.
+func (info *connInfo) write(pieces ...[]byte) error {
+	info.touch()
+	info.writeMutex.Lock()
+	defer info.writeMutex.Unlock()
+	_, err := info.writer.WritePieces(pieces...)
+	if err != nil {
+		return err
+	}
+	return info.flush()
+}
+
+// touch records that something is being written to this connection.
+func (info *connInfo) touch() {
+	atomic.StoreInt64(&info.lastWrite, time.Now().UnixNano())
+}
+
+// idleFor returns how long it's been since anything was written to this
+// connection.
+func (info *connInfo) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&info.lastWrite)))
+}
+
+// writeNow is like write, but flushes right away even if writes are coalesced.
+func (info *connInfo) writeNow(pieces ...[]byte) error {
+	info.touch()
+	info.writeMutex.Lock()
+	defer info.writeMutex.Unlock()
+	_, err := info.writer.WritePieces(pieces...)
+	if err != nil {
+		return err
+	}
+	return info.flushNow()
+}
+
+// stream returns the writer underlying info.writer.
+func (info *connInfo) stream() io.Writer {
+	if info.buffered != nil {
+		return info.buffered
+	}
+	return info.conn
+}
+
+// flush flushes what's been written so far, or, if writes are coalesced,
+// schedules a flush. Callers need to hold writeMutex.
+func (info *connInfo) flush() error {
+	if info.buffered == nil {
+		return info.flushNow()
+	}
+	if !info.scheduled {
+		info.scheduled = true
+		time.AfterFunc(info.interval, func() {
+			info.writeMutex.Lock()
+			defer info.writeMutex.Unlock()
+			info.scheduled = false
+			err := info.flushNow()
+			if err != nil {
+				// Subsequent writes will fail with the same error
+				log.Tracef("Unable to flush: %s", err)
+			}
+		})
+	}
+	return nil
+}
+
+// flushNow flushes what's been written so far. Callers need to hold
+// writeMutex.
+func (info *connInfo) flushNow() error {
+	if info.flusher != nil {
+		err := info.flusher.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	if info.buffered != nil {
+		return info.buffered.Flush()
+	}
+	return nil
+}
+
+// writeBatch writes several frames, each consisting of the given pieces, to
+// this connection and flushes them all at once.
+func (info *connInfo) writeBatch(frames [][][]byte) error {
+	info.touch()
+	info.writeMutex.Lock()
+	defer info.writeMutex.Unlock()
+	writer := info.writer
+	flush := info.flush
+	if info.flusher == nil && info.buffered == nil {
+		// Uncompressed writes go straight to the connection, so buffer them
+		bw := bufio.NewWriter(info.conn)
+		writer, flush = framed.NewWriter(bw), bw.Flush
+	}
+	for _, pieces := range frames {
+		_, err := writer.WritePieces(pieces...)
+		if err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+// writeFrom writes a frame to the given peer and topic whose body is streamed
+// from r.
+func (info *connInfo) writeFrom(to PeerId, id TopicId, r io.Reader, length int) error {
+	info.touch()
+	info.writeMutex.Lock()
+	defer info.writeMutex.Unlock()
+	stream := info.stream()
+	if info.flusher != nil {
+		stream = info.flusher
+	}
+	header := make([]byte, framed.FrameHeaderLength, framed.FrameHeaderLength+WaddellHeaderLength)
+	endianness.PutUint16(header, uint16(WaddellHeaderLength+length))
+	header = append(header, to.toBytes()...)
+	header = append(header, id.toBytes()...)
+	_, err := stream.Write(header)
+	if err != nil {
+		return err
+	}
+	n, err := io.CopyN(stream, r, int64(length))
+	if err != nil {
+		return fmt.Errorf("Only sent %d of %d bytes: %w", n, length, err)
+	}
+	return info.flush()
+}
+
+// startCompression asks the server to compress this connection and waits for
+// its answer. If the server declines, the connection remains uncompressed.
+func (info *connInfo) startCompression() error {
+	_, err := info.writer.Write(compressRequest)
+	if err == nil {
+		err = info.flushNow()
+	}
+	if err != nil {
+		return err
+	}
+	// Note - we don't write anything else until we have the server's answer,
+	// after which the server expects compressed data if it agreed.
+	msg, err := info.receive()
+	if err != nil {
+		return err
+	}
+	if msg.From != serverId || msg.topic != compressionFrame {
+		return fmt.Errorf("Unexpected response to compression request")
+	}
+	switch string(msg.Body) {
+	case "":
+		log.Debug("Server declined to compress connection")
+	case compressionFlate:
+		info.compression = compressionFlate
+		info.reader = compressedReader(info.conn)
+		info.writer, info.flusher = compressedWriter(info.stream())
+	default:
+		// The server is already compressing, so we can't fall back to an
+		// uncompressed connection.
+		return fmt.Errorf("Server chose unsupported compression %q", msg.Body)
+	}
+	return nil
+}
+
+// connError reports an error on the connection described by info, causing the
+// client to disconnect and reconnect on next use. Errors on connections other
+// than the current one are ignored.
+func (c *Client) connError(info *connInfo, err error) {
+	select {
+	case c.connErrCh <- &connError{info, err}:
+	case <-c.done:
+		// Connection is being closed anyway
+	}
+}
+
+// disconnected reports the error that caused the client to disconnect to the
+// OnDisconnect callback.
+func (c *Client) disconnected(err error) {
+	if c.OnDisconnect == nil || err == reconnectRequested || c.isClosed() {
+		return
+	}
+	disconnectedErr, ok := err.(*DisconnectedError)
+	if !ok {
+		disconnectedErr = &DisconnectedError{Reason: CloseNetwork, Err: err}
+	}
+	go c.OnDisconnect(disconnectedErr)
 }
 
 func (c *Client) getConnInfo() *connInfo {
 	infoCh := make(chan *connInfo)
-	c.connInfoChs <- infoCh
-	return <-infoCh
+	select {
+	case c.connInfoChs <- infoCh:
+		return <-infoCh
+	case <-c.done:
+		return &connInfo{err: closedError}
+	}
 }
@@ -0,0 +1,266 @@
+package waddell
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Flow control credits
+//
+// Credits let a receiver limit how many messages a sender may send it, so that
+// a fast sender can't overwhelm a slow receiver. This is end-to-end flow
+// control between the applications, independent of TCP's flow control and of
+// the server's buffers (see Server.InboxCapacity). Like receipts, credits are
+// implemented entirely by clients, using a reserved topic, so servers relay
+// them like any other message:
+//
+//   receiver -> sender : message on creditTopic whose body is the 32-bit
+//                        number of additional messages that the receiver
+//                        grants the sender
+//
+// Flow control is opt-in on both sides. Receivers opt in by granting credits,
+// and senders by enabling ClientConfig.FlowControl, so that peers can't slow
+// down senders that don't expect it. Senders send to peers freely until
+// they're first granted credits by that peer, after which every message sent
+// to that peer uses up one credit. Grants add up, so receivers typically grant
+// a window of credits up front and then grant more as they process messages.
+//
+// While a peer's credits are used up, the Send functions wait for more
+// credits, and messages sent to the peer on Out topics queue up behind its
+// balance (see creditQueueLength), so that one slow peer doesn't hold up
+// messages to other peers on the same topic. Since the client can't tell
+// whether a peer that stopped granting credits is merely slow or gone, it
+// forgets the peer's balance once it has waited CreditTimeout for more
+// credits, failing the waiting sends. Balances are also forgotten when the
+// client reconnects, since peers granted them to the client's previous id.
+
+const (
+	creditTopic = TopicId(0xfffd)
+
+	creditsLength = 4
+
+	// creditQueueLength is how many messages sent on Out topics can queue up
+	// for a peer that's out of credits before further ones are dropped.
+	creditQueueLength = 1000
+)
+
+// creditBalance tracks the credits that a peer has granted to this client.
+type creditBalance struct {
+	available int
+	granted   chan struct{} // closed whenever more credits are granted
+	gone      chan struct{} // closed once the balance is forgotten, see forgetCredits
+	err       error         // why waiting sends failed, if the balance is forgotten
+	queue     chan *queuedOut
+	queued    int // messages in queue or being sent from it
+}
+
+// queuedOut is a message from an Out topic that's waiting for credits.
+type queuedOut struct {
+	topic TopicId
+	body  [][]byte
+	size  int
+}
+
+func (c *Client) creditTimeout() time.Duration {
+	if c.CreditTimeout <= 0 {
+		return defaultCreditTimeout
+	}
+	return c.CreditTimeout
+}
+
+// GrantCredits allows the given peer to send n more messages to this client
+// (see "Flow control credits"). Once a peer with ClientConfig.FlowControl has
+// been granted credits, it waits when sending to this client while it has no
+// credits left, so the peer needs to run a version of this package that
+// supports credits (topic 0xfffd is reserved for them).
+func (c *Client) GrantCredits(to PeerId, n int) error {
+	if c.isClosed() {
+		return closedError
+	}
+	if n <= 0 || uint64(n) > math.MaxUint32 {
+		return fmt.Errorf("Number of credits must be between 1 and %d", uint32(math.MaxUint32))
+	}
+	info := c.getConnInfo()
+	if info.err != nil {
+		return info.err
+	}
+	b := make([]byte, creditsLength)
+	endianness.PutUint32(b, uint32(n))
+	err := info.write(to.toBytes(), creditTopic.toBytes(), b)
+	if err != nil {
+		c.connError(info, err)
+		return err
+	}
+	return nil
+}
+
+// processCredits adds the credits granted by a message on creditTopic to the
+// sender's balance.
+func (c *Client) processCredits(msg *MessageIn) {
+	if !c.FlowControl {
+		log.Tracef("Ignoring credits from %s without FlowControl", c.logId(msg.From))
+		return
+	}
+	if len(msg.Body) != creditsLength {
+		log.Tracef("Ignoring invalid credits from %s", c.logId(msg.From))
+		return
+	}
+	n := int(endianness.Uint32(msg.Body))
+	c.creditsMutex.Lock()
+	defer c.creditsMutex.Unlock()
+	balance := c.credits[msg.From]
+	if balance == nil {
+		balance = &creditBalance{granted: make(chan struct{}), gone: make(chan struct{})}
+		c.credits[msg.From] = balance
+	}
+	balance.available += n
+	close(balance.granted)
+	balance.granted = make(chan struct{})
+}
+
+// awaitCredit uses up one of the credits granted by the given peer, waiting
+// for the peer to grant more if none are left. Peers that never granted
+// credits don't use flow control, so sending to them never waits. Returns
+// closedError if the client is closed while waiting, or an error if the peer
+// doesn't grant more credits within CreditTimeout.
+func (c *Client) awaitCredit(to PeerId) error {
+	c.creditsMutex.Lock()
+	balance := c.credits[to]
+	c.creditsMutex.Unlock()
+	if balance == nil {
+		return nil
+	}
+	return c.awaitCreditFrom(to, balance)
+}
+
+// awaitCreditFrom uses up one credit from the given balance, see awaitCredit.
+func (c *Client) awaitCreditFrom(to PeerId, balance *creditBalance) error {
+	timeout := time.NewTimer(c.creditTimeout())
+	defer timeout.Stop()
+	for {
+		c.creditsMutex.Lock()
+		if balance.available > 0 {
+			balance.available--
+			c.creditsMutex.Unlock()
+			return nil
+		}
+		granted := balance.granted
+		c.creditsMutex.Unlock()
+
+		select {
+		case <-granted:
+			// Try again
+		case <-balance.gone:
+			// Only a timeout fails the sends waiting with us, after a
+			// reconnect they're sent without flow control
+			return balance.err
+		case <-timeout.C:
+			err := fmt.Errorf("Timed out waiting for credits from %s", to)
+			c.forgetCredits(to, balance, err)
+			return err
+		case <-c.done:
+			return closedError
+		}
+	}
+}
+
+// forgetCredits forgets the given peer's balance, ending all waits for its
+// credits with the given error.
+func (c *Client) forgetCredits(to PeerId, balance *creditBalance, err error) {
+	c.creditsMutex.Lock()
+	defer c.creditsMutex.Unlock()
+	c.forgetBalance(to, balance, err)
+}
+
+// forgetAllCredits forgets all balances once the client has a new id, letting
+// the sends that are waiting for credits go ahead without flow control.
+func (c *Client) forgetAllCredits() {
+	c.creditsMutex.Lock()
+	defer c.creditsMutex.Unlock()
+	for to, balance := range c.credits {
+		c.forgetBalance(to, balance, nil)
+	}
+}
+
+// forgetBalance must be called with creditsMutex held.
+func (c *Client) forgetBalance(to PeerId, balance *creditBalance, err error) {
+	if c.credits[to] != balance {
+		// Already forgotten
+		return
+	}
+	delete(c.credits, to)
+	balance.err = err
+	close(balance.gone)
+}
+
+// queueForCredit decides whether a message from an Out topic can be sent to the
+// given peer right away, using up one of the peer's credits if necessary. If
+// not, it queues the message until the peer grants more credits and returns
+// true. Messages queue up behind earlier ones for the same peer, so they stay
+// in order.
+func (c *Client) queueForCredit(topic TopicId, to PeerId, body [][]byte, size int) bool {
+	c.creditsMutex.Lock()
+	defer c.creditsMutex.Unlock()
+	balance := c.credits[to]
+	if balance == nil {
+		return false
+	}
+	if balance.queued == 0 && balance.available > 0 {
+		balance.available--
+		return false
+	}
+	if balance.queue == nil {
+		balance.queue = make(chan *queuedOut, creditQueueLength)
+		go c.sendQueued(to, balance)
+	}
+	select {
+	case balance.queue <- &queuedOut{topic, body, size}:
+		balance.queued++
+	default:
+		log.Errorf("Too many messages waiting for credits from %s, dropping message on %d", c.logId(to), topic)
+	}
+	return true
+}
+
+// sendQueued sends the messages queued for the given peer as it grants
+// credits, until the peer's balance is forgotten.
+func (c *Client) sendQueued(to PeerId, balance *creditBalance) {
+	for {
+		select {
+		case msg := <-balance.queue:
+			c.sendQueuedMessage(to, balance, msg)
+		case <-balance.gone:
+			// Nothing can be queued anymore, deal with what's left
+			for {
+				select {
+				case msg := <-balance.queue:
+					c.sendQueuedMessage(to, balance, msg)
+				default:
+					return
+				}
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Client) sendQueuedMessage(to PeerId, balance *creditBalance, msg *queuedOut) {
+	defer func() {
+		c.creditsMutex.Lock()
+		balance.queued--
+		c.creditsMutex.Unlock()
+	}()
+	err := c.awaitCreditFrom(to, balance)
+	if err != nil {
+		log.Debugf("Dropping message on %d to %s: %s", msg.topic, c.logId(to), err)
+		return
+	}
+	info := c.getConnInfo()
+	if info.err != nil {
+		log.Debugf("Dropping message on %d to %s: %s", msg.topic, c.logId(to), info.err)
+		return
+	}
+	c.writeMessage(info, msg.topic, to, msg.body, msg.size)
+}
@@ -0,0 +1,142 @@
+package waddell
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	lookupHost = net.LookupHost
+	lookupSRV  = net.LookupSRV
+)
+
+// SRVDialer creates a DialFunc that finds waddell servers by looking up the SRV
+// record for the given service, proto and name (e.g. "waddell", "tcp",
+// "example.com"). Targets are tried in order of priority, randomized by weight
+// within each priority (see net.LookupSRV), failing over to the next target if
+// connecting fails. The record is looked up again on every dial so that
+// changes are picked up, falling back to the targets found when the dialer was
+// created if that fails.
+//
+// The returned DialFunc can be used with ClientConfig.ServerCert to connect
+// using TLS.
+func SRVDialer(service, proto, name string) (DialFunc, error) {
+	_, addrs, err := lookupSRV(service, proto, name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to look up SRV record for %s: %s", name, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("No SRV targets found for %s", name)
+	}
+
+	return func() (net.Conn, error) {
+		_, current, err := lookupSRV(service, proto, name)
+		if err != nil || len(current) == 0 {
+			log.Tracef("Unable to refresh SRV record for %s, using previous targets: %s", name, err)
+			current = addrs
+		}
+
+		var lastErr error
+		for _, srv := range current {
+			addr := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+			conn, err := net.Dial("tcp", addr)
+			if err == nil {
+				return conn, nil
+			}
+			log.Tracef("Unable to dial SRV target %s: %s", addr, err)
+			lastErr = err
+		}
+		return nil, fmt.Errorf("Unable to dial any of %d SRV targets for %s: %s", len(current), name, lastErr)
+	}, nil
+}
+
+// BoundDialer creates a DialFunc that connects to the waddell server at hostport
+// from the given local IP address, which is useful on multi-homed hosts or when
+// signaling needs to be routed over a particular interface (e.g. a VPN).
+//
+// The returned DialFunc can be used with ClientConfig.ServerCert to connect
+// using TLS.
+//
+// Note - if the local address becomes unavailable (e.g. after a network
+// change), dialing fails and the client's reconnect attempts fail along with
+// it. Applications that need to handle this should watch for network changes
+// and create a new Client with an updated BoundDialer.
+func BoundDialer(localAddr string, hostport string) (DialFunc, error) {
+	ip := net.ParseIP(localAddr)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid local address %s", localAddr)
+	}
+	dialer := &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: ip},
+	}
+	return func() (net.Conn, error) {
+		return dialer.Dial("tcp", hostport)
+	}, nil
+}
+
+// CachingDialer creates a DialFunc that connects to the waddell server at
+// hostport, caching the addresses that the host resolves to for the given ttl
+// so that reconnecting doesn't have to wait for a DNS lookup every time. If
+// none of the cached addresses can be reached (e.g. because the server moved),
+// the host is resolved again right away and the fresh addresses are tried
+// before giving up.
+//
+// The returned DialFunc can be used with ClientConfig.ServerCert to connect
+// using TLS.
+func CachingDialer(hostport string, ttl time.Duration) (DialFunc, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid address %s: %s", hostport, err)
+	}
+
+	var addrs []string
+	var expires time.Time
+	var mutex sync.Mutex
+	resolve := func(force bool) ([]string, bool, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !force && len(addrs) > 0 && time.Now().Before(expires) {
+			return addrs, true, nil
+		}
+		resolved, err := lookupHost(host)
+		if err != nil {
+			return nil, false, fmt.Errorf("Unable to resolve %s: %s", host, err)
+		}
+		addrs = resolved
+		expires = time.Now().Add(ttl)
+		return addrs, false, nil
+	}
+	dialAny := func(current []string) (net.Conn, error) {
+		var lastErr error
+		for _, addr := range current {
+			conn, err := net.Dial("tcp", net.JoinHostPort(addr, port))
+			if err == nil {
+				return conn, nil
+			}
+			log.Tracef("Unable to dial %s at %s: %s", host, addr, err)
+			lastErr = err
+		}
+		return nil, fmt.Errorf("Unable to dial any of %d addresses for %s: %s", len(current), host, lastErr)
+	}
+
+	return func() (net.Conn, error) {
+		current, cached, err := resolve(false)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialAny(current)
+		if err == nil || !cached {
+			return conn, err
+		}
+		// Cached addresses may be stale, resolve again
+		current, _, err = resolve(true)
+		if err != nil {
+			return nil, err
+		}
+		return dialAny(current)
+	}, nil
+}
@@ -0,0 +1,65 @@
+package waddell
+
+import (
+	"sync"
+)
+
+// fairSemaphore is a counting semaphore that grants slots strictly in the order
+// in which they were requested, without letting newcomers barge ahead of
+// goroutines that are already waiting. Since each peer's frames are relayed by
+// a single goroutine that has at most one request outstanding, granting slots
+// in order amounts to round-robin scheduling among the peers that have frames
+// to relay, so a peer that's flooding the server has to wait its turn behind
+// every other peer.
+//
+// Requests are partitioned by priority class (see Server.PriorityClass): a
+// slot always goes to the longest waiting request of the highest class that
+// has requests waiting, so the round-robin happens within each class.
+type fairSemaphore struct {
+	slots   int
+	waiters []fairWaiter
+	mutex   sync.Mutex
+}
+
+type fairWaiter struct {
+	ch    chan struct{}
+	class int
+}
+
+func newFairSemaphore(slots int) *fairSemaphore {
+	return &fairSemaphore{slots: slots}
+}
+
+func (s *fairSemaphore) acquire(class int) {
+	s.mutex.Lock()
+	if s.slots > 0 && len(s.waiters) == 0 {
+		s.slots--
+		s.mutex.Unlock()
+		return
+	}
+	ch := make(chan struct{})
+	s.waiters = append(s.waiters, fairWaiter{ch, class})
+	s.mutex.Unlock()
+	<-ch
+}
+
+func (s *fairSemaphore) release() {
+	s.mutex.Lock()
+	if len(s.waiters) > 0 {
+		// Hand our slot directly to the longest waiting goroutine of the
+		// highest class
+		next := 0
+		for i, w := range s.waiters {
+			if w.class > s.waiters[next].class {
+				next = i
+			}
+		}
+		close(s.waiters[next].ch)
+		copy(s.waiters[next:], s.waiters[next+1:])
+		s.waiters[len(s.waiters)-1] = fairWaiter{}
+		s.waiters = s.waiters[:len(s.waiters)-1]
+	} else {
+		s.slots++
+	}
+	s.mutex.Unlock()
+}
@@ -0,0 +1,181 @@
+package waddell
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Handle is an independent view of a Client, created with Client.Dup, that
+// lets separate components of an application share one connection (and hence
+// one peer id) without having to coordinate receiving. Each Handle has its own
+// in topics and filter, while sending (including through Out) goes through the
+// shared Client.
+//
+// Incoming messages are routed rather than broadcast, so every message is
+// delivered exactly once. A message goes to the first Handle (in the order in
+// which they were created) that is listening on the message's topic and whose
+// filter accepts the message. Messages that no Handle takes are delivered to
+// the Client's own in topic as usual. The Client's filter (see
+// Client.SetFilter) applies to all messages before any routing takes place.
+type Handle struct {
+	client        *Client
+	filter        atomic.Value // func(*MessageIn) bool, see SetFilter
+	topicsIn      map[TopicId]chan *MessageIn
+	topicsInMutex sync.Mutex
+	done          chan struct{} // closed once the handle is closed
+	deliverMutex  sync.RWMutex  // held for reading while delivering messages
+	closed        int32
+}
+
+// Dup creates a new Handle that shares this client's connection, see Handle.
+// The Handle stays attached to the client until either of them is closed.
+func (c *Client) Dup() *Handle {
+	h := &Handle{
+		client:   c,
+		topicsIn: make(map[TopicId]chan *MessageIn),
+		done:     make(chan struct{}),
+	}
+	c.handlesMutex.Lock()
+	// Copy on write, so that routing can use a snapshot without locking
+	handles := make([]*Handle, 0, len(c.handles)+1)
+	handles = append(handles, c.handles...)
+	c.handles = append(handles, h)
+	c.handlesMutex.Unlock()
+	return h
+}
+
+// Client returns the Client that this Handle shares.
+func (h *Handle) Client() *Client {
+	return h.client
+}
+
+// CurrentId returns the shared client's current id, see Client.CurrentId.
+func (h *Handle) CurrentId() PeerId {
+	return h.client.CurrentId()
+}
+
+// In returns this Handle's (one and only) channel for receiving from the topic
+// identified by the given id. Like the Client's in topics, it's buffered
+// according to ClientConfig.InBufferSize.
+func (h *Handle) In(id TopicId) <-chan *MessageIn {
+	if h.isClosed() {
+		panic("Attempted to obtain in topic on closed handle")
+	}
+	if h.client.Mode == SendOnly {
+		panic("Attempted to obtain in topic on send only client")
+	}
+	if checkTopic(id) != nil {
+		panic("Attempted to obtain reserved in topic")
+	}
+	return h.in(id, true)
+}
+
+// Out returns the shared client's channel for writing to the given topic, see
+// Client.Out.
+func (h *Handle) Out(id TopicId) chan<- *MessageOut {
+	return h.client.Out(id)
+}
+
+// SetFilter sets a filter deciding which messages are routed to this Handle.
+// Messages that the filter rejects are offered to the next Handle or the
+// Client instead of being discarded. Passing nil removes the filter, in which
+// case the Handle takes every message on the topics it listens on. Like the
+// Client's filter, it runs on the goroutine that reads from the server, so it
+// needs to be fast.
+func (h *Handle) SetFilter(filter func(msg *MessageIn) bool) {
+	h.filter.Store(filter)
+}
+
+// Close detaches this Handle from the client and closes its in topics. It
+// leaves the client connected. Messages that would have been routed to this
+// Handle go elsewhere from now on.
+func (h *Handle) Close() error {
+	if !atomic.CompareAndSwapInt32(&h.closed, 0, 1) {
+		return nil
+	}
+	c := h.client
+	c.handlesMutex.Lock()
+	handles := make([]*Handle, 0, len(c.handles))
+	for _, existing := range c.handles {
+		if existing != h {
+			handles = append(handles, existing)
+		}
+	}
+	c.handles = handles
+	c.handlesMutex.Unlock()
+
+	// Unblock any pending delivery, then wait for it to finish before closing
+	// the channels that it might be sending on.
+	close(h.done)
+	h.deliverMutex.Lock()
+	defer h.deliverMutex.Unlock()
+	h.topicsInMutex.Lock()
+	defer h.topicsInMutex.Unlock()
+	for _, ch := range h.topicsIn {
+		close(ch)
+	}
+	return nil
+}
+
+func (h *Handle) isClosed() bool {
+	return atomic.LoadInt32(&h.closed) == 1
+}
+
+func (h *Handle) in(id TopicId, create bool) chan *MessageIn {
+	h.topicsInMutex.Lock()
+	defer h.topicsInMutex.Unlock()
+	ch := h.topicsIn[id]
+	if ch == nil && create {
+		ch = make(chan *MessageIn, h.client.InBufferSize)
+		h.topicsIn[id] = ch
+	}
+	return ch
+}
+
+// accepts checks whether the given message passes this Handle's filter.
+func (h *Handle) accepts(msg *MessageIn) bool {
+	filter, _ := h.filter.Load().(func(msg *MessageIn) bool)
+	return filter == nil || filter(msg)
+}
+
+// deliver delivers msg to the given in topic of this Handle, returning false
+// if the Handle was closed before msg could be delivered.
+func (h *Handle) deliver(ch chan *MessageIn, msg *MessageIn) bool {
+	h.deliverMutex.RLock()
+	defer h.deliverMutex.RUnlock()
+	if h.isClosed() {
+		return false
+	}
+	select {
+	case ch <- msg:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// route determines the in topic to which to deliver the given message, along
+// with the Handle to which it belongs (nil for the client's own in topics). It
+// returns a nil channel if nobody is listening on the message's topic.
+func (c *Client) route(msg *MessageIn) (chan *MessageIn, *Handle) {
+	c.handlesMutex.RLock()
+	handles := c.handles
+	c.handlesMutex.RUnlock()
+	for _, h := range handles {
+		ch := h.in(msg.topic, false)
+		if ch != nil && h.accepts(msg) {
+			return ch, h
+		}
+	}
+	return c.in(msg.topic, false), nil
+}
+
+// closeHandles closes all of this client's Handles.
+func (c *Client) closeHandles() {
+	c.handlesMutex.RLock()
+	handles := c.handles
+	c.handlesMutex.RUnlock()
+	for _, h := range handles {
+		h.Close()
+	}
+}
@@ -0,0 +1,41 @@
+package waddell
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// HealthHandler returns an http.Handler that reports the server's health for
+// load balancer and orchestrator health checks (e.g. a Kubernetes readiness
+// probe at /healthz). It responds with 200 while the server is accepting
+// connections and under its limits, and with 503 while the server isn't
+// serving yet, is draining (i.e. after Shutdown or Migrate) or is overloaded,
+// meaning that it has reached one of its limits (see Utilization.Max). The
+// body briefly states which. Serving the handler is up to the application,
+// the server doesn't listen for HTTP on its own.
+func (server *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, message := server.health()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		fmt.Fprintln(w, message)
+	})
+}
+
+// health determines the HTTP status and message with which HealthHandler
+// responds.
+func (server *Server) health() (int, string) {
+	if atomic.LoadInt32(&server.shutdown) == 1 || atomic.LoadInt32(&server.draining) == 1 {
+		return http.StatusServiceUnavailable, "draining"
+	}
+	stats := server.Stats()
+	if stats.Uptime == 0 {
+		return http.StatusServiceUnavailable, "not serving"
+	}
+	if max := stats.Utilization.Max(); max >= 100 {
+		return http.StatusServiceUnavailable, fmt.Sprintf("overloaded (%.0f%% utilized)", max)
+	}
+	return http.StatusOK, "ok"
+}
@@ -0,0 +1,273 @@
+package waddell
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HTTP/2 transport
+//
+// For networks that only let HTTPS through, waddell connections can be tunneled
+// over HTTP/2. Each connection is a single long-lived POST request:
+//
+//   client -> server : request body carries the frames that the client would
+//                      otherwise write to the TCP connection
+//
+//   server -> client : response body carries the frames that the server would
+//                      otherwise write to the TCP connection, starting right
+//                      after the response headers
+//
+// Since HTTP/2 streams are bidirectional, both bodies flow at the same time for
+// as long as the connection lasts. Frames map 1:1 onto the bytes of the
+// bodies, so framing, peer id addressing and everything else work exactly as
+// they do over TCP.
+
+// HTTPListener is a net.Listener whose connections are HTTP/2 requests. Use
+// it as an http.Handler with an HTTP/2 capable http.Server (e.g. one serving
+// TLS) and pass it to Server.Serve to serve waddell over HTTP/2, see DialHTTP2.
+// Requests using older versions of HTTP are rejected, since they can't stream
+// both ways at once.
+type HTTPListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewHTTPListener creates a new HTTPListener.
+func NewHTTPListener() *HTTPListener {
+	return &HTTPListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// ServeHTTP turns the request into a connection that's accepted by this
+// listener and blocks until the connection is closed.
+func (l *HTTPListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor < 2 {
+		// Closing the connection keeps the server from waiting for the rest
+		// of the request body, which never ends when sent by DialHTTP2.
+		w.Header().Set("Connection", "close")
+		http.Error(w, "waddell requires HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "waddell requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	err := rc.Flush()
+	if err != nil {
+		log.Debugf("Unable to flush response headers to %s: %s", r.RemoteAddr, err)
+		return
+	}
+	conn := &httpServerConn{
+		body:   r.Body,
+		w:      w,
+		rc:     rc,
+		remote: httpAddr(r.RemoteAddr),
+		done:   make(chan struct{}),
+	}
+	if r.TLS != nil {
+		conn.serverName = r.TLS.ServerName
+	}
+	defer conn.finish()
+
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		return
+	case <-r.Context().Done():
+		return
+	}
+	select {
+	case <-conn.done:
+	case <-r.Context().Done():
+	}
+}
+
+// Accept implements the method from net.Listener.
+func (l *HTTPListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements the method from net.Listener. Connections that have
+// already been accepted stay open.
+func (l *HTTPListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+// Addr implements the method from net.Listener.
+func (l *HTTPListener) Addr() net.Addr {
+	return httpAddr("http")
+}
+
+// DialHTTP2 creates a DialFunc that connects to the waddell server at the given
+// URL over HTTP/2 (see HTTPListener) using the given http.Client, whose
+// Transport needs to support HTTP/2 (like http.DefaultTransport does for
+// https URLs). Since the connection is secured by the http.Client, don't
+// combine this with ClientConfig.ServerCert or ClientConfig.TLSConfig.
+//
+// Note - HTTP/2 connections don't support deadlines, so ClientConfig.IdTimeout
+// doesn't apply.
+func DialHTTP2(url string, client *http.Client) DialFunc {
+	return func() (net.Conn, error) {
+		pr, pw := io.Pipe()
+		req, err := http.NewRequest(http.MethodPost, url, pr)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			pw.Close()
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK || resp.ProtoMajor < 2 {
+			resp.Body.Close()
+			pw.Close()
+			return nil, fmt.Errorf("Unable to connect over HTTP/2, got %s over %s", resp.Status, resp.Proto)
+		}
+		return &httpClientConn{
+			body:   resp.Body,
+			w:      pw,
+			remote: httpAddr(req.URL.Host),
+			secure: resp.TLS != nil,
+		}, nil
+	}
+}
+
+// httpServerConn is the server's side of a connection over HTTP/2.
+type httpServerConn struct {
+	body       io.ReadCloser
+	w          http.ResponseWriter
+	rc         *http.ResponseController
+	remote     net.Addr
+	serverName string // SNI of the underlying TLS connection, if any
+	done       chan struct{}
+	closeOnce  sync.Once
+	finished   bool // true once the handler has returned
+	mutex      sync.Mutex
+}
+
+func (c *httpServerConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+func (c *httpServerConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.finished {
+		// Writing after the handler returned isn't allowed
+		return 0, net.ErrClosed
+	}
+	n, err := c.w.Write(b)
+	if err == nil {
+		err = c.rc.Flush()
+	}
+	return n, err
+}
+
+func (c *httpServerConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return nil
+}
+
+// finish marks the handler as having returned.
+func (c *httpServerConn) finish() {
+	c.mutex.Lock()
+	c.finished = true
+	c.mutex.Unlock()
+	c.Close()
+}
+
+func (c *httpServerConn) LocalAddr() net.Addr {
+	return httpAddr("http")
+}
+
+func (c *httpServerConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *httpServerConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *httpServerConn) SetReadDeadline(t time.Time) error {
+	return c.rc.SetReadDeadline(t)
+}
+
+func (c *httpServerConn) SetWriteDeadline(t time.Time) error {
+	return c.rc.SetWriteDeadline(t)
+}
+
+// httpClientConn is the client's side of a connection over HTTP/2.
+type httpClientConn struct {
+	body   io.ReadCloser
+	w      *io.PipeWriter
+	remote net.Addr
+	secure bool // whether the connection uses TLS
+}
+
+func (c *httpClientConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+func (c *httpClientConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c *httpClientConn) Close() error {
+	c.w.Close()
+	return c.body.Close()
+}
+
+func (c *httpClientConn) LocalAddr() net.Addr {
+	return httpAddr("http")
+}
+
+func (c *httpClientConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *httpClientConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *httpClientConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *httpClientConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// httpAddr is the address of one end of a connection over HTTP/2.
+type httpAddr string
+
+func (a httpAddr) Network() string {
+	return "http"
+}
+
+func (a httpAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,197 @@
+// Package faultnet simulates network failures for testing how waddell clients
+// cope with them, e.g. whether they reconnect after their connection drops or
+// notice when the network stops delivering traffic.
+//
+// A Network wraps the function used to dial the waddell server (see
+// ClientConfig.Dial). All connections dialed through a Network can then be
+// partitioned, slowed down or dropped on demand:
+//
+//	network := faultnet.New()
+//	client, err := waddell.NewClient(&waddell.ClientConfig{
+//	  Dial: network.Dial(func() (net.Conn, error) {
+//	    return net.Dial("tcp", serverAddr)
+//	  }),
+//	})
+//	...
+//	network.Partition() // traffic stops flowing, like a pulled network cable
+//	network.Heal()      // traffic flows again
+//	network.Drop()      // connections are closed abruptly
+//
+// Since this package is internal, it's only available to waddell's own tests.
+package faultnet
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrPartitioned is returned when dialing while the Network is
+	// partitioned.
+	ErrPartitioned = fmt.Errorf("Network partitioned")
+)
+
+// Network is a simulated network between clients and a waddell server.
+type Network struct {
+	healed chan struct{} // closed while traffic flows
+	delay  time.Duration
+	conns  map[*Conn]bool
+	mutex  sync.Mutex
+}
+
+// New creates a healthy Network.
+func New() *Network {
+	healed := make(chan struct{})
+	close(healed)
+	return &Network{
+		healed: healed,
+		conns:  make(map[*Conn]bool),
+	}
+}
+
+// Dial wraps the given dial function so that its connections go through this
+// Network.
+func (n *Network) Dial(dial func() (net.Conn, error)) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		if n.partitioned() {
+			return nil, ErrPartitioned
+		}
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		c := &Conn{Conn: conn, network: n, closed: make(chan struct{})}
+		n.mutex.Lock()
+		n.conns[c] = true
+		n.mutex.Unlock()
+		return c, nil
+	}
+}
+
+// Partition stops all traffic until Heal is called. As with a real partition,
+// existing connections aren't closed, they just stall: writes block and reads
+// don't return anything until the partition heals, at which point all traffic
+// is delivered as if nothing had happened. New connections fail with
+// ErrPartitioned.
+func (n *Network) Partition() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	select {
+	case <-n.healed:
+		n.healed = make(chan struct{})
+	default:
+		// already partitioned
+	}
+}
+
+// Heal ends a partition, delivering any traffic that was held up by it.
+func (n *Network) Heal() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	select {
+	case <-n.healed:
+		// not partitioned
+	default:
+		close(n.healed)
+	}
+}
+
+// SetDelay delays every read and write on connections through this Network by
+// the given amount, simulating a slow network. 0 removes the delay.
+func (n *Network) SetDelay(delay time.Duration) {
+	n.mutex.Lock()
+	n.delay = delay
+	n.mutex.Unlock()
+}
+
+// Drop closes all existing connections through this Network, simulating
+// connections that were reset.
+func (n *Network) Drop() {
+	n.mutex.Lock()
+	conns := make([]*Conn, 0, len(n.conns))
+	for c := range n.conns {
+		conns = append(conns, c)
+	}
+	n.mutex.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func (n *Network) partitioned() bool {
+	select {
+	case <-n.state():
+		return false
+	default:
+		return true
+	}
+}
+
+func (n *Network) state() chan struct{} {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.healed
+}
+
+func (n *Network) getDelay() time.Duration {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.delay
+}
+
+// Conn is a connection through a Network.
+type Conn struct {
+	net.Conn
+	network   *Network
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Read reads from the underlying connection, holding on to the data for as
+// long as the Network is partitioned.
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if waitErr := c.wait(); waitErr != nil {
+			return 0, waitErr
+		}
+	}
+	return n, err
+}
+
+// Write writes to the underlying connection once the Network isn't
+// partitioned.
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.wait(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// Close closes the underlying connection.
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.network.mutex.Lock()
+		delete(c.network.conns, c)
+		c.network.mutex.Unlock()
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// wait waits out any partition and delay.
+func (c *Conn) wait() error {
+	select {
+	case <-c.network.state():
+	case <-c.closed:
+		return net.ErrClosed
+	}
+	if delay := c.network.getDelay(); delay > 0 {
+		time.Sleep(delay)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package waddell
+
+import (
+	"fmt"
+)
+
+// Introductions
+//
+// Peers still need to learn one peer id out of band, but once one side knows
+// the other's id, an introduction lets both sides confirm each other's ids
+// without the application having to agree on a first message of its own. Like
+// receipts and credits, introductions are implemented entirely by clients,
+// using a reserved topic, so servers relay them like any other message:
+//
+//   introducer -> peer  : message on introTopic whose body is introHello
+//
+//   peer -> introducer  : message on introTopic whose body is introReply,
+//                         sent automatically by the peer's client
+//
+// Each side passes the other's id (which it takes from msg.From) to
+// ClientConfig.OnIntroduction, the peer upon receiving the hello and the
+// introducer upon receiving the reply. Only hellos are answered, so
+// introductions never bounce back and forth.
+
+const (
+	introTopic = TopicId(0xfffc)
+
+	introHello = byte(0)
+	introReply = byte(1)
+)
+
+// Introduce introduces this client to the given peer (see "Introductions").
+// Once the peer's client answers, both sides know each other's ids, which
+// each side learns from ClientConfig.OnIntroduction. Introduce doesn't wait
+// for the answer, and like messages sent on Out topics, introductions to peers
+// that aren't connected are silently dropped. The peer needs to run a version
+// of this package that supports introductions (topic 0xfffc is reserved for
+// them).
+func (c *Client) Introduce(to PeerId) error {
+	if c.isClosed() {
+		return closedError
+	}
+	if c.Mode == ReceiveOnly {
+		return fmt.Errorf("Unable to send on receive only client")
+	}
+	info := c.getConnInfo()
+	if info.err != nil {
+		return info.err
+	}
+	err := info.write(to.toBytes(), introTopic.toBytes(), []byte{introHello})
+	if err != nil {
+		c.connError(info, err)
+		return err
+	}
+	return nil
+}
+
+// processIntroduction answers a peer's introduction and tells the application
+// about the peer that introduced itself or answered our introduction.
+func (c *Client) processIntroduction(info *connInfo, msg *MessageIn) {
+	if len(msg.Body) != 1 || msg.Body[0] > introReply {
+		log.Tracef("Ignoring invalid introduction from %s", c.logId(msg.From))
+		return
+	}
+	if msg.Body[0] == introHello && c.Mode != ReceiveOnly {
+		err := info.write(msg.From.toBytes(), introTopic.toBytes(), []byte{introReply})
+		if err != nil {
+			log.Tracef("Unable to answer introduction from %s: %s", c.logId(msg.From), err)
+		}
+	}
+	if c.OnIntroduction != nil {
+		go c.OnIntroduction(msg.From)
+	}
+}
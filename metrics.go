@@ -0,0 +1,118 @@
+package waddell
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// SizeBuckets are the upper bounds (inclusive) of the buckets of
+	// Metrics.MessageSizes, in bytes. The last bucket of the histogram counts
+	// everything bigger.
+	SizeBuckets = [...]int{64, 256, 1024, 4096, 16384}
+
+	// IntervalBuckets are the upper bounds (inclusive) of the buckets of
+	// Metrics.MessageIntervals. The last bucket of the histogram counts
+	// everything longer.
+	IntervalBuckets = [...]time.Duration{10 * time.Millisecond, 100 * time.Millisecond, time.Second, 10 * time.Second, time.Minute}
+)
+
+// Metrics collects counters about the frames handled by a Server, broken down
+// by type of frame. To enable collection, set Server.Metrics to a non-nil
+// *Metrics. When Server.Metrics is nil, no counting takes place.
+//
+// The counters are updated atomically, so use Snapshot to read them while the
+// Server is running.
+type Metrics struct {
+	// Messages: number of messages received from peers for relaying
+	Messages int64
+
+	// KeepAlives: number of keepalive frames received from peers
+	KeepAlives int64
+
+	// Invalid: number of frames received from peers that could not be parsed
+	Invalid int64
+
+	// System: number of system frames (e.g. redirects) sent to peers
+	System int64
+
+	// Dropped: number of messages that weren't relayed because the server was
+	// already buffering Server.MaxBufferedBytes or because the recipient's
+	// inbox was full (see Server.InboxCapacity)
+	Dropped int64
+
+	// MessageSizes: histogram of the body sizes of messages received from
+	// peers, bucketed by SizeBuckets
+	MessageSizes [len(SizeBuckets) + 1]int64
+
+	// MessageIntervals: histogram of the time between consecutive messages
+	// received from the same peer, bucketed by IntervalBuckets
+	MessageIntervals [len(IntervalBuckets) + 1]int64
+}
+
+// Snapshot returns a copy of the current values of the counters.
+func (m *Metrics) Snapshot() Metrics {
+	snapshot := Metrics{
+		Messages:   atomic.LoadInt64(&m.Messages),
+		KeepAlives: atomic.LoadInt64(&m.KeepAlives),
+		Invalid:    atomic.LoadInt64(&m.Invalid),
+		System:     atomic.LoadInt64(&m.System),
+		Dropped:    atomic.LoadInt64(&m.Dropped),
+	}
+	for i := range m.MessageSizes {
+		snapshot.MessageSizes[i] = atomic.LoadInt64(&m.MessageSizes[i])
+	}
+	for i := range m.MessageIntervals {
+		snapshot.MessageIntervals[i] = atomic.LoadInt64(&m.MessageIntervals[i])
+	}
+	return snapshot
+}
+
+func (m *Metrics) count(counter *int64) {
+	atomic.AddInt64(counter, 1)
+}
+
+// countMessage counts a message with the given body size that arrived interval
+// after the previous message from the same peer (0 if it's the first one).
+func (m *Metrics) countMessage(size int, interval time.Duration) {
+	if m == nil {
+		return
+	}
+	m.count(&m.Messages)
+	i := 0
+	for i < len(SizeBuckets) && size > SizeBuckets[i] {
+		i++
+	}
+	m.count(&m.MessageSizes[i])
+	if interval > 0 {
+		i = 0
+		for i < len(IntervalBuckets) && interval > IntervalBuckets[i] {
+			i++
+		}
+		m.count(&m.MessageIntervals[i])
+	}
+}
+
+func (m *Metrics) countKeepAlive() {
+	if m != nil {
+		m.count(&m.KeepAlives)
+	}
+}
+
+func (m *Metrics) countInvalid() {
+	if m != nil {
+		m.count(&m.Invalid)
+	}
+}
+
+func (m *Metrics) countSystem() {
+	if m != nil {
+		m.count(&m.System)
+	}
+}
+
+func (m *Metrics) countDropped() {
+	if m != nil {
+		m.count(&m.Dropped)
+	}
+}
@@ -0,0 +1,174 @@
+package waddell
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// relayStage identifies a stage of relaying a message, see RelayProfile.
+type relayStage int
+
+const (
+	stageRead = relayStage(iota)
+	stageParse
+	stageLookup
+	stageEnqueue
+	stageWrite
+	numRelayStages
+)
+
+const (
+	// profileSamples is how many of the most recent relayed messages'
+	// timings are kept for computing percentiles.
+	profileSamples = 1024
+)
+
+// RelayProfile breaks down where the server spends its time relaying messages,
+// see Server.ProfileRelay. Timings are taken from the most recently relayed
+// messages (up to 1024 of them). Messages that aren't relayed (e.g. because
+// they're dropped) aren't included.
+type RelayProfile struct {
+	// Read: from the first byte of a message arriving until the whole message
+	// has been read (which is mostly up to the sender and the network)
+	Read StageTimings
+
+	// Parse: decoding the message's header and resolving its recipient's
+	// alias, if any
+	Parse StageTimings
+
+	// Lookup: looking up the recipient and checking whether the sender may
+	// message it (see Authorize and IsolateByServerName)
+	Lookup StageTimings
+
+	// Enqueue: waiting for a relay turn (see FairRelayConcurrency), a slot
+	// in the recipient's inbox (see InboxCapacity) and buffer capacity (see
+	// MaxBufferedBytes)
+	Enqueue StageTimings
+
+	// Write: writing the message to the recipient (which is mostly up to the
+	// recipient and the network)
+	Write StageTimings
+}
+
+// StageTimings summarizes how long a stage of relaying took.
+type StageTimings struct {
+	Samples int
+	P50     time.Duration
+	P90     time.Duration
+	P99     time.Duration
+	Max     time.Duration
+}
+
+// relayProfile collects the timings of the stages of relaying messages.
+type relayProfile struct {
+	samples [numRelayStages][]time.Duration
+	next    int  // index at which to record the next sample
+	full    bool // whether samples have wrapped around
+	mutex   sync.Mutex
+}
+
+func newRelayProfile() *relayProfile {
+	profile := &relayProfile{}
+	for i := range profile.samples {
+		profile.samples[i] = make([]time.Duration, profileSamples)
+	}
+	return profile
+}
+
+// record records the timings of the stages of relaying a single message.
+func (rp *relayProfile) record(stages *[numRelayStages]time.Duration) {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+	for i, d := range stages {
+		rp.samples[i][rp.next] = d
+	}
+	rp.next++
+	if rp.next == profileSamples {
+		rp.next = 0
+		rp.full = true
+	}
+}
+
+// RelayProfile returns where the server spends its time relaying messages if
+// ProfileRelay is set, otherwise nil. Computing it involves copying and sorting
+// the recent timings, so it's considerably more expensive than Stats.
+func (server *Server) RelayProfile() *RelayProfile {
+	if server.profile == nil {
+		return nil
+	}
+	return server.profile.snapshot()
+}
+
+// snapshot computes the RelayProfile from the recorded samples.
+func (rp *relayProfile) snapshot() *RelayProfile {
+	rp.mutex.Lock()
+	n := rp.next
+	if rp.full {
+		n = profileSamples
+	}
+	var sorted [numRelayStages][]time.Duration
+	for i := range rp.samples {
+		sorted[i] = append([]time.Duration(nil), rp.samples[i][:n]...)
+	}
+	rp.mutex.Unlock()
+
+	timings := func(samples []time.Duration) StageTimings {
+		if len(samples) == 0 {
+			return StageTimings{}
+		}
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+		percentile := func(p int) time.Duration {
+			return samples[(len(samples)-1)*p/100]
+		}
+		return StageTimings{
+			Samples: len(samples),
+			P50:     percentile(50),
+			P90:     percentile(90),
+			P99:     percentile(99),
+			Max:     samples[len(samples)-1],
+		}
+	}
+	return &RelayProfile{
+		Read:    timings(sorted[stageRead]),
+		Parse:   timings(sorted[stageParse]),
+		Lookup:  timings(sorted[stageLookup]),
+		Enqueue: timings(sorted[stageEnqueue]),
+		Write:   timings(sorted[stageWrite]),
+	}
+}
+
+// relayTimer times the stages of relaying a single message at a time, see
+// ProfileRelay. Its methods do nothing if profiling is disabled.
+type relayTimer struct {
+	profile *relayProfile // nil if profiling is disabled
+	last    time.Time
+	stages  [numRelayStages]time.Duration
+}
+
+// start starts timing a message whose first byte arrived at the given time.
+func (t *relayTimer) start(began time.Time) {
+	if t.profile == nil {
+		return
+	}
+	t.last = began
+	t.stages = [numRelayStages]time.Duration{}
+}
+
+// lap adds the time since the previous lap to the given stage.
+func (t *relayTimer) lap(stage relayStage) {
+	if t.profile == nil {
+		return
+	}
+	now := time.Now()
+	t.stages[stage] += now.Sub(t.last)
+	t.last = now
+}
+
+// finish records the timings of a message that was relayed.
+func (t *relayTimer) finish() {
+	if t.profile == nil {
+		return
+	}
+	t.profile.record(&t.stages)
+}
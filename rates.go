@@ -0,0 +1,85 @@
+package waddell
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// rateWindow is the number of whole seconds over which Client.Rates
+	// averages throughput.
+	rateWindow = 5
+)
+
+// Rates describes the throughput of a Client's messages, averaged over the
+// previous 5 whole seconds. Rates are updated once per second, so messages sent
+// or received during the current second aren't reflected yet.
+type Rates struct {
+	// SentMessages: messages sent per second
+	SentMessages float64
+
+	// SentBytes: bytes of message bodies sent per second
+	SentBytes float64
+
+	// ReceivedMessages: messages received per second
+	ReceivedMessages float64
+
+	// ReceivedBytes: bytes of message bodies received per second
+	ReceivedBytes float64
+}
+
+// Rates returns the current throughput of this client's messages, which allows
+// applications to throttle themselves before the server does. Only messages to
+// and from other peers are counted.
+func (c *Client) Rates() Rates {
+	now := time.Now()
+	sentMessages, sentBytes := c.sent.rates(now)
+	receivedMessages, receivedBytes := c.received.rates(now)
+	return Rates{
+		SentMessages:     sentMessages,
+		SentBytes:        sentBytes,
+		ReceivedMessages: receivedMessages,
+		ReceivedBytes:    receivedBytes,
+	}
+}
+
+// rateCounter counts messages and bytes in one bucket per second, keeping just
+// enough buckets to cover the rate window and the current second.
+type rateCounter struct {
+	buckets [rateWindow + 1]rateBucket
+	mutex   sync.Mutex
+}
+
+type rateBucket struct {
+	second   int64
+	messages int64
+	bytes    int64
+}
+
+func (rc *rateCounter) add(now time.Time, bytes int) {
+	second := now.Unix()
+	rc.mutex.Lock()
+	b := &rc.buckets[second%int64(len(rc.buckets))]
+	if b.second != second {
+		*b = rateBucket{second: second}
+	}
+	b.messages++
+	b.bytes += int64(bytes)
+	rc.mutex.Unlock()
+}
+
+// rates returns messages and bytes per second over the rate window preceding
+// the current second.
+func (rc *rateCounter) rates(now time.Time) (float64, float64) {
+	second := now.Unix()
+	var messages, bytes int64
+	rc.mutex.Lock()
+	for _, b := range rc.buckets {
+		if b.second >= second-rateWindow && b.second < second {
+			messages += b.messages
+			bytes += b.bytes
+		}
+	}
+	rc.mutex.Unlock()
+	return float64(messages) / rateWindow, float64(bytes) / rateWindow
+}
@@ -0,0 +1,117 @@
+package waddell
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/getlantern/framed"
+)
+
+// readBuffer is a connection's own buffer for reading frames, see
+// Server.MinReadBuffer. It starts out (and, while the connection is quiet,
+// stays) small, grows to fit larger frames as they arrive and shrinks back
+// once no large frames have arrived for a while.
+type readBuffer struct {
+	min         int
+	max         int
+	shrinkAfter time.Duration
+	header      [framed.FrameHeaderLength]byte
+	buf         []byte      // nil until the first frame arrives or after shrinking
+	shrink      *time.Timer // shrinks buf back to min, nil until buf first grows
+	mutex       sync.Mutex
+}
+
+func (server *Server) newReadBuffer() *readBuffer {
+	min := server.minReadBuffer()
+	if min <= 0 {
+		return nil
+	}
+	max := server.MaxReadBuffer
+	if max <= 0 {
+		max = server.BufferBytes
+	}
+	if max < min {
+		max = min
+	}
+	shrinkAfter := server.ReadBufferShrinkAfter
+	if shrinkAfter <= 0 {
+		shrinkAfter = DefaultReadBufferShrinkAfter
+	}
+	return &readBuffer{min: min, max: max, shrinkAfter: shrinkAfter}
+}
+
+// read reads the next frame from the given stream (the same stream that the
+// connection's framed.Reader reads from). The returned frame is only valid
+// until the next call to read.
+func (rb *readBuffer) read(r io.Reader) ([]byte, error) {
+	_, err := io.ReadFull(r, rb.header[:])
+	if err != nil {
+		return nil, err
+	}
+	length := int(endianness.Uint16(rb.header[:]))
+	if length > rb.max {
+		return nil, fmt.Errorf("Frame of %d bytes exceeds maximum read buffer of %d bytes", length, rb.max)
+	}
+	b := rb.bufferFor(length)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+// bufferFor returns a buffer of the given length, growing buf as necessary.
+func (rb *readBuffer) bufferFor(length int) []byte {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	if rb.buf == nil {
+		rb.buf = make([]byte, rb.min)
+	}
+	if length <= rb.min {
+		return rb.buf[:length]
+	}
+	if length > len(rb.buf) {
+		// Grow to the next power of 2 (within limits), so that a run of
+		// slightly larger frames doesn't grow the buffer every time
+		size := rb.min
+		for size < length {
+			size *= 2
+		}
+		if size > rb.max {
+			size = rb.max
+		}
+		rb.buf = make([]byte, size)
+	}
+	if rb.shrink == nil {
+		rb.shrink = time.AfterFunc(rb.shrinkAfter, rb.shrinkToMin)
+	} else {
+		rb.shrink.Reset(rb.shrinkAfter)
+	}
+	return rb.buf[:length]
+}
+
+// shrinkToMin drops a grown buffer, so that a connection that's waiting for
+// its next frame only holds on to a buffer of the minimum size. A frame that's
+// still being read into the old buffer is unaffected.
+func (rb *readBuffer) shrinkToMin() {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	if len(rb.buf) > rb.min {
+		rb.buf = make([]byte, rb.min)
+	}
+}
+
+// stop stops shrinking the buffer once the connection is closed.
+func (rb *readBuffer) stop() {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	if rb.shrink != nil {
+		rb.shrink.Stop()
+	}
+}
+
+// size returns the current size of the buffer.
+func (rb *readBuffer) size() int {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	return len(rb.buf)
+}
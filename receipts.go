@@ -0,0 +1,186 @@
+package waddell
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Delivery receipts
+//
+// Receipts are implemented entirely by clients, using two reserved topics, so
+// servers relay them like any other message:
+//
+//   sender -> recipient : message on receiptRequestTopic whose body is the
+//                         16-bit topic of the message, a 64-bit receipt id
+//                         chosen by the sender and the actual message body
+//
+//   recipient -> sender : message on receiptTopic whose body is the 64-bit
+//                         receipt id, sent once the message has been
+//                         delivered to the recipient's in topic
+//
+// The one thing the server does know about receipts is that, when it drops a
+// message on receiptRequestTopic, it tells the sender with a droppedFrame so
+// that SendWithReceipt can fail right away.
+//
+// Receipt ids are unique per sending client, so the sender correlates a receipt
+// to the message using the receipt id together with the id of the peer from
+// which the receipt came.
+
+const (
+	receiptRequestTopic = TopicId(0xfffe)
+	receiptTopic        = TopicId(0xffff)
+
+	receiptIdLength = 8
+)
+
+type receiptKey struct {
+	from PeerId
+	id   uint64
+}
+
+// SendWithReceipt sends a message to the given peer on the given topic and
+// waits for the recipient's client to confirm that the message was delivered,
+// which gives end-to-end confirmation of delivery rather than just confirmation
+// that the message made it to the server. The message counts as delivered once
+// the recipient's client has passed it to the in topic for the given topic,
+// which may be buffered (see ClientConfig.InBufferSize). If the recipient isn't
+// reading from that topic (or isn't listening on it at all), no receipt is sent
+// and SendWithReceipt returns an error once the timeout elapses.
+//
+// Note - the recipient needs to run a version of this package that supports
+// receipts, and topics 0xfffe and 0xffff are reserved for them. If the server
+// reports that it dropped the message, SendWithReceipt returns a *DroppedError
+// without waiting for the timeout.
+func (c *Client) SendWithReceipt(id TopicId, to PeerId, timeout time.Duration, body ...[]byte) error {
+	if c.isClosed() {
+		return closedError
+	}
+	if c.Mode == ReceiveOnly {
+		return fmt.Errorf("Unable to send on receive only client")
+	}
+	err := checkTopic(id)
+	if err != nil {
+		return err
+	}
+	body, ok := c.intercept(to, body)
+	if !ok {
+		return fmt.Errorf("Message dropped by Intercept")
+	}
+	err = checkSize(bodyLength(body), MaxDataLength-TopicIdLength-receiptIdLength)
+	if err != nil {
+		return err
+	}
+	err = c.awaitCredit(to)
+	if err != nil {
+		return err
+	}
+
+	key := receiptKey{to, atomic.AddUint64(&c.receiptSeq, 1)}
+	received := make(chan error, 1)
+	c.receiptsMutex.Lock()
+	c.receipts[key] = received
+	c.receiptsMutex.Unlock()
+	defer func() {
+		c.receiptsMutex.Lock()
+		delete(c.receipts, key)
+		c.receiptsMutex.Unlock()
+	}()
+
+	info := c.getConnInfo()
+	if info.err != nil {
+		return info.err
+	}
+	header := make([]byte, TopicIdLength+receiptIdLength)
+	endianness.PutUint16(header, uint16(id))
+	endianness.PutUint64(header[TopicIdLength:], key.id)
+	pieces := make([][]byte, 0, 3+len(body))
+	pieces = append(pieces, to.toBytes(), receiptRequestTopic.toBytes(), header)
+	pieces = append(pieces, body...)
+	err = info.write(pieces...)
+	if err != nil {
+		c.connError(info, err)
+		return err
+	}
+
+	select {
+	case err := <-received:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("No receipt received within %v", timeout)
+	}
+}
+
+// unwrapReceiptRequest turns a message that requests a receipt into the
+// actual message, returning the receipt id.
+func unwrapReceiptRequest(msg *MessageIn) (uint64, error) {
+	if len(msg.Body) < TopicIdLength+receiptIdLength {
+		return 0, fmt.Errorf("Receipt request too short")
+	}
+	msg.topic = TopicId(endianness.Uint16(msg.Body))
+	receiptId := endianness.Uint64(msg.Body[TopicIdLength:])
+	msg.Body = msg.Body[TopicIdLength+receiptIdLength:]
+	return receiptId, nil
+}
+
+// sendReceipt confirms delivery of the message with the given receipt id to its
+// sender.
+func (c *Client) sendReceipt(info *connInfo, to PeerId, receiptId uint64) {
+	b := make([]byte, receiptIdLength)
+	endianness.PutUint64(b, receiptId)
+	err := info.write(to.toBytes(), receiptTopic.toBytes(), b)
+	if err != nil {
+		log.Tracef("Unable to send receipt to %s: %s", c.logId(to), err)
+	}
+}
+
+// processReceipt notifies whoever is waiting for the given receipt.
+func (c *Client) processReceipt(msg *MessageIn) {
+	if len(msg.Body) != receiptIdLength {
+		log.Tracef("Ignoring invalid receipt from %s", c.logId(msg.From))
+		return
+	}
+	c.completeReceipt(receiptKey{msg.From, endianness.Uint64(msg.Body)}, nil)
+}
+
+// processDropped notifies whoever is waiting for a receipt for a message that
+// the server dropped.
+func (c *Client) processDropped(body []byte) {
+	if len(body) != PeerIdLength+receiptIdLength+2 {
+		log.Errorf("Invalid dropped frame of length %d", len(body))
+		return
+	}
+	to, err := readPeerId(body)
+	if err != nil {
+		log.Errorf("Unable to read recipient of dropped message: %s", err)
+		return
+	}
+	receiptId := endianness.Uint64(body[PeerIdLength:])
+	reason := DropReason(endianness.Uint16(body[PeerIdLength+receiptIdLength:]))
+	c.completeReceipt(receiptKey{to, receiptId}, &DroppedError{reason})
+}
+
+// completeReceipt passes the outcome of sending the message identified by key
+// to whoever is waiting for its receipt.
+func (c *Client) completeReceipt(key receiptKey, err error) {
+	c.receiptsMutex.Lock()
+	received := c.receipts[key]
+	c.receiptsMutex.Unlock()
+	if received == nil {
+		log.Tracef("Ignoring unexpected receipt from %s", c.logId(key.from))
+		return
+	}
+	select {
+	case received <- err:
+	default:
+	}
+}
+
+// encodeDropped encodes the body of a droppedFrame.
+func encodeDropped(to PeerId, receiptId uint64, reason DropReason) []byte {
+	b := make([]byte, PeerIdLength+receiptIdLength+2)
+	copy(b, to.toBytes())
+	endianness.PutUint64(b[PeerIdLength:], receiptId)
+	endianness.PutUint16(b[PeerIdLength+receiptIdLength:], uint16(reason))
+	return b
+}
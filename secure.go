@@ -0,0 +1,154 @@
+package waddell
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+)
+
+// End-to-end encryption
+//
+// TLS only protects the connections between clients and the server. The server
+// terminates TLS, so it can read every message that it relays. SecuredPeer adds
+// encryption between the peers themselves on top of a Session, so that the
+// server only ever relays ciphertext that it can neither read nor tamper with
+// undetected.
+//
+// Each peer has a long-term X25519 key pair (see NewSecureKey). The peers
+// combine their own private key and the other peer's public key into a shared
+// secret, from which they derive one AES-256-GCM key per direction. Every
+// message carries a random nonce ahead of the ciphertext and is authenticated
+// together with its topic:
+//
+//   12-byte nonce | ciphertext | 16-byte tag
+//
+// Key management is up to the application:
+//
+//   - Private keys never leave the peer that generated them. Keep them as
+//     secret as TLS private keys.
+//
+//   - Public keys (PublicKey().Bytes() of a private key, parsed again with
+//     ecdh.X25519().NewPublicKey) have to be exchanged out of band over a
+//     channel that the server can't tamper with, just like peer ids. If the
+//     server could substitute its own public keys, it could read and relay
+//     everything as a man in the middle. Public keys don't need to be secret.
+//
+//   - Since the keys are long-term, they survive reconnects and changes of
+//     peer id. To rotate keys, generate new ones and exchange the new public
+//     keys out of band again.
+//
+// SecuredPeer doesn't protect against the server replaying, reordering or
+// dropping messages, nor does it hide who talks to whom, when, or how much.
+// Applications that care about replays should include their own sequence
+// numbers in the messages.
+
+const (
+	secureNonceLength = 12
+	secureOverhead    = secureNonceLength + 16
+)
+
+// NewSecureKey generates a new X25519 private key for use with SecuredPeer.
+func NewSecureKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// SecuredPeer wraps a Session with end-to-end authenticated encryption (see
+// "End-to-end encryption"). Both peers need to use a SecuredPeer on their
+// Sessions with each other.
+type SecuredPeer struct {
+	session *Session
+	sealer  cipher.AEAD // for messages to the remote peer
+	opener  cipher.AEAD // for messages from the remote peer
+}
+
+// NewSecuredPeer secures the given Session using this peer's private key and
+// the remote peer's public key, which must have been exchanged out of band.
+func NewSecuredPeer(session *Session, key *ecdh.PrivateKey, remoteKey *ecdh.PublicKey) (*SecuredPeer, error) {
+	shared, err := key.ECDH(remoteKey)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to agree on shared secret: %s", err)
+	}
+	local := key.PublicKey().Bytes()
+	remote := remoteKey.Bytes()
+	// Separate keys for each direction keep the server from reflecting a
+	// peer's own messages back at it.
+	sealer, err := newSecureAEAD(shared, local, remote)
+	if err != nil {
+		return nil, err
+	}
+	opener, err := newSecureAEAD(shared, remote, local)
+	if err != nil {
+		return nil, err
+	}
+	return &SecuredPeer{session: session, sealer: sealer, opener: opener}, nil
+}
+
+// newSecureAEAD derives the key for messages from the peer with public key from
+// to the peer with public key to.
+func newSecureAEAD(shared []byte, from []byte, to []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write([]byte("waddell end-to-end encryption"))
+	h.Write(shared)
+	h.Write(from)
+	h.Write(to)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create cipher: %s", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Session returns the underlying Session.
+func (sp *SecuredPeer) Session() *Session {
+	return sp.session
+}
+
+// Send encrypts the given body and sends it to the remote peer. Encryption
+// adds 28 bytes to every message, so bodies can be at most MaxDataLength-28
+// bytes long.
+func (sp *SecuredPeer) Send(body ...[]byte) error {
+	length := bodyLength(body)
+	err := checkSize(length, MaxDataLength-secureOverhead)
+	if err != nil {
+		return err
+	}
+	plaintext := make([]byte, 0, length)
+	for _, piece := range body {
+		plaintext = append(plaintext, piece...)
+	}
+	sealed := make([]byte, secureNonceLength, secureOverhead+length)
+	_, err = rand.Read(sealed)
+	if err != nil {
+		return fmt.Errorf("Unable to generate nonce: %s", err)
+	}
+	sealed = sp.sealer.Seal(sealed, sealed, plaintext, sp.session.topic.toBytes())
+	return sp.session.Send(sealed)
+}
+
+// Receive blocks until the next message from the remote peer arrives and
+// returns its decrypted body. Messages that fail to decrypt (e.g. because they
+// were tampered with or weren't encrypted for this peer) are discarded. Note
+// that a Session that doesn't know its remote peer yet binds to whichever peer
+// sends it the first message (see NewSession), so a peer that doesn't have
+// the right keys can still keep such a Session from hearing from anybody else.
+func (sp *SecuredPeer) Receive() ([]byte, error) {
+	for {
+		sealed, err := sp.session.Receive()
+		if err != nil {
+			return nil, err
+		}
+		if len(sealed) < secureOverhead {
+			log.Tracef("Session on topic %d ignoring message too short to be encrypted", sp.session.topic)
+			continue
+		}
+		body, err := sp.opener.Open(nil, sealed[:secureNonceLength], sealed[secureNonceLength:], sp.session.topic.toBytes())
+		if err != nil {
+			log.Tracef("Session on topic %d ignoring message that failed to decrypt: %s", sp.session.topic, err)
+			continue
+		}
+		return body, nil
+	}
+}
@@ -0,0 +1,109 @@
+package waddell
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var (
+	// ErrNoClients is returned by Selector.Select when no clients have been
+	// added to the Selector.
+	ErrNoClients = fmt.Errorf("No clients to select from")
+)
+
+// Selector receives messages on a single topic from several Clients at once
+// (e.g. clients connected to different waddell servers), so that applications
+// don't have to fan in the clients' in topics themselves. Unlike ClientMgr, a
+// Selector doesn't manage the clients, it only multiplexes receiving.
+//
+// Selecting is fair: whenever messages are waiting on more than one client,
+// the client to receive from is picked at random, so a busy client can't starve
+// the others.
+type Selector struct {
+	topic   TopicId
+	clients []*Client
+	ins     []<-chan *MessageIn
+	changed chan struct{} // closed whenever clients are added or removed
+	mutex   sync.Mutex
+}
+
+// NewSelector creates a Selector that receives on the given topic.
+func NewSelector(topic TopicId) *Selector {
+	return &Selector{
+		topic:   topic,
+		changed: make(chan struct{}),
+	}
+}
+
+// Add starts selecting from the given client, which shares its in topic with
+// the Selector, so the application shouldn't also receive from it directly.
+// Adding a client that has already been added does nothing.
+func (s *Selector) Add(c *Client) {
+	in := c.In(s.topic)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, existing := range s.clients {
+		if existing == c {
+			return
+		}
+	}
+	s.clients = append(s.clients, c)
+	s.ins = append(s.ins, in)
+	s.notifyChanged()
+}
+
+// Remove stops selecting from the given client.
+func (s *Selector) Remove(c *Client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, existing := range s.clients {
+		if existing == c {
+			s.clients = append(s.clients[:i:i], s.clients[i+1:]...)
+			s.ins = append(s.ins[:i:i], s.ins[i+1:]...)
+			s.notifyChanged()
+			return
+		}
+	}
+}
+
+// notifyChanged wakes up any pending Select so that it picks up the current
+// clients. Must be called with mutex held.
+func (s *Selector) notifyChanged() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Select blocks until a message is available from one of the clients and
+// returns the message along with the client that received it. If one of the
+// clients is closed, Select stops selecting from it and returns it along with
+// an error. If there are no clients to select from, Select returns
+// ErrNoClients.
+func (s *Selector) Select() (*MessageIn, *Client, error) {
+	for {
+		s.mutex.Lock()
+		if len(s.clients) == 0 {
+			s.mutex.Unlock()
+			return nil, nil, ErrNoClients
+		}
+		clients := s.clients
+		cases := make([]reflect.SelectCase, 0, len(s.ins)+1)
+		for _, in := range s.ins {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(in)})
+		}
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.changed)})
+		s.mutex.Unlock()
+
+		chosen, value, ok := reflect.Select(cases)
+		if chosen == len(clients) {
+			// Clients changed, select again
+			continue
+		}
+		c := clients[chosen]
+		if !ok {
+			s.Remove(c)
+			return nil, c, closedError
+		}
+		return value.Interface().(*MessageIn), c, nil
+	}
+}
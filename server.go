@@ -1,10 +1,18 @@
 package waddell
 
 import (
+	"bufio"
+	"compress/flate"
+	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
+	"math/rand"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/getlantern/framed"
 	"github.com/getlantern/tlsdefaults"
@@ -12,11 +20,24 @@ import (
 )
 
 const (
-	DefaultNumBuffers = 10000
+	DefaultNumBuffers          = 10000
+	DefaultOnConnectTimeout    = 5 * time.Second
+	DefaultFrameReadTimeout    = 30 * time.Second
+	DefaultHandshakeTimeout    = 10 * time.Second
+	DefaultBackpressureTimeout = 5 * time.Second
+
+	DefaultReadBufferShrinkAfter = 10 * time.Second
 
 	numAddPeerAttempts = 100
 )
 
+var (
+	errRecipientNotConnected = fmt.Errorf("Recipient not connected")
+	errBuffersFull           = fmt.Errorf("Server buffers full")
+	errInboxFull             = fmt.Errorf("Recipient's inbox full")
+	errUnauthorized          = fmt.Errorf("Sender not authorized to message recipient")
+)
+
 // Server is a waddell server
 type Server struct {
 	// NumBuffers: number of buffers to cache for reading and writing (balances
@@ -27,24 +48,345 @@ type Server struct {
 	// message size that can be transmitted).  Defaults to 65,535.
 	BufferBytes int
 
-	peers      map[PeerId]*peer // connected peers by id
-	peersMutex sync.RWMutex     // protects access to peers map
-	buffers    *bpool.BytePool  // pool of buffers for reading/writing
+	// MinReadBuffer: if greater than 0, each connection reads frames into a
+	// buffer of its own that starts out this many bytes long and only grows
+	// (up to MaxReadBuffer) when a larger frame arrives, instead of holding on
+	// to one of the BufferBytes sized buffers while it waits for its next
+	// frame. Once no larger frames have arrived for ReadBufferShrinkAfter,
+	// the buffer shrinks back to this size. This keeps the memory footprint
+	// of many connections that mostly carry small messages low, while still
+	// allowing the occasional large message.
+	MinReadBuffer int
+
+	// MaxReadBuffer: how large a connection's read buffer may grow if using
+	// MinReadBuffer. Like BufferBytes, this caps the size of frames that
+	// peers can send. Defaults to BufferBytes.
+	MaxReadBuffer int
+
+	// ReadBufferShrinkAfter: how long a connection's read buffer stays grown
+	// after the last frame that didn't fit MinReadBuffer. Defaults to 10
+	// seconds.
+	ReadBufferShrinkAfter time.Duration
+
+	// TraceSampleRate: fraction (between 0 and 1) of relayed messages for
+	// which to log the sender, recipient and size, which helps diagnose
+	// messages that aren't arriving. Message bodies are never logged. Defaults
+	// to 0, which disables sampling.
+	TraceSampleRate float64
+
+	// Metrics: if non-nil, the server counts the frames it handles using
+	// these Metrics.
+	Metrics *Metrics
+
+	// Echo: if true, messages sent to EchoId are echoed back to the sender,
+	// which allows clients to test round-trip connectivity without needing a
+	// second peer. See Client.Echo.
+	Echo bool
+
+	// MaxConnections: if greater than 0, the server rejects new connections
+	// while it already has this many connected peers. Rejected clients receive
+	// a RejectedError with reason RejectServerFull.
+	MaxConnections int
+
+	// OnConnect: optional hook that's called whenever a new connection has
+	// been accepted (and, if using TLS, the TLS handshake has completed), with
+	// the peer id that's about to be assigned and the remote address of the
+	// connection. If it returns an error, the connection is rejected with
+	// RejectDenied. This allows custom admission control, e.g. checking quotas
+	// in an external system.
+	//
+	// OnConnect is called on the new connection's own goroutine, so it doesn't
+	// hold up accepting other connections. Still, it should return promptly,
+	// since the client waits on it to get its peer id.
+	OnConnect func(id PeerId, remoteAddr net.Addr) error
+
+	// OnConnectTimeout: how long to wait for OnConnect before rejecting the
+	// connection. Defaults to 5 seconds.
+	OnConnectTimeout time.Duration
+
+	// AllowCompression: if true, the server agrees to compress connections
+	// with flate for clients that ask for it (see ClientConfig.Compress).
+	AllowCompression bool
+
+	// FrameReadTimeout: how long a peer has to finish sending a frame once it
+	// has started sending it. Peers that stall in the middle of a frame (e.g.
+	// in a slowloris style attack) are disconnected, which frees up the
+	// server resources dedicated to them. Peers can still sit idle between
+	// frames for as long as they like. Defaults to 30 seconds, set to a
+	// negative value to disable.
+	FrameReadTimeout time.Duration
+
+	// HandshakeTimeout: how long a peer connecting over TLS has to complete
+	// the TLS handshake. Peers that connect but stall the handshake are
+	// disconnected, so they can't tie up the server's goroutines and
+	// connection slots (see MaxConnections). Defaults to 10 seconds, set to a
+	// negative value to disable.
+	HandshakeTimeout time.Duration
+
+	// MaxBufferedBytes: if greater than 0, caps the total size of the
+	// messages that the server holds in memory while relaying them. Since
+	// the server relays each message with a synchronous write, messages to
+	// slow readers stay buffered until the reader catches up. Once the cap is
+	// reached, the server drops further messages instead of relaying them
+	// (see DropBuffersFull and Metrics.Dropped) until enough buffered
+	// messages have been delivered. See BufferedBytes.
+	MaxBufferedBytes int64
+
+	// InboxCapacity: if greater than 0, at most this many senders may be
+	// writing to any one recipient at a time. The server relays each message
+	// with a synchronous write, so a sender that's relaying to a slow
+	// recipient stays blocked (holding on to its message) until the recipient
+	// has read it. Nothing is queued beyond these blocked writes. Limiting
+	// them keeps a single slow recipient from tying up lots of senders and
+	// memory. Further messages to that recipient are dropped (see
+	// DropInboxFull and Metrics.Dropped) unless Backpressure is enabled.
+	// Since signaling messages tend to be small and uniform, counting them
+	// is often easier to reason about than MaxBufferedBytes. The two can be
+	// combined, in which case whichever limit is reached first applies.
+	InboxCapacity int
+
+	// Backpressure: if true, messages to recipients whose inbox is full (see
+	// InboxCapacity) aren't dropped right away. Instead, the server stops
+	// reading from the sender until the recipient's inbox has room, so that
+	// congestion propagates back to senders much like TCP flow control.
+	// Backpressure doesn't apply to MaxBufferedBytes.
+	//
+	// Deadlock avoidance: a sender waits for at most one recipient's inbox at
+	// a time, and only while it doesn't hold a slot in any inbox, so the
+	// server itself never waits in a cycle. Peers can still congest each
+	// other though, e.g. if A and B each only read once they're done writing
+	// to the other. To break such cycles, senders wait at most
+	// BackpressureTimeout, after which the message is dropped after all.
+	//
+	// Note - while waiting, the sender holds on to its relay turn if
+	// FairRelayConcurrency is set.
+	Backpressure bool
+
+	// BackpressureTimeout: how long to wait for room in a recipient's inbox
+	// when applying Backpressure. Defaults to DefaultBackpressureTimeout.
+	BackpressureTimeout time.Duration
+
+	// MaxConnectionLifetime: if greater than 0, the server closes connections
+	// once they've been open this long, telling clients why (see
+	// CloseExpired). Clients reconnect on next use and get a fresh peer id,
+	// which enforces rotation of peer ids centrally. To keep clients from all
+	// reconnecting at the same time, each connection's lifetime is shortened
+	// by a random amount of up to 10%.
+	MaxConnectionLifetime time.Duration
+
+	// FairRelayConcurrency: if greater than 0, the server relays at most this
+	// many messages at a time and hands out turns to relay round-robin among
+	// the peers that have messages waiting. This keeps a single high-volume
+	// sender from starving other peers when the server is CPU or bandwidth
+	// bound, at the cost of some scheduling overhead per message. A good
+	// starting point is the number of CPUs.
+	//
+	// Note - since relaying includes writing to the recipient, turns are held
+	// for as long as it takes to write to the recipient, so slow recipients
+	// slow down relaying for everyone once all turns are taken.
+	FairRelayConcurrency int
+
+	// PriorityClass: optional function assigning a priority class to each
+	// newly connected peer (after OnConnect has admitted it), e.g. based on
+	// its ServerName or on what OnConnect learned about it. When relay turns
+	// are scarce (see FairRelayConcurrency), peers of higher classes get
+	// turns first, and turns are handed out round-robin within each class.
+	// This allows guaranteeing service levels for premium peers, at the risk
+	// of starving lower classes while higher classes keep the server busy.
+	// Classes have no effect unless FairRelayConcurrency is set. Messages
+	// themselves carry no priority, so all messages from a peer are relayed
+	// in order with that peer's class. Peers default to class 0.
+	PriorityClass func(p *PeerInfo) int
+
+	// CoalesceWindow: by default (0), every relayed message is written to the
+	// recipient with its own write (i.e. syscall). If greater than 0, messages
+	// to a recipient are instead buffered for up to CoalesceWindow, so that
+	// bursts of messages to the same recipient go out in a single write. This
+	// is the server's counterpart to ClientConfig.FlushInterval and trades
+	// the same way, adding up to CoalesceWindow of latency to save syscalls
+	// and packets, so keep it small (e.g. a millisecond). System frames (e.g.
+	// pongs and close notifications) are always written right away, along
+	// with anything that's already buffered.
+	CoalesceWindow time.Duration
+
+	// AutoTune: experimental. If true, the server periodically looks at its
+	// Stats and adjusts CoalesceWindow and MinReadBuffer to its traffic,
+	// starting from the configured values. It coalesces writes for up to a
+	// millisecond while connections are busy and few messages are dropped
+	// (drops indicate that recipients are falling behind already), and sizes
+	// new connections' read buffers to fit the average message. Off by
+	// default.
+	AutoTune bool
+
+	// ProfileRelay: if true, the server times the stages of relaying each
+	// message (reading, parsing, looking up the recipient, enqueueing and
+	// writing) and reports percentiles of the timings in RelayProfile,
+	// which pinpoints where latency comes from under load. Timing adds some
+	// overhead to every message, so this is meant for performance debugging.
+	ProfileRelay bool
+
+	// TraceRelay: optional hook for tracing the relaying of messages, e.g. by
+	// starting an OpenTelemetry span. It's called with the sender, recipient,
+	// topic and body size of each message that the server is about to relay
+	// and returns a function that the server calls once it's done relaying,
+	// with an error if the message couldn't be relayed (e.g. because the
+	// recipient isn't connected). TraceRelay is called on the sender's
+	// goroutine, so it should return promptly. When TraceRelay is nil,
+	// tracing adds no overhead.
+	TraceRelay func(from PeerId, to PeerId, topic TopicId, size int) (done func(err error))
+
+	// Authorize: optional function deciding whether the peer identified by
+	// from may send messages to the peer identified by to, e.g. for
+	// deployments where only peers paired by an external authorization system
+	// may talk to each other. Unauthorized messages are dropped (see
+	// DropUnauthorized). Since Authorize is called for every relayed message
+	// on the sender's goroutine, it needs to be fast and safe for concurrent
+	// use, e.g. by looking up an in-memory map rather than calling out to the
+	// authorization system. The server doesn't cache its answers, so
+	// revocations take effect immediately. Authorize can look up details like
+	// the peers' ServerName using Peer.
+	Authorize func(from PeerId, to PeerId) bool
+
+	// IsolateByServerName: if true, peers can only message peers that
+	// connected using the same TLS server name (SNI), which isolates tenants
+	// that share a server under different hostnames. To peers of other
+	// tenants, a peer looks like it isn't connected at all (see
+	// DropRecipientNotConnected), so tenants can't even learn about each
+	// other's peers. This requires serving TLS with a certificate for each
+	// tenant's hostname, e.g. using ListenTLS with a tls.Config whose
+	// GetCertificate picks the certificate by SNI. Peers that connect without
+	// TLS or without SNI form a tenant of their own (with an empty server
+	// name).
+	//
+	// Note - clients choose the server name they send, so this only isolates
+	// tenants from each other as long as clients can't learn other tenants'
+	// hostnames. It's not a substitute for authenticating clients (see
+	// OnConnect) or for Authorize.
+	IsolateByServerName bool
+
+	// OnDrop: optional callback that's notified whenever the server drops a
+	// message instead of relaying it, e.g. because the recipient isn't
+	// connected or because the server's buffers are full. OnDrop is called on
+	// its own goroutine so that it never holds up relaying. Independently of
+	// OnDrop, senders that used Client.SendWithReceipt are told when their
+	// message was dropped.
+	OnDrop func(from PeerId, to PeerId, reason DropReason)
+
+	// LogId: optional function that determines how peer ids appear in the
+	// server's logs, for example to shorten them or to keep raw ids out of
+	// logs altogether. Defaults to PeerId.String.
+	LogId func(id PeerId) string
+
+	// Welcome: optional function returning a payload to push to each peer
+	// right after assigning it an id, e.g. operational parameters like lists
+	// of STUN/TURN servers or a recommended keepalive interval. Clients can
+	// read the payload with Client.Welcome. Payloads longer than
+	// MaxDataLength aren't sent.
+	Welcome func(id PeerId) []byte
+
+	// RandSource: optional source of entropy from which to generate peer ids,
+	// e.g. for operators who need to use a particular (FIPS validated) random
+	// number generator. Reads from RandSource are serialized. Defaults to
+	// crypto/rand.
+	RandSource io.Reader
+
+	// Allocator: optional Allocator to which the server delegates allocating
+	// peer ids, e.g. to make ids unique across a cluster or to embed routing
+	// information in them. Ids that are already taken or reserved are
+	// allocated again, up to a few times before rejecting the connection.
+	// Takes precedence over RandSource. By default, peer ids are random.
+	Allocator Allocator
+
+	// AcceptRate: if greater than 0, the maximum number of new connections per
+	// second that the server accepts. This smooths out storms of reconnecting
+	// clients (e.g. after an outage) so that they don't overwhelm the server's
+	// CPU (for TLS handshakes) or downstream systems like OnConnect. By
+	// default, excess connections wait their turn.
+	AcceptRate float64
+
+	// AcceptBurst: how many connections in excess of AcceptRate the server
+	// accepts back-to-back before it starts throttling. Defaults to 1.
+	AcceptBurst int
+
+	// RejectExcessConnections: if true, connections in excess of AcceptRate
+	// are rejected with RejectRateLimited instead of waiting their turn.
+	RejectExcessConnections bool
+
+	// AuditEvents: if greater than 0, the number of recent connection
+	// lifecycle events (connects, disconnects and rejections) that the server
+	// keeps for investigating incidents, see RecentEvents. Memory use is
+	// bounded by this number.
+	AuditEvents int
+
+	peers         map[PeerId]*peer // connected peers by id
+	aliases       map[string]*peer // connected peers by alias
+	peersMutex    sync.RWMutex     // protects access to peers and aliases maps
+	buffers       *bpool.BytePool  // pool of buffers for reading/writing
+	listener      net.Listener
+	listenerMutex sync.Mutex
+	randMutex     sync.Mutex // serializes reads from RandSource
+	shutdown      int32
+	draining      int32 // set once Migrate has been called
+	buffered      int64 // bytes of messages currently being relayed
+	relaySlots    *fairSemaphore
+	started       int64 // when Serve was called, in unix nanoseconds
+	relayed       int64 // see Stats
+	relayedBytes  int64 // see Stats
+	dropped       int64 // see Stats
+	connected     int64 // admitted peers, see Stats
+	registered    int64 // all peers in peers, see Stats
+	accepted      rateCounter
+	profile       *relayProfile // non-nil if ProfileRelay is set
+	tuner         *autoTuner    // non-nil if AutoTune is set
+	audit         auditLog
 }
 
 // Listen creates a listener at the given address. pkfile and certfile are
 // optional. If both are specified, connections will be secured with TLS.
 func Listen(addr string, pkfile string, certfile string) (net.Listener, error) {
+	return ListenWith(net.ListenConfig{}, addr, pkfile, certfile)
+}
+
+// ListenWith is like Listen, but creates the underlying TCP listener using the
+// given ListenConfig, which allows tuning the listening socket. Commonly useful
+// options are:
+//
+//   - Control: set socket options like SO_RCVBUF/SO_SNDBUF (buffer sizes) or
+//     SO_REUSEPORT (to run multiple servers on the same port)
+//   - KeepAlive: the TCP keepalive period for accepted connections
+//
+// Note - the accept backlog is determined by the operating system (e.g.
+// net.core.somaxconn on Linux) and needs to be raised there for servers that
+// handle high connection churn.
+func ListenWith(lc net.ListenConfig, addr string, pkfile string, certfile string) (net.Listener, error) {
 	if (pkfile != "" && certfile == "") || (pkfile == "" && certfile != "") {
 		return nil, fmt.Errorf("Please specify both pkfile and certfile")
 	}
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
 	if pkfile != "" {
-		return listenTLS(addr, pkfile, certfile)
+		return listenTLS(l, pkfile, certfile)
 	} else {
-		return net.Listen("tcp", addr)
+		return l, nil
 	}
 }
 
+// ListenUnix creates a listener on the Unix domain socket at the given path,
+// which is useful when clients run on the same host as the server (e.g. as a
+// sidecar). Since traffic never leaves the host, TLS is unnecessary for local
+// sockets. Clients can connect using a DialFunc like:
+//
+//	func() (net.Conn, error) {
+//	  return net.Dial("unix", path)
+//	}
+//
+// Framing and peer id addressing work exactly as they do over TCP.
+func ListenUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
+
 // Serve starts the waddell server using the given listener
 func (server *Server) Serve(listener net.Listener) error {
 	// Set default values
@@ -56,92 +398,580 @@ func (server *Server) Serve(listener net.Listener) error {
 	}
 
 	server.buffers = bpool.NewBytePool(server.NumBuffers, server.BufferBytes)
+	atomic.StoreInt64(&server.started, time.Now().UnixNano())
+	server.peersMutex.Lock()
 	server.peers = make(map[PeerId]*peer)
+	server.aliases = make(map[string]*peer)
+	server.peersMutex.Unlock()
+	server.listenerMutex.Lock()
+	server.listener = listener
+	server.listenerMutex.Unlock()
+	limiter := server.newAcceptLimiter()
+	if server.FairRelayConcurrency > 0 {
+		server.relaySlots = newFairSemaphore(server.FairRelayConcurrency)
+	}
+	if server.ProfileRelay {
+		server.profile = newRelayProfile()
+	}
+	if server.AutoTune {
+		server.tuner = server.newAutoTuner()
+		go server.tuner.run()
+	}
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if atomic.LoadInt32(&server.shutdown) == 1 {
+				return nil
+			}
 			return fmt.Errorf("Error accepting connection: %s", err)
 		}
-		p, err := server.addPeer(&peer{
-			server: server,
-			conn:   conn,
-			reader: framed.NewReader(conn),
-			writer: framed.NewWriter(conn),
-		})
-		if err != nil {
-			// Note - we only enter here if we failed to find a unique UUID
-			// within numAddPeerAttempts tries, which is pretty much impossible.
-			log.Error(err)
-			conn.Close()
+		server.accepted.add(time.Now(), 0)
+		if limiter != nil {
+			if server.RejectExcessConnections {
+				if !limiter.allow(time.Now()) {
+					go server.reject(conn, &RejectedError{RejectRateLimited, "Too many new connections"})
+					continue
+				}
+			} else {
+				time.Sleep(limiter.wait(time.Now()))
+			}
+		}
+		p := &peer{
+			server:      server,
+			conn:        conn,
+			frames:      &frameTimer{r: conn, conn: conn, timeout: server.frameReadTimeout(), timeBegin: server.ProfileRelay},
+			timer:       relayTimer{profile: server.profile},
+			readBuf:     server.newReadBuffer(),
+			connectedAt: time.Now(),
+		}
+		if server.CoalesceWindow > 0 || server.AutoTune {
+			p.buffered = bufio.NewWriter(fullWriter{conn})
+		}
+		p.writer = framed.NewWriter(p.stream())
+		if server.InboxCapacity > 0 {
+			p.inbox = make(chan struct{}, server.InboxCapacity)
+		}
+		p.reader = framed.NewReader(p.frames)
+		p, rejection := server.addPeer(p)
+		if rejection != nil {
+			log.Debug(rejection)
+			go server.reject(conn, rejection)
 			continue
 		}
 		go p.run()
 	}
 }
 
-func listenTLS(addr string, pkfile string, certfile string) (net.Listener, error) {
+// acceptLimiter limits the rate at which the server accepts connections using
+// the generic cell rate algorithm, which is equivalent to a token bucket.
+type acceptLimiter struct {
+	interval  time.Duration // time between connections at the steady rate
+	tolerance time.Duration // how far ahead of the steady rate we allow bursts
+	tat       time.Time     // theoretical arrival time of the next connection
+}
+
+func (server *Server) newAcceptLimiter() *acceptLimiter {
+	if server.AcceptRate <= 0 {
+		return nil
+	}
+	burst := server.AcceptBurst
+	if burst < 1 {
+		burst = 1
+	}
+	interval := time.Duration(float64(time.Second) / server.AcceptRate)
+	return &acceptLimiter{
+		interval:  interval,
+		tolerance: time.Duration(burst-1) * interval,
+	}
+}
+
+// allow checks whether a connection arriving at the given time is within the
+// rate, counting it if so.
+func (l *acceptLimiter) allow(now time.Time) bool {
+	if l.tat.Before(now) {
+		l.tat = now
+	}
+	if l.tat.Sub(now) > l.tolerance {
+		return false
+	}
+	l.tat = l.tat.Add(l.interval)
+	return true
+}
+
+// wait counts a connection arriving at the given time and returns how long it
+// needs to wait in order to stay within the rate.
+func (l *acceptLimiter) wait(now time.Time) time.Duration {
+	if l.tat.Before(now) {
+		l.tat = now
+	}
+	wait := l.tat.Sub(now) - l.tolerance
+	l.tat = l.tat.Add(l.interval)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// ListenTLS creates a listener at the given address whose connections are
+// secured with TLS using the given config, which needs to supply the server's
+// certificate (via Certificates or GetCertificate). This allows operators to
+// control TLS in detail, e.g. to only allow TLS 1.3 by setting MinVersion to
+// tls.VersionTLS13, or to restrict CipherSuites (which only applies to TLS 1.2
+// and earlier, since Go doesn't allow configuring TLS 1.3 cipher suites).
+// Stricter settings lock out older clients, so check what your clients
+// support before tightening them. If MinVersion isn't set, it defaults to TLS
+// 1.2. The given config isn't modified.
+func ListenTLS(addr string, cfg *tls.Config) (net.Listener, error) {
+	if len(cfg.Certificates) == 0 && cfg.GetCertificate == nil && cfg.GetConfigForClient == nil {
+		return nil, fmt.Errorf("Please specify a certificate in the TLS config")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg = cfg.Clone()
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+	return tls.NewListener(&eofListener{l}, cfg), nil
+}
+
+func listenTLS(l net.Listener, pkfile string, certfile string) (net.Listener, error) {
 	cert, err := tls.LoadX509KeyPair(certfile, pkfile)
 	if err != nil {
+		l.Close()
 		return nil, fmt.Errorf("Unable to load cert and pk: %s", err)
 	}
 
 	cfg := tlsdefaults.Server()
 	cfg.MinVersion = tls.VersionTLS12 // force newest available version of TLS
 	cfg.Certificates = []tls.Certificate{cert}
-	return tls.Listen("tcp", addr, cfg)
+	return tls.NewListener(&eofListener{l}, cfg), nil
 }
 
 type peer struct {
-	server *Server
-	id     PeerId
-	conn   net.Conn
-	reader *framed.Reader
-	writer *framed.Writer
+	server        *Server
+	id            PeerId
+	conn          net.Conn
+	reader        *framed.Reader
+	writer        *framed.Writer
+	flusher       *flate.Writer // non-nil if writes are compressed
+	buffered      *bufio.Writer // non-nil if writes are coalesced
+	scheduled     bool          // whether a flush is scheduled, protected by writeMutex
+	frames        *frameTimer
+	readBuf       *readBuffer // nil unless using MinReadBuffer
+	timer         relayTimer  // only used by the peer's own goroutine
+	connectedAt   time.Time
+	lastMessage   time.Time // only used for metrics
+	writeMutex    sync.Mutex
+	inbox         chan struct{} // slots for senders writing to this peer, see InboxCapacity
+	serverName    atomic.Value  // string, set once TLS handshake completes
+	closeReason   int32         // CloseReason with which the server closed the connection
+	priorityClass int32         // see PriorityClass
+	admitted      int32         // 1 once the peer has been told its id, see isAdmitted
+	alias         string        // protected by server.peersMutex
 }
 
-func (server *Server) addPeer(p *peer) (*peer, error) {
-	server.peersMutex.Lock()
-	defer server.peersMutex.Unlock()
-	peerAdded := false
+// isAdmitted indicates whether the peer has been told its id. Until then, the
+// peer is only registered (so that it counts towards MaxConnections and its id
+// stays reserved) but isn't routable or visible to the application.
+func (p *peer) isAdmitted() bool {
+	return atomic.LoadInt32(&p.admitted) == 1
+}
+
+func (server *Server) backpressureTimeout() time.Duration {
+	if server.BackpressureTimeout == 0 {
+		return DefaultBackpressureTimeout
+	}
+	return server.BackpressureTimeout
+}
+
+func (server *Server) handshakeTimeout() time.Duration {
+	if server.HandshakeTimeout == 0 {
+		return DefaultHandshakeTimeout
+	}
+	return server.HandshakeTimeout
+}
+
+func (server *Server) frameReadTimeout() time.Duration {
+	if server.FrameReadTimeout == 0 {
+		return DefaultFrameReadTimeout
+	}
+	return server.FrameReadTimeout
+}
+
+// frameTimer sits between a peer's framed.Reader and its underlying stream and
+// sets a read deadline on the connection as soon as the first bytes of a frame
+// arrive, so that the rest of the frame has to arrive within the timeout.
+type frameTimer struct {
+	r         io.Reader
+	conn      net.Conn
+	timeout   time.Duration
+	started   bool
+	timeBegin bool      // whether to record when frames begin, see ProfileRelay
+	began     time.Time // when the first bytes of the current frame arrived
+}
+
+func (ft *frameTimer) Read(b []byte) (int, error) {
+	n, err := ft.r.Read(b)
+	if n > 0 && ft.timeBegin && ft.began.IsZero() {
+		ft.began = time.Now()
+	}
+	if n > 0 && !ft.started && ft.timeout > 0 {
+		ft.started = true
+		ft.conn.SetReadDeadline(time.Now().Add(ft.timeout))
+	}
+	return n, err
+}
+
+// frameDone clears the read deadline once a whole frame has been read and
+// returns when the frame began (if recording that).
+func (ft *frameTimer) frameDone() time.Time {
+	began := ft.began
+	ft.began = time.Time{}
+	if ft.started {
+		ft.started = false
+		ft.conn.SetReadDeadline(time.Time{})
+	}
+	return began
+}
+
+func (server *Server) addPeer(p *peer) (*peer, *RejectedError) {
 	for i := 0; i < numAddPeerAttempts; i++ {
-		p.id = randomPeerId()
-		_, exists := server.peers[p.id]
-		if exists {
+		// Allocate outside of the lock, since external Allocators may be slow
+		id, err := server.allocateId()
+		if err != nil {
+			return nil, &RejectedError{RejectUnknown, fmt.Sprintf("Unable to generate peer id: %s", err)}
+		}
+		server.peersMutex.Lock()
+		if server.MaxConnections > 0 && len(server.peers) >= server.MaxConnections {
+			n := len(server.peers)
+			server.peersMutex.Unlock()
+			return nil, &RejectedError{RejectServerFull, fmt.Sprintf("Server already has %d connections", n)}
+		}
+		_, exists := server.peers[id]
+		if exists || IsReserved(id) {
 			// We had an ID collision, try assigning a different ID.
+			server.peersMutex.Unlock()
 			continue
 		}
-		server.peers[p.id] = p
-		peerAdded = true
+		p.id = id
+		server.peers[id] = p
+		atomic.AddInt64(&server.registered, 1)
+		server.peersMutex.Unlock()
+		return p, nil
+	}
+	// Note - we only get here if we failed to find a unique UUID within
+	// numAddPeerAttempts tries, which is pretty much impossible.
+	return nil, &RejectedError{RejectUnknown, fmt.Sprintf("Unable to find unique UUID within %d tries", numAddPeerAttempts)}
+}
+
+// reject tells the client on the given conn why it was rejected and then
+// closes the connection.
+func (server *Server) reject(conn net.Conn, err *RejectedError) {
+	defer conn.Close()
+	server.recordEvent(AuditEvent{Type: AuditReject, RemoteAddr: conn.RemoteAddr(), Rejection: err})
+	p := &peer{
+		server: server,
+		conn:   conn,
+		writer: framed.NewWriter(fullWriter{conn}),
 	}
-	if !peerAdded {
-		return nil, fmt.Errorf("Unable to find unique UUID within %d tries", numAddPeerAttempts)
+	err2 := p.sendSystemFrame(rejectFrame, encodeReject(err))
+	if err2 != nil {
+		log.Tracef("Unable to send rejection: %s", err2)
 	}
-	return p, nil
 }
 
 func (server *Server) getPeer(id PeerId) *peer {
 	server.peersMutex.RLock()
 	defer server.peersMutex.RUnlock()
-	return server.peers[id]
+	p := server.peers[id]
+	if p == nil || !p.isAdmitted() {
+		return nil
+	}
+	return p
 }
 
-func (server *Server) removePeer(id PeerId) {
+func (server *Server) removePeer(p *peer) {
 	server.peersMutex.Lock()
 	defer server.peersMutex.Unlock()
-	delete(server.peers, id)
+	if server.peers[p.id] == p {
+		server.deletePeer(p)
+	}
+	if p.alias != "" && server.aliases[p.alias] == p {
+		delete(server.aliases, p.alias)
+	}
+}
+
+// deletePeer unregisters the given peer. Must be called with peersMutex held.
+func (server *Server) deletePeer(p *peer) {
+	delete(server.peers, p.id)
+	atomic.AddInt64(&server.registered, -1)
+	if p.isAdmitted() {
+		atomic.AddInt64(&server.connected, -1)
+	}
+}
+
+// onConnect calls the OnConnect hook for the given peer, giving up after
+// OnConnectTimeout.
+func (server *Server) onConnect(p *peer) error {
+	timeout := server.OnConnectTimeout
+	if timeout == 0 {
+		timeout = DefaultOnConnectTimeout
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.OnConnect(p.id, p.conn.RemoteAddr())
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("OnConnect timed out after %s", timeout)
+	}
+}
+
+// Shutdown stops the server from accepting new connections (causing Serve to
+// return) and disconnects all connected peers, telling them that the server is
+// shutting down (see CloseShutdown).
+func (server *Server) Shutdown() error {
+	atomic.StoreInt32(&server.shutdown, 1)
+	var err error
+	server.listenerMutex.Lock()
+	if server.listener != nil {
+		err = server.listener.Close()
+	}
+	server.listenerMutex.Unlock()
+
+	for _, p := range server.allPeers() {
+		p.close(CloseShutdown, "Server shutting down")
+	}
+	return err
+}
+
+// allPeers returns a snapshot of all registered peers, including ones that
+// haven't been admitted yet.
+func (server *Server) allPeers() []*peer {
+	server.peersMutex.RLock()
+	defer server.peersMutex.RUnlock()
+	peers := make([]*peer, 0, len(server.peers))
+	for _, p := range server.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// connectedPeers returns a snapshot of the currently connected (admitted)
+// peers.
+func (server *Server) connectedPeers() []*peer {
+	server.peersMutex.RLock()
+	defer server.peersMutex.RUnlock()
+	peers := make([]*peer, 0, len(server.peers))
+	for _, p := range server.peers {
+		if p.isAdmitted() {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// PeerInfo describes a peer that's connected to a Server.
+type PeerInfo struct {
+	Id          PeerId
+	RemoteAddr  net.Addr
+	ConnectedAt time.Time
+
+	// ServerName: the server name (SNI) that the peer asked for during the
+	// TLS handshake, or empty if it connected without TLS or without SNI.
+	// Server names are lowercased.
+	ServerName string
+
+	// PriorityClass: the peer's priority class, see Server.PriorityClass
+	PriorityClass int
+}
+
+// Peers lists the currently connected peers.
+func (server *Server) Peers() []*PeerInfo {
+	peers := server.connectedPeers()
+	infos := make([]*PeerInfo, 0, len(peers))
+	for _, p := range peers {
+		infos = append(infos, p.info())
+	}
+	return infos
+}
+
+// logId returns the given id as it should appear in logs, see LogId. The label
+// is only computed if the log line is actually written.
+func (server *Server) logId(id PeerId) fmt.Stringer {
+	if server.LogId == nil {
+		return id
+	}
+	return idLabel{id, server.LogId}
+}
+
+// Peer looks up the connected peer identified by the given id, returning nil
+// if no such peer is connected.
+func (server *Server) Peer(id PeerId) *PeerInfo {
+	p := server.getPeer(id)
+	if p == nil {
+		return nil
+	}
+	return p.info()
+}
+
+func (p *peer) info() *PeerInfo {
+	return &PeerInfo{
+		Id:            p.id,
+		RemoteAddr:    p.conn.RemoteAddr(),
+		ConnectedAt:   p.connectedAt,
+		ServerName:    p.getServerName(),
+		PriorityClass: int(atomic.LoadInt32(&p.priorityClass)),
+	}
+}
+
+// getServerName returns the server name recorded by recordServerName.
+func (p *peer) getServerName() string {
+	serverName, _ := p.serverName.Load().(string)
+	return serverName
+}
+
+// recordServerName completes the TLS handshake (if the connection uses TLS)
+// within the HandshakeTimeout and records the server name that the peer asked
+// for.
+func (p *peer) recordServerName() error {
+	var serverName string
+	switch conn := p.conn.(type) {
+	case *tls.Conn:
+		if timeout := p.server.handshakeTimeout(); timeout > 0 {
+			conn.SetDeadline(time.Now().Add(timeout))
+		}
+		err := conn.Handshake()
+		if err != nil {
+			return err
+		}
+		conn.SetDeadline(time.Time{})
+		serverName = conn.ConnectionState().ServerName
+	case *httpServerConn:
+		serverName = conn.serverName
+	}
+	p.serverName.Store(strings.ToLower(serverName))
+	return nil
+}
+
+// Disconnect kicks the peer identified by the given id, telling it that it was
+// kicked (see CloseKicked). It returns an error if no such peer is connected.
+// The peer is free to reconnect, in which case it's assigned a new id.
+func (server *Server) Disconnect(id PeerId) error {
+	server.peersMutex.Lock()
+	p := server.peers[id]
+	if p != nil && p.isAdmitted() {
+		server.deletePeer(p)
+	} else {
+		p = nil
+	}
+	server.peersMutex.Unlock()
+	if p == nil {
+		return fmt.Errorf("Peer %s is not connected", id)
+	}
+	log.Debugf("Disconnecting %s", server.logId(id))
+	p.close(CloseKicked, "Disconnected by server")
+	return nil
+}
+
+// Migrate asks all currently connected peers to reconnect to the waddell server
+// at addr, which allows draining this server for maintenance without
+// abruptly disconnecting everyone. The reason is passed along to clients for
+// informational purposes. Clients that don't follow redirects simply remain
+// connected to this server. From then on, HealthHandler reports this server as
+// draining.
+func (server *Server) Migrate(addr string, reason string) {
+	atomic.StoreInt32(&server.draining, 1)
+	body := encodeRedirect(addr, reason)
+	peers := server.connectedPeers()
+	var wg sync.WaitGroup
+	wg.Add(len(peers))
+	for _, p := range peers {
+		go func(p *peer) {
+			defer wg.Done()
+			err := p.sendSystemFrame(redirectFrame, body)
+			if err != nil {
+				log.Tracef("Unable to redirect %s: %s", p.server.logId(p.id), err)
+				p.disconnect()
+			}
+		}(p)
+	}
+	wg.Wait()
 }
 
 func (p *peer) run() {
 	defer p.conn.Close()
-	defer p.server.removePeer(p.id)
+	defer p.server.removePeer(p)
+	if p.readBuf != nil {
+		defer p.readBuf.stop()
+	}
 
-	// Tell the peer its id (and set topic to UnknownTopic)
-	_, err := p.writer.WritePieces(p.id.toBytes(), UnknownTopic.toBytes())
+	// Make sure TLS is established before admitting the peer
+	err := p.recordServerName()
+	if err != nil {
+		log.Debugf("TLS handshake failed: %s", err)
+		return
+	}
+
+	if p.server.OnConnect != nil {
+		err := p.server.onConnect(p)
+		if err != nil {
+			log.Debugf("Rejecting connection from %s: %s", p.conn.RemoteAddr(), err)
+			rejection := &RejectedError{RejectDenied, err.Error()}
+			p.server.recordEvent(AuditEvent{Type: AuditReject, Id: p.id, RemoteAddr: p.conn.RemoteAddr(), ServerName: p.getServerName(), Rejection: rejection})
+			err = p.sendSystemFrame(rejectFrame, encodeReject(rejection))
+			if err != nil {
+				log.Tracef("Unable to send rejection: %s", err)
+			}
+			return
+		}
+	}
+	if p.server.PriorityClass != nil {
+		atomic.StoreInt32(&p.priorityClass, int32(p.server.PriorityClass(p.info())))
+	}
+
+	// Tell the peer its id (and set topic to our protocol version, flagging
+	// whether a welcome follows)
+	welcome := p.welcome()
+	version := TopicId(ProtocolVersion)
+	if welcome != nil {
+		version |= welcomeFlag
+	}
+	err = p.write(p.id.toBytes(), version.toBytes())
 	if err != nil {
 		log.Debugf("Unable to send peerid on connect: %s", err)
 		return
 	}
+	if welcome != nil {
+		err = p.sendSystemFrame(welcomeFrame, welcome)
+		if err != nil {
+			log.Debugf("Unable to send welcome on connect: %s", err)
+			return
+		}
+	}
+	// Only now that the peer knows its id can others reach it
+	atomic.StoreInt32(&p.admitted, 1)
+	atomic.AddInt64(&p.server.connected, 1)
+	p.server.recordEvent(AuditEvent{Type: AuditConnect, Id: p.id, RemoteAddr: p.conn.RemoteAddr(), ServerName: p.getServerName()})
+	defer func() {
+		reason := CloseReason(atomic.LoadInt32(&p.closeReason))
+		p.server.recordEvent(AuditEvent{Type: AuditDisconnect, Id: p.id, RemoteAddr: p.conn.RemoteAddr(), ServerName: p.getServerName(), Reason: reason})
+	}()
+
+	if p.server.MaxConnectionLifetime > 0 {
+		lifetime := p.server.MaxConnectionLifetime
+		lifetime -= time.Duration(rand.Int63n(int64(lifetime/10) + 1))
+		expire := time.AfterFunc(lifetime, func() {
+			log.Debugf("Closing connection to %s after %v", p.server.logId(p.id), lifetime)
+			p.close(CloseExpired, "Connection lifetime exceeded")
+		})
+		defer expire.Stop()
+	}
 
 	// Read messages until there are no more to read
 	for {
@@ -151,40 +981,398 @@ func (p *peer) run() {
 	}
 }
 
+// welcome returns the welcome payload for this peer.
+func (p *peer) welcome() []byte {
+	if p.server.Welcome == nil {
+		return nil
+	}
+	welcome := p.server.Welcome(p.id)
+	if len(welcome) > MaxDataLength {
+		log.Errorf("Welcome of %d bytes exceeds maximum of %d, not sending", len(welcome), MaxDataLength)
+		return nil
+	}
+	return welcome
+}
+
 func (p *peer) readNext() (ok bool) {
-	b := p.server.buffers.Get()
-	defer p.server.buffers.Put(b)
-	n, err := p.reader.Read(b)
+	var b []byte
+	var err error
+	if p.readBuf != nil {
+		b, err = p.readBuf.read(p.frames)
+	} else {
+		buf := p.server.buffers.Get()
+		defer p.server.buffers.Put(buf)
+		var n int
+		n, err = p.reader.Read(buf)
+		b = buf[:n]
+	}
 	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			log.Debugf("Disconnecting %s, which didn't finish sending a frame within %v", p.server.logId(p.id), p.frames.timeout)
+		} else if err == io.EOF && truncated(p.conn) {
+			log.Debugf("Connection from %s ended without TLS close_notify, it may have been truncated", p.server.logId(p.id))
+		}
 		return false
 	}
-	msg := b[:n]
+	p.timer.start(p.frames.frameDone())
+	p.timer.lap(stageRead)
+	msg := b
 	if len(msg) == 1 && msg[0] == keepAlive[0] {
 		// Got a keepalive message, ignore it
+		p.server.Metrics.countKeepAlive()
+		return true
+	}
+	if len(msg) == 1 && msg[0] == compressRequest[0] {
+		return p.startCompression()
+	}
+	if len(msg) == 9 && msg[0] == ping[0] {
+		// Got a heartbeat, answer it with the same sequence number
+		p.server.Metrics.countKeepAlive()
+		return p.sendSystemFrame(pongFrame, msg[1:]) == nil
+	}
+	if len(msg) > 1 && len(msg) <= 1+MaxAliasLength && msg[0] == aliasRequest[0] {
+		return p.registerAlias(string(msg[1:]))
+	}
+	if len(msg) < WaddellHeaderLength {
+		p.server.Metrics.countInvalid()
+		log.Errorf("Frame of %d bytes is too short for a waddell header", len(msg))
 		return true
 	}
 	to, err := readPeerId(msg)
 	if err != nil {
 		// Problem determining recipient
+		p.server.Metrics.countInvalid()
 		log.Errorf("Unable to determine recipient: %s", err.Error())
 		return true
 	}
+	if to == KeepAliveId {
+		p.server.Metrics.countKeepAlive()
+		return true
+	}
+	if to == aliasId {
+		var ok bool
+		to, msg, ok = p.resolveAlias(msg)
+		if !ok {
+			p.server.Metrics.countDropped()
+			p.dropped(aliasId, b, DropRecipientNotConnected)
+			return true
+		}
+	}
+	p.timer.lap(stageParse)
+	if p.server.Metrics != nil {
+		now := time.Now()
+		var interval time.Duration
+		if !p.lastMessage.IsZero() {
+			interval = now.Sub(p.lastMessage)
+		}
+		p.lastMessage = now
+		p.server.Metrics.countMessage(len(msg)-WaddellHeaderLength, interval)
+	}
+	if to == EchoId {
+		p.echo(msg)
+		return true
+	}
+	var done func(error)
+	if p.server.TraceRelay != nil {
+		topic, _ := readTopicId(msg[PeerIdLength:])
+		done = p.server.TraceRelay(p.id, to, topic, len(msg)-WaddellHeaderLength)
+	}
+	if p.server.relaySlots != nil {
+		p.server.relaySlots.acquire(int(atomic.LoadInt32(&p.priorityClass)))
+		p.timer.lap(stageEnqueue)
+		err = p.relay(to, msg)
+		p.server.relaySlots.release()
+	} else {
+		err = p.relay(to, msg)
+	}
+	if done != nil {
+		done(err)
+	}
+	if err == nil {
+		p.timer.finish()
+	}
+	return true
+}
+
+// relay relays msg to the peer identified by to, returning an error if the
+// message couldn't be relayed.
+func (p *peer) relay(to PeerId, msg []byte) error {
+	sampled := p.server.sample()
+	if p.server.Authorize != nil && !p.server.Authorize(p.id, to) {
+		// Check this first so that unauthorized senders can't find out
+		// whether the recipient is connected
+		if sampled {
+			log.Debugf("Not relaying %d bytes from %s to %s: not authorized", len(msg), p.server.logId(p.id), p.server.logId(to))
+		}
+		p.dropped(to, msg, DropUnauthorized)
+		return errUnauthorized
+	}
 	cto := p.server.getPeer(to)
+	if cto != nil && p.server.IsolateByServerName && cto.getServerName() != p.getServerName() {
+		// Peers of other tenants look like they're not connected
+		cto = nil
+	}
 	if cto == nil {
 		// Recipient not found
-		return true
+		if sampled {
+			log.Debugf("Not relaying %d bytes from %s to %s: recipient not connected", len(msg), p.server.logId(p.id), p.server.logId(to))
+		}
+		p.dropped(to, msg, DropRecipientNotConnected)
+		return errRecipientNotConnected
 	}
-	// Set sender's id as the id in the message
-	err = p.id.write(msg)
+	p.timer.lap(stageLookup)
+	// Set sender's id as the id in the message. Note - this overwrites the
+	// recipient's id, so clients have no way of specifying the From of the
+	// delivered message. From always reflects the id that the server assigned
+	// to the sending connection.
+	err := p.id.write(msg)
 	if err != nil {
-		return true
+		return err
 	}
-	_, err = cto.writer.Write(msg)
+	if cto.inbox != nil {
+		if !p.server.enqueue(cto) {
+			p.server.Metrics.countDropped()
+			if sampled {
+				log.Debugf("Not relaying %d bytes from %s to %s: recipient's inbox full", len(msg), p.server.logId(p.id), p.server.logId(to))
+			}
+			p.dropped(to, msg, DropInboxFull)
+			return errInboxFull
+		}
+		defer cto.dequeue()
+	}
+	if !p.server.reserve(len(msg)) {
+		p.server.Metrics.countDropped()
+		if sampled {
+			log.Debugf("Not relaying %d bytes from %s to %s: server buffers full", len(msg), p.server.logId(p.id), p.server.logId(to))
+		}
+		p.dropped(to, msg, DropBuffersFull)
+		return errBuffersFull
+	}
+	p.timer.lap(stageEnqueue)
+	// Note - relaying synchronously, before reading the next frame from this
+	// peer, is what guarantees that messages from one peer to another arrive
+	// in the order in which they were sent.
+	//
+	// If the write fails, part of the frame may already have been written, so
+	// the recipient is disconnected rather than sending it any more frames
+	// that it would misread.
+	err = cto.write(msg)
+	p.timer.lap(stageWrite)
+	p.server.release(len(msg))
 	if err != nil {
-		log.Tracef("%s unable to write to recipient %s: %s", p.id, to, err)
+		log.Tracef("%s unable to write to recipient %s: %s", p.server.logId(p.id), p.server.logId(to), err)
 		cto.disconnect()
+		p.dropped(to, msg, DropWriteFailed)
+		return err
+	}
+	p.server.countRelayed(len(msg) - WaddellHeaderLength)
+	if sampled {
+		log.Debugf("Relayed %d bytes from %s to %s", len(msg), p.server.logId(p.id), p.server.logId(to))
+	}
+	return nil
+}
+
+// dropped reports that msg from this peer to the given recipient was dropped,
+// both to OnDrop and, if msg requested a receipt, to this peer.
+func (p *peer) dropped(to PeerId, msg []byte, reason DropReason) {
+	atomic.AddInt64(&p.server.dropped, 1)
+	if p.server.OnDrop != nil {
+		go p.server.OnDrop(p.id, to, reason)
+	}
+	topic, err := readTopicId(msg[PeerIdLength:])
+	if err != nil || topic != receiptRequestTopic || len(msg) < WaddellHeaderLength+TopicIdLength+receiptIdLength {
+		return
+	}
+	receiptId := endianness.Uint64(msg[WaddellHeaderLength+TopicIdLength:])
+	err = p.sendSystemFrame(droppedFrame, encodeDropped(to, receiptId, reason))
+	if err != nil {
+		log.Tracef("Unable to tell %s that its message was dropped: %s", p.server.logId(p.id), err)
+	}
+}
+
+// enqueue takes a slot in the given recipient's inbox, waiting for one to become
+// available if applying Backpressure. It returns false if no slot was available.
+func (server *Server) enqueue(to *peer) bool {
+	select {
+	case to.inbox <- struct{}{}:
 		return true
+	default:
+		if !server.Backpressure {
+			return false
+		}
+	}
+	timer := time.NewTimer(server.backpressureTimeout())
+	defer timer.Stop()
+	select {
+	case to.inbox <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (p *peer) dequeue() {
+	<-p.inbox
+}
+
+// BufferedBytes returns the total size of the messages that the server is
+// currently holding in memory while relaying them.
+func (server *Server) BufferedBytes() int64 {
+	return atomic.LoadInt64(&server.buffered)
+}
+
+// reserve accounts for n bytes being buffered, returning false if that would
+// exceed MaxBufferedBytes.
+func (server *Server) reserve(n int) bool {
+	buffered := atomic.AddInt64(&server.buffered, int64(n))
+	if server.MaxBufferedBytes > 0 && buffered > server.MaxBufferedBytes {
+		atomic.AddInt64(&server.buffered, -int64(n))
+		return false
+	}
+	return true
+}
+
+func (server *Server) release(n int) {
+	atomic.AddInt64(&server.buffered, -int64(n))
+}
+
+// sample determines whether or not to log the current message, based on
+// TraceSampleRate.
+func (server *Server) sample() bool {
+	return server.TraceSampleRate > 0 && rand.Float64() < server.TraceSampleRate
+}
+
+// echo sends the given message back to this peer, with From set to EchoId
+// (which is already in place since the message was addressed to EchoId).
+func (p *peer) echo(msg []byte) {
+	if !p.server.Echo {
+		return
+	}
+	err := p.write(msg)
+	if err != nil {
+		log.Tracef("Unable to echo to %s: %s", p.server.logId(p.id), err)
+		p.disconnect()
+	}
+}
+
+// write writes a frame consisting of the given pieces to this peer.
+func (p *peer) write(pieces ...[]byte) error {
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+	_, err := p.writer.WritePieces(pieces...)
+	if err != nil {
+		return err
+	}
+	return p.flush()
+}
+
+// writeNow is like write, but flushes right away even if writes are coalesced.
+func (p *peer) writeNow(pieces ...[]byte) error {
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+	_, err := p.writer.WritePieces(pieces...)
+	if err != nil {
+		return err
+	}
+	return p.flushNow()
+}
+
+// stream returns the writer underlying p.writer.
+func (p *peer) stream() io.Writer {
+	if p.buffered != nil {
+		return p.buffered
+	}
+	return fullWriter{p.conn}
+}
+
+// flush flushes what's been written so far, or, if writes are coalesced,
+// schedules a flush within the CoalesceWindow. Callers need to hold
+// writeMutex.
+func (p *peer) flush() error {
+	window := p.server.coalesceWindow()
+	if p.buffered == nil || window <= 0 {
+		return p.flushNow()
+	}
+	if !p.scheduled {
+		p.scheduled = true
+		time.AfterFunc(window, func() {
+			p.writeMutex.Lock()
+			defer p.writeMutex.Unlock()
+			p.scheduled = false
+			err := p.flushNow()
+			if err != nil {
+				// Part of a frame may already have been written, see relay
+				log.Tracef("Unable to flush to %s: %s", p.server.logId(p.id), err)
+				p.disconnect()
+			}
+		})
+	}
+	return nil
+}
+
+// flushNow flushes what's been written so far. Callers need to hold
+// writeMutex.
+func (p *peer) flushNow() error {
+	if p.flusher != nil {
+		err := p.flusher.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	if p.buffered != nil {
+		return p.buffered.Flush()
+	}
+	return nil
+}
+
+// fullWriter is an io.Writer that makes sure that the whole buffer is written
+// to the wrapped writer. A frame that's only partially written would desync
+// the recipient's framing, so this guards against writers that accept only
+// part of a write (e.g. because of backpressure) without reporting an error.
+type fullWriter struct {
+	io.Writer
+}
+
+func (w fullWriter) Write(b []byte) (int, error) {
+	total := 0
+	for total < len(b) {
+		n, err := w.Writer.Write(b[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			return total, io.ErrShortWrite
+		}
+	}
+	return total, nil
+}
+
+// startCompression answers a client's request to compress the connection and,
+// if allowed, compresses everything read and written from here on.
+func (p *peer) startCompression() bool {
+	if !p.server.AllowCompression {
+		err := p.sendSystemFrame(compressionFrame)
+		return err == nil
+	}
+
+	// The client compresses everything it sends after its request. Frames are
+	// timed after decompression, since flate reads ahead from the connection.
+	p.frames.r = flate.NewReader(p.conn)
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+	_, err := p.writer.WritePieces(serverId.toBytes(), compressionFrame.toBytes(), []byte(compressionFlate))
+	if err != nil {
+		log.Tracef("Unable to acknowledge compression: %s", err)
+		return false
+	}
+	p.server.Metrics.countSystem()
+	err = p.flushNow()
+	if err != nil {
+		log.Tracef("Unable to acknowledge compression: %s", err)
+		return false
 	}
+	p.writer, p.flusher = compressedWriter(p.stream())
 	return true
 }
 
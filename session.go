@@ -0,0 +1,101 @@
+package waddell
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Session is a conversation between the local Client and a single remote peer
+// on a single topic, which is the common case for signaling between two peers.
+// A Session only delivers messages from its remote peer; messages that other
+// peers send on the same topic are discarded.
+//
+// Because a Client has only one inbound channel per topic, there should be at
+// most one Session per topic on any given Client. Sessions on SendOnly and
+// ReceiveOnly clients only support sending or receiving, respectively.
+type Session struct {
+	client      *Client
+	topic       TopicId
+	in          <-chan *MessageIn
+	remote      PeerId
+	remoteMutex sync.RWMutex
+}
+
+// NewSession starts a Session with the peer identified by remote on the given
+// topic.
+//
+// Typically, one side (the offerer) learns the other side's id out-of-band
+// while the other side (the answerer) doesn't know the offerer's id until it
+// hears from it. To support the answerer, remote may be left as the zero
+// PeerId, in which case the Session binds to whichever peer sends it the first
+// message.
+func NewSession(client *Client, remote PeerId, topic TopicId) *Session {
+	s := &Session{
+		client: client,
+		topic:  topic,
+		remote: remote,
+	}
+	if client.Mode != SendOnly {
+		s.in = client.In(topic)
+	}
+	return s
+}
+
+// Remote returns the id of the remote peer, which is the zero PeerId if the
+// Session hasn't yet heard from its remote peer.
+func (s *Session) Remote() PeerId {
+	s.remoteMutex.RLock()
+	defer s.remoteMutex.RUnlock()
+	return s.remote
+}
+
+// Send sends the given body to the remote peer. It returns an error once the
+// underlying Client has been closed.
+func (s *Session) Send(body ...[]byte) error {
+	if s.client.Mode == ReceiveOnly {
+		return fmt.Errorf("Unable to send on receive only client")
+	}
+	remote := s.Remote()
+	if remote == serverId {
+		return fmt.Errorf("Remote peer not yet known")
+	}
+	return s.client.send(s.topic, remote, body)
+}
+
+// Receive blocks until the next message from the remote peer arrives and
+// returns its body. It returns an error once the underlying Client has been
+// closed.
+//
+// The returned body belongs to the caller and stays valid indefinitely. If the
+// Client pools messages or reuses buffers (see ClientConfig.PoolMessages and
+// ClientConfig.ReuseBuffers), Receive copies the body and releases the message
+// itself, so callers never need to call Release.
+func (s *Session) Receive() ([]byte, error) {
+	if s.in == nil {
+		return nil, fmt.Errorf("Unable to receive on send only client")
+	}
+	for msg := range s.in {
+		if s.accept(msg.From) {
+			body := msg.Body
+			if s.client.PoolMessages || s.client.ReuseBuffers {
+				body = append([]byte(nil), msg.Body...)
+				msg.Release()
+			}
+			return body, nil
+		}
+		log.Tracef("Session on topic %d ignoring message from %s", s.topic, s.client.logId(msg.From))
+		msg.Release()
+	}
+	return nil, closedError
+}
+
+// accept checks whether a message from the given peer belongs to this Session,
+// binding the Session to that peer if its remote isn't known yet.
+func (s *Session) accept(from PeerId) bool {
+	s.remoteMutex.Lock()
+	defer s.remoteMutex.Unlock()
+	if s.remote == serverId {
+		s.remote = from
+	}
+	return s.remote == from
+}
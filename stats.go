@@ -0,0 +1,125 @@
+package waddell
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of a Server's vital statistics, see Server.Stats.
+type Stats struct {
+	// Connections: number of currently connected peers
+	Connections int
+
+	// Handshaking: number of peers that are still connecting, i.e. that
+	// haven't been told their id yet (e.g. because they're in the middle of
+	// the TLS handshake or OnConnect). Like connected peers, they count
+	// towards MaxConnections.
+	Handshaking int
+
+	// MessagesRelayed: number of messages successfully relayed to their
+	// recipients
+	MessagesRelayed int64
+
+	// BytesRelayed: total size of the bodies of the messages counted by
+	// MessagesRelayed
+	BytesRelayed int64
+
+	// Dropped: number of messages that weren't relayed, for any of the reasons
+	// listed under DropReason
+	Dropped int64
+
+	// BufferedBytes: see Server.BufferedBytes
+	BufferedBytes int64
+
+	// Uptime: time since the server started serving
+	Uptime time.Duration
+
+	// AcceptRate: new connections accepted per second, averaged over the
+	// previous 5 whole seconds (like Client.Rates)
+	AcceptRate float64
+
+	// Utilization: how close the server is to its configured limits
+	Utilization Utilization
+}
+
+// Utilization expresses how much of each of a Server's configured limits is in
+// use, as percentages. A percentage is 0 if the corresponding limit isn't set.
+// Values above 100 are possible, e.g. when connections arrive faster than
+// AcceptRate and have to wait their turn.
+type Utilization struct {
+	// Connections: Stats.Connections plus Stats.Handshaking as a percentage of
+	// MaxConnections
+	Connections float64
+
+	// BufferedBytes: Stats.BufferedBytes as a percentage of MaxBufferedBytes
+	BufferedBytes float64
+
+	// AcceptRate: Stats.AcceptRate as a percentage of Server.AcceptRate
+	AcceptRate float64
+}
+
+// Max returns the highest of the percentages, which is a convenient single
+// signal of how close the server is to being at capacity (e.g. for
+// autoscaling).
+func (u Utilization) Max() float64 {
+	max := u.Connections
+	if u.BufferedBytes > max {
+		max = u.BufferedBytes
+	}
+	if u.AcceptRate > max {
+		max = u.AcceptRate
+	}
+	return max
+}
+
+// Stats returns a snapshot of the server's vital statistics. Unlike Metrics,
+// these are always collected. Taking a snapshot only involves a handful of
+// atomic loads, so it's cheap enough to poll frequently (e.g. to log stats
+// every second). Note that the individual values are read one at a time, so
+// they may be very slightly out of sync with each other. See RelayProfile for
+// the (more expensive) relay profile.
+func (server *Server) Stats() Stats {
+	stats := Stats{
+		MessagesRelayed: atomic.LoadInt64(&server.relayed),
+		BytesRelayed:    atomic.LoadInt64(&server.relayedBytes),
+		Dropped:         atomic.LoadInt64(&server.dropped),
+		BufferedBytes:   server.BufferedBytes(),
+	}
+	stats.Connections = int(atomic.LoadInt64(&server.connected))
+	stats.Handshaking = int(atomic.LoadInt64(&server.registered)) - stats.Connections
+	if stats.Handshaking < 0 {
+		// Read while a peer was being admitted or removed
+		stats.Handshaking = 0
+	}
+	if started := atomic.LoadInt64(&server.started); started > 0 {
+		stats.Uptime = time.Since(time.Unix(0, started))
+	}
+	stats.AcceptRate, _ = server.accepted.rates(time.Now())
+	stats.Utilization = server.utilization(stats)
+	return stats
+}
+
+// utilization computes the Utilization of the server's limits given its stats.
+func (server *Server) utilization(stats Stats) Utilization {
+	var u Utilization
+	if server.MaxConnections > 0 {
+		// Same count that MaxConnections is enforced on
+		u.Connections = percent(float64(stats.Connections+stats.Handshaking), float64(server.MaxConnections))
+	}
+	if server.MaxBufferedBytes > 0 {
+		u.BufferedBytes = percent(float64(stats.BufferedBytes), float64(server.MaxBufferedBytes))
+	}
+	if server.AcceptRate > 0 {
+		u.AcceptRate = percent(stats.AcceptRate, server.AcceptRate)
+	}
+	return u
+}
+
+func percent(value float64, limit float64) float64 {
+	return 100 * value / limit
+}
+
+func (server *Server) countRelayed(size int) {
+	atomic.AddInt64(&server.relayed, 1)
+	atomic.AddInt64(&server.relayedBytes, int64(size))
+}
@@ -0,0 +1,368 @@
+package waddell
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+)
+
+const (
+	// redirectFrame is a system frame asking the client to reconnect to a
+	// different waddell server. Its body contains the 16-bit length of the
+	// address, the address and a human-readable reason.
+	redirectFrame = TopicId(1)
+
+	// rejectFrame is a system frame sent in place of the peer id when the
+	// server rejects a connection. Its body contains the 16-bit RejectReason
+	// followed by a human-readable message.
+	rejectFrame = TopicId(2)
+
+	// compressionFrame is a system frame answering a client's request to
+	// compress the connection. Its body contains the name of the compression
+	// algorithm, or is empty if the server declined to compress.
+	compressionFrame = TopicId(3)
+
+	// closeFrame is a system frame telling the client why the server is about
+	// to close the connection. Its body contains the 16-bit CloseReason
+	// followed by a human-readable message.
+	closeFrame = TopicId(4)
+
+	// pongFrame is a system frame answering a client's heartbeat ping. Its body
+	// is the 64-bit sequence number from the ping.
+	pongFrame = TopicId(5)
+
+	// welcomeFrame is a system frame that servers speaking protocol version 3
+	// or later send right after the id frame. Its body is the (possibly empty)
+	// welcome payload, see Server.Welcome. Servers speaking protocol version 5
+	// or later only send it if they set welcomeFlag in the id frame.
+	welcomeFrame = TopicId(6)
+
+	// welcomeFlag is set on top of the protocol version in the topic of the id
+	// frame if a welcome frame follows it.
+	welcomeFlag = TopicId(0x8000)
+
+	// droppedFrame is a system frame telling the sender of a message that
+	// requested a receipt that the server dropped the message. Its body
+	// contains the recipient's id, the 64-bit receipt id and the 16-bit
+	// DropReason.
+	droppedFrame = TopicId(7)
+
+	// aliasFrame is a system frame answering a client's request to register
+	// an alias. Its body is a single byte indicating whether the alias was
+	// registered, already taken or invalid.
+	aliasFrame = TopicId(8)
+)
+
+// RejectReason is a machine-readable code identifying why the waddell server
+// rejected a connection.
+type RejectReason uint16
+
+const (
+	// RejectUnknown: the server didn't specify a reason
+	RejectUnknown = RejectReason(0)
+
+	// RejectServerFull: the server has reached its maximum number of
+	// connections
+	RejectServerFull = RejectReason(1)
+
+	// RejectRateLimited: the server is accepting connections too quickly
+	RejectRateLimited = RejectReason(2)
+
+	// RejectUnauthorized: the client failed to authenticate
+	RejectUnauthorized = RejectReason(3)
+
+	// RejectDenied: the server refuses to accept this client
+	RejectDenied = RejectReason(4)
+)
+
+func (reason RejectReason) String() string {
+	switch reason {
+	case RejectServerFull:
+		return "server full"
+	case RejectRateLimited:
+		return "rate limited"
+	case RejectUnauthorized:
+		return "unauthorized"
+	case RejectDenied:
+		return "denied"
+	default:
+		return "unknown"
+	}
+}
+
+// RejectedError is the error returned when connecting to a waddell server that
+// rejects the connection.
+type RejectedError struct {
+	Reason  RejectReason
+	Message string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("Connection rejected (%s): %s", e.Reason, e.Message)
+}
+
+// Temporary indicates whether the rejection is likely to go away such that it
+// makes sense to try connecting again later.
+func (e *RejectedError) Temporary() bool {
+	return e.Reason == RejectServerFull || e.Reason == RejectRateLimited
+}
+
+var (
+	// serverId is the reserved PeerId used as the sender of system frames,
+	// i.e. frames that originate from the waddell server itself rather than
+	// from another peer. Since the server always stamps relayed messages with
+	// the sender's assigned id, peers can't forge system frames.
+	serverId = PeerId{}
+
+	// EchoId is the reserved PeerId of the waddell server's echo service.
+	// Messages sent to EchoId are echoed back to the sender, with From set to
+	// EchoId, if the server has Echo enabled. See Client.Echo.
+	EchoId = reservedId(0xff)
+
+	// KeepAliveId is the reserved PeerId to which keepalives can be addressed
+	// (see ClientConfig.KeepAliveTarget). The server treats messages sent to
+	// it like keepalive frames.
+	KeepAliveId = reservedId(0x6b)
+)
+
+// IsReserved indicates whether the given id is reserved for use by the waddell
+// server itself (like the sender of system frames or EchoId), in which case it
+// is never assigned to a peer. Reserved ids are those whose bytes all have the
+// same value.
+func IsReserved(id PeerId) bool {
+	b := id.toBytes()
+	for _, c := range b[1:] {
+		if c != b[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// reservedId constructs a reserved PeerId whose bytes are all set to b. All
+// reserved ids need to be constructed with reservedId, see IsReserved.
+func reservedId(b byte) PeerId {
+	id, err := readPeerId(bytes.Repeat([]byte{b}, PeerIdLength))
+	if err != nil {
+		panic(fmt.Sprintf("Unable to construct reserved id: %s", err))
+	}
+	return id
+}
+
+// sendSystemFrame sends a system frame of the given type to this peer.
+func (p *peer) sendSystemFrame(frameType TopicId, body ...[]byte) error {
+	pieces := make([][]byte, 0, 2+len(body))
+	pieces = append(pieces, serverId.toBytes(), frameType.toBytes())
+	pieces = append(pieces, body...)
+	err := p.writeNow(pieces...)
+	if err == nil {
+		p.server.Metrics.countSystem()
+	}
+	return err
+}
+
+// processSystemFrame handles a system frame received from the server.
+func (c *Client) processSystemFrame(info *connInfo, msg *MessageIn) {
+	switch msg.topic {
+	case redirectFrame:
+		addr, reason, err := decodeRedirect(msg.Body)
+		if err != nil {
+			log.Errorf("Unable to decode redirect: %s", err)
+			return
+		}
+		c.redirect(info, addr, reason)
+	case closeFrame:
+		// The server is about to close the connection, so disconnect now in
+		// order to report the reason.
+		c.connError(info, decodeClose(msg.Body))
+	case droppedFrame:
+		c.processDropped(msg.Body)
+	case pongFrame:
+		if len(msg.Body) != 8 {
+			log.Errorf("Invalid pong of length %d", len(msg.Body))
+			return
+		}
+		select {
+		case c.pongCh <- endianness.Uint64(msg.Body):
+			// okay
+		default:
+			log.Trace("Nobody waiting for pong, discarding")
+		}
+	default:
+		log.Tracef("Ignoring unknown system frame %d", msg.topic)
+	}
+}
+
+// CloseReason identifies why a connection to the waddell server was closed.
+type CloseReason uint16
+
+const (
+	// CloseNetwork: the connection was lost without the server giving a
+	// reason, e.g. due to a network error
+	CloseNetwork = CloseReason(0)
+
+	// CloseShutdown: the server is shutting down
+	CloseShutdown = CloseReason(1)
+
+	// CloseIdle: the connection was idle for too long
+	CloseIdle = CloseReason(2)
+
+	// CloseKicked: the server kicked the client, e.g. for exceeding rate
+	// limits or at the request of an administrator
+	CloseKicked = CloseReason(3)
+
+	// CloseRedirected: the server redirected the client to a different server
+	CloseRedirected = CloseReason(4)
+
+	// CloseExpired: the connection reached the server's maximum connection
+	// lifetime (see Server.MaxConnectionLifetime)
+	CloseExpired = CloseReason(5)
+)
+
+func (reason CloseReason) String() string {
+	switch reason {
+	case CloseShutdown:
+		return "server shutdown"
+	case CloseIdle:
+		return "idle"
+	case CloseKicked:
+		return "kicked"
+	case CloseRedirected:
+		return "redirected"
+	case CloseExpired:
+		return "expired"
+	default:
+		return "network"
+	}
+}
+
+// DropReason identifies why the waddell server dropped a message instead of
+// relaying it.
+type DropReason uint16
+
+const (
+	// DropRecipientNotConnected: the recipient isn't connected to the server
+	DropRecipientNotConnected = DropReason(0)
+
+	// DropBuffersFull: the server's buffers are full (see
+	// Server.MaxBufferedBytes)
+	DropBuffersFull = DropReason(1)
+
+	// DropWriteFailed: writing to the recipient failed, in which case the
+	// server disconnects the recipient
+	DropWriteFailed = DropReason(2)
+
+	// DropInboxFull: the recipient's inbox is full (see
+	// Server.InboxCapacity)
+	DropInboxFull = DropReason(3)
+
+	// DropUnauthorized: the sender isn't allowed to message the recipient
+	// (see Server.Authorize)
+	DropUnauthorized = DropReason(4)
+)
+
+func (reason DropReason) String() string {
+	switch reason {
+	case DropBuffersFull:
+		return "buffers full"
+	case DropWriteFailed:
+		return "write failed"
+	case DropInboxFull:
+		return "inbox full"
+	case DropUnauthorized:
+		return "unauthorized"
+	default:
+		return "recipient not connected"
+	}
+}
+
+// DroppedError is the error returned by Client.SendWithReceipt when the server
+// reports that it dropped the message.
+type DroppedError struct {
+	Reason DropReason
+}
+
+func (e *DroppedError) Error() string {
+	return fmt.Sprintf("Message dropped by server: %s", e.Reason)
+}
+
+// DisconnectedError describes why a client's connection to the waddell server
+// was closed. See ClientConfig.OnDisconnect.
+type DisconnectedError struct {
+	Reason CloseReason
+
+	// Message: human-readable message from the server, if any
+	Message string
+
+	// Err: the underlying error, if any
+	Err error
+}
+
+func (e *DisconnectedError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("Disconnected (%s): %s", e.Reason, e.Err)
+	}
+	return fmt.Sprintf("Disconnected (%s): %s", e.Reason, e.Message)
+}
+
+func (e *DisconnectedError) Unwrap() error {
+	return e.Err
+}
+
+// close tells this peer why it's being disconnected and then closes its
+// connection.
+func (p *peer) close(reason CloseReason, message string) {
+	atomic.StoreInt32(&p.closeReason, int32(reason))
+	err := p.sendSystemFrame(closeFrame, encodeClose(reason, message))
+	if err != nil {
+		log.Tracef("Unable to tell %s why it's being disconnected: %s", p.server.logId(p.id), err)
+	}
+	closeWrite(p.conn)
+}
+
+func encodeClose(reason CloseReason, message string) []byte {
+	b := make([]byte, 2+len(message))
+	endianness.PutUint16(b, uint16(reason))
+	copy(b[2:], message)
+	return b
+}
+
+func decodeClose(b []byte) *DisconnectedError {
+	if len(b) < 2 {
+		return &DisconnectedError{Reason: CloseNetwork}
+	}
+	return &DisconnectedError{Reason: CloseReason(endianness.Uint16(b)), Message: string(b[2:])}
+}
+
+func encodeReject(err *RejectedError) []byte {
+	b := make([]byte, 2+len(err.Message))
+	endianness.PutUint16(b, uint16(err.Reason))
+	copy(b[2:], err.Message)
+	return b
+}
+
+func decodeReject(b []byte) *RejectedError {
+	if len(b) < 2 {
+		return &RejectedError{RejectUnknown, ""}
+	}
+	return &RejectedError{RejectReason(endianness.Uint16(b)), string(b[2:])}
+}
+
+func encodeRedirect(addr string, reason string) []byte {
+	b := make([]byte, 2+len(addr)+len(reason))
+	endianness.PutUint16(b, uint16(len(addr)))
+	copy(b[2:], addr)
+	copy(b[2+len(addr):], reason)
+	return b
+}
+
+func decodeRedirect(b []byte) (addr string, reason string, err error) {
+	if len(b) < 2 {
+		return "", "", fmt.Errorf("Redirect too short")
+	}
+	addrLength := int(endianness.Uint16(b))
+	if len(b) < 2+addrLength {
+		return "", "", fmt.Errorf("Redirect too short to contain address of length %d", addrLength)
+	}
+	return string(b[2 : 2+addrLength]), string(b[2+addrLength:]), nil
+}
@@ -0,0 +1,109 @@
+package waddell
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// TLS close_notify
+//
+// When closing a TLS connection gracefully, each side sends a close_notify
+// alert before closing the underlying connection. That lets the other side
+// tell a clean close apart from a connection that was cut short, e.g. by an
+// attacker truncating it. Both the client and the server send close_notify
+// when closing gracefully (Client.Close and Server.Shutdown) and give the other
+// side up to gracefulCloseTimeout to answer in kind. Connections that end
+// without close_notify are reported as ErrTruncated by the client and logged
+// by the server.
+//
+// Detecting truncation requires access to the connection underneath TLS, so
+// it only works for TLS connections set up by waddell itself (i.e. clients
+// using ServerCert or TLSConfig and servers using Listen, ListenWith or
+// ListenTLS).
+
+var (
+	gracefulCloseTimeout = 1 * time.Second
+)
+
+// closeGracefully closes the given connection. TLS connections first send
+// close_notify and wait up to gracefulCloseTimeout for the other side's
+// close_notify, discarding anything else that's still read. Anybody else
+// reading from the connection at the same time sees the same EOF.
+func closeGracefully(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return conn.Close()
+	}
+	err := tlsConn.CloseWrite()
+	if err != nil {
+		// Handshake didn't complete, nothing to be graceful about
+		return tlsConn.Close()
+	}
+	tlsConn.SetReadDeadline(time.Now().Add(gracefulCloseTimeout))
+	io.Copy(io.Discard, tlsConn)
+	err = tlsConn.Close()
+	if errors.Is(err, net.ErrClosed) {
+		// Whoever else was reading closed the connection upon seeing the
+		// other side's close_notify
+		return nil
+	}
+	return err
+}
+
+// closeWrite sends close_notify on TLS connections and gives whoever is reading
+// from the connection up to gracefulCloseTimeout to receive the other side's
+// close_notify before closing it. Other connections are closed immediately.
+func closeWrite(conn net.Conn) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || tlsConn.CloseWrite() != nil {
+		conn.Close()
+		return
+	}
+	time.AfterFunc(gracefulCloseTimeout, func() {
+		conn.Close()
+	})
+}
+
+// truncated checks whether the given connection is a TLS connection whose
+// underlying connection ended without the other side sending close_notify.
+func truncated(conn net.Conn) bool {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return false
+	}
+	raw, ok := tlsConn.NetConn().(*eofConn)
+	return ok && atomic.LoadInt32(&raw.eof) == 1
+}
+
+// eofConn is a net.Conn that remembers whether it has reached EOF, which tells
+// the TLS connection on top of it if the other side closed it without
+// close_notify (after close_notify, TLS stops reading).
+type eofConn struct {
+	net.Conn
+	eof int32
+}
+
+func (c *eofConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err == io.EOF {
+		atomic.StoreInt32(&c.eof, 1)
+	}
+	return n, err
+}
+
+// eofListener is a net.Listener whose connections are eofConns.
+type eofListener struct {
+	net.Listener
+}
+
+func (l *eofListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &eofConn{Conn: conn}, nil
+}
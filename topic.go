@@ -2,14 +2,23 @@ package waddell
 
 import (
 	"fmt"
+	"io"
+	"time"
 )
 
 // Out returns the (one and only) channel for writing to the topic identified by
-// the given id.
+// the given id. Messages whose bodies exceed MaxDataLength are logged and
+// discarded, use one of the Send methods to find out about those.
 func (c *Client) Out(id TopicId) chan<- *MessageOut {
 	if c.isClosed() {
 		panic("Attempted to obtain out topic on closed client")
 	}
+	if c.Mode == ReceiveOnly {
+		panic("Attempted to obtain out topic on receive only client")
+	}
+	if checkTopic(id) != nil {
+		panic("Attempted to obtain reserved out topic")
+	}
 
 	c.topicsOutMutex.Lock()
 	defer c.topicsOutMutex.Unlock()
@@ -32,6 +41,12 @@ func (c *Client) In(id TopicId) <-chan *MessageIn {
 	if c.isClosed() {
 		panic("Attempted to obtain in topic on closed client")
 	}
+	if c.Mode == SendOnly {
+		panic("Attempted to obtain in topic on send only client")
+	}
+	if checkTopic(id) != nil {
+		panic("Attempted to obtain reserved in topic")
+	}
 
 	return c.in(id, true)
 }
@@ -47,20 +62,34 @@ func (t *topic) processOut() {
 		if t.client.isClosed() {
 			return
 		}
-		info := t.client.getConnInfo()
-		if info.err != nil {
-			log.Errorf("Unable to get connection to waddell, stop sending to %d: %s", t.id, info.err)
-			t.client.Close()
-			return
+		body, ok := t.client.intercept(msg.To, msg.Body)
+		if !ok {
+			continue
 		}
-		pieces := make([][]byte, 0, 2+len(msg.Body))
-		pieces = append(pieces, msg.To.toBytes(), t.id.toBytes())
-		pieces = append(pieces, msg.Body...)
-		_, err := info.writer.WritePieces(pieces...)
+		size := bodyLength(body)
+		err := checkSize(size, MaxDataLength)
 		if err != nil {
-			t.client.connError(err)
+			// Writing it would fail anyway, no need to drop the connection
+			log.Errorf("Not sending message on %d: %s", t.id, err)
 			continue
 		}
+		if t.client.queueForCredit(t.id, msg.To, body, size) {
+			// Sent once the recipient grants more credits
+			continue
+		}
+		info := t.client.getConnInfo()
+		if info.err == ErrCircuitOpen {
+			log.Tracef("Circuit breaker open, dropping message on %d", t.id)
+			continue
+		}
+		if info.err != nil {
+			if !t.client.isClosed() {
+				log.Errorf("Unable to get connection to waddell, stop sending to %d: %s", t.id, info.err)
+				t.client.Close()
+			}
+			return
+		}
+		t.client.writeMessage(info, t.id, msg.To, body, size)
 	}
 }
 
@@ -69,32 +98,165 @@ func (c *Client) in(id TopicId, create bool) chan *MessageIn {
 	defer c.topicsInMutex.Unlock()
 	ch := c.topicsIn[id]
 	if ch == nil && create {
-		ch = make(chan *MessageIn)
+		ch = make(chan *MessageIn, c.InBufferSize)
 		c.topicsIn[id] = ch
+		if c.insClosed {
+			close(ch)
+		}
 	}
 	return ch
 }
 
 func (c *Client) processInbound() {
+	closeClient := false
+	defer func() {
+		c.closeIns()
+		close(c.inboundDone)
+		if closeClient {
+			// Only once we're done, since Close waits for us
+			c.Close()
+		}
+	}()
+
+	// When reusing buffers, this tracks the buffers of messages that have been
+	// delivered on each in topic (including those of Handles) but may still be
+	// in use by the application.
+	var outstanding map[chan *MessageIn][][]byte
+	if c.ReuseBuffers {
+		outstanding = make(map[chan *MessageIn][][]byte)
+	}
+
 	for {
+		c.waitUntilResumed()
 		if c.isClosed() {
 			return
 		}
 		info := c.getConnInfo()
+		if info.err == ErrCircuitOpen {
+			// Wait until it's time to probe the server again
+			select {
+			case <-time.After(c.untilProbe()):
+			case <-c.done:
+			}
+			continue
+		}
 		if info.err != nil {
-			log.Errorf("Unable to get connection to waddell, stop receiving: %s", info.err)
-			c.Close()
+			if !c.isClosed() {
+				log.Errorf("Unable to get connection to waddell, stop receiving: %s", info.err)
+				closeClient = true
+			}
 			return
 		}
-		msg, err := info.receive()
+		var msg *MessageIn
+		var buf []byte
+		var err error
+		if c.PoolMessages {
+			buf = bufferPool.Get().([]byte)
+			msg = messagePool.Get().(*MessageIn)
+			err = info.receiveInto(buf, msg)
+		} else if c.ReuseBuffers {
+			buf = bufferPool.Get().([]byte)
+			msg = &MessageIn{}
+			err = info.receiveInto(buf, msg)
+		} else {
+			msg, err = info.receive()
+		}
 		if err != nil {
-			c.connError(err)
+			c.releaseBuffer(buf)
+			c.connError(info, info.readError(err))
 			continue
 		}
-		topicIn := c.in(msg.topic, false)
-		if topicIn != nil {
-			topicIn <- msg
+		if msg.From == serverId {
+			c.processSystemFrame(info, msg)
+			c.releaseBuffer(buf)
+			continue
+		}
+		if msg.From == EchoId {
+			// Echoes aren't subject to buffer reuse
+			msg.Body = append([]byte(nil), msg.Body...)
+			c.releaseBuffer(buf)
+			select {
+			case c.echoCh <- msg:
+			default:
+				log.Trace("Nobody waiting for echo, discarding")
+			}
+			continue
+		}
+		if msg.topic == receiptTopic {
+			c.processReceipt(msg)
+			c.releaseBuffer(buf)
+			continue
+		}
+		if msg.topic == creditTopic {
+			c.processCredits(msg)
+			c.releaseBuffer(buf)
+			continue
 		}
+		if msg.topic == introTopic {
+			c.processIntroduction(info, msg)
+			c.releaseBuffer(buf)
+			continue
+		}
+		var receiptId uint64
+		wantsReceipt := msg.topic == receiptRequestTopic
+		if wantsReceipt {
+			receiptId, err = unwrapReceiptRequest(msg)
+			if err != nil {
+				log.Tracef("Ignoring invalid message from %s: %s", c.logId(msg.From), err)
+				c.releaseBuffer(buf)
+				continue
+			}
+		}
+		if !c.accepts(msg) {
+			c.releaseBuffer(buf)
+			continue
+		}
+		c.received.add(time.Now(), len(msg.Body))
+		topicIn, handle := c.route(msg)
+		if topicIn == nil {
+			c.releaseBuffer(buf)
+			continue
+		}
+		if c.PoolMessages {
+			// The buffer now belongs to the message until it's released
+			msg.buf = buf
+			buf = nil
+		}
+		if handle == nil {
+			select {
+			case topicIn <- msg:
+			case <-c.done:
+				// Closed while waiting for the application to receive
+				msg.Release()
+				c.releaseBuffer(buf)
+				return
+			}
+		} else if !handle.deliver(topicIn, msg) {
+			msg.Release()
+			c.releaseBuffer(buf)
+			continue
+		}
+		if wantsReceipt {
+			c.sendReceipt(info, msg.From, receiptId)
+		}
+		if buf != nil {
+			// Once a message has been delivered, the application has received
+			// all but at most InBufferSize of the messages on this topic and is
+			// done with all but the most recent one it received, so we can
+			// reuse the buffers of any older messages.
+			bufs := append(outstanding[topicIn], buf)
+			for len(bufs) > c.InBufferSize+1 {
+				c.releaseBuffer(bufs[0])
+				bufs = bufs[1:]
+			}
+			outstanding[topicIn] = bufs
+		}
+	}
+}
+
+func (c *Client) releaseBuffer(buf []byte) {
+	if buf != nil {
+		bufferPool.Put(buf)
 	}
 }
 
@@ -105,17 +267,60 @@ func (info *connInfo) receive() (*MessageIn, error) {
 	if err != nil {
 		return nil, err
 	}
+	return info.parse(frame)
+}
+
+// readError maps an error encountered reading from the server to either
+// ErrConnectionClosed, if the server closed the connection cleanly,
+// ErrTruncated, if a TLS connection ended without close_notify, or an error
+// wrapping the underlying error.
+func (info *connInfo) readError(err error) error {
+	if err == io.EOF {
+		if truncated(info.conn) {
+			return ErrTruncated
+		}
+		return ErrConnectionClosed
+	}
+	return fmt.Errorf("Unable to read from waddell server: %w", err)
+}
+
+// receiveInto is like receive, but reads the message into the given buffer and
+// MessageIn.
+func (info *connInfo) receiveInto(buf []byte, msg *MessageIn) error {
+	log.Trace("Receiving")
+	n, err := info.reader.Read(buf)
+	log.Tracef("Received %d: %s", n, err)
+	if err != nil {
+		return err
+	}
+	return info.parseInto(buf[:n], msg)
+}
+
+// parse parses a frame into a MessageIn.
+func (info *connInfo) parse(frame []byte) (*MessageIn, error) {
+	msg := &MessageIn{}
+	err := info.parseInto(frame, msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// parseInto is like parse, but parses into the given MessageIn.
+func (info *connInfo) parseInto(frame []byte, msg *MessageIn) error {
 	if len(frame) < WaddellHeaderLength {
-		return nil, fmt.Errorf("Frame not long enough to contain waddell headers. Needed %d bytes, found only %d.", WaddellHeaderLength, len(frame))
+		return fmt.Errorf("Frame not long enough to contain waddell headers. Needed %d bytes, found only %d.", WaddellHeaderLength, len(frame))
 	}
 	peer, err := readPeerId(frame)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	topic, err := readTopicId(frame[PeerIdLength:])
-	return &MessageIn{
-		From:  peer,
-		topic: topic,
-		Body:  frame[PeerIdLength+TopicIdLength:],
-	}, nil
+	if err != nil {
+		return err
+	}
+	msg.From = peer
+	msg.topic = topic
+	msg.Body = frame[WaddellHeaderLength:]
+	return nil
 }
@@ -1,17 +1,32 @@
 package waddell
 
 import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/getlantern/fdcount"
+	"github.com/getlantern/framed"
 	"github.com/getlantern/testify/assert"
+	"github.com/getlantern/waddell/internal/faultnet"
 )
 
 const (
@@ -47,50 +62,3699 @@ func TestPeerIdStringRoundTrip(t *testing.T) {
 	}
 }
 
+func TestLogId(t *testing.T) {
+	id := randomPeerId()
+	server := &Server{}
+	assert.Equal(t, id.String(), fmt.Sprint(server.logId(id)))
+	server.LogId = func(id PeerId) string {
+		return id.String()[:8]
+	}
+	assert.Equal(t, id.String()[:8], fmt.Sprint(server.logId(id)))
+
+	client := &Client{ClientConfig: &ClientConfig{}}
+	assert.Equal(t, id.String(), fmt.Sprint(client.logId(id)))
+	client.LogId = func(id PeerId) string {
+		return "peer"
+	}
+	assert.Equal(t, "peer", fmt.Sprint(client.logId(id)))
+}
+
+func TestPeerIdCompactStringRoundTrip(t *testing.T) {
+	orig := randomPeerId()
+	compact := orig.CompactString()
+	assert.Equal(t, 22, len(compact), "Compact string should be 22 characters")
+	read, err := PeerIdFromCompactString(compact)
+	if err != nil {
+		t.Errorf("Unable to read compact peer id: %s", err)
+	} else {
+		assert.Equal(t, orig, read)
+	}
+
+	// The two encodings aren't interchangeable
+	_, err = PeerIdFromCompactString(orig.String())
+	assert.Error(t, err, "Standard string should not parse as compact string")
+	_, err = PeerIdFromString(compact)
+	assert.Error(t, err, "Compact string should not parse as standard string")
+	_, err = PeerIdFromCompactString("!!!!!!!!!!!!!!!!!!!!!!")
+	assert.Error(t, err, "Invalid characters should be rejected")
+}
+
+func TestRandSource(t *testing.T) {
+	server := &Server{RandSource: bytes.NewReader(bytes.Repeat([]byte{0xab}, 16))}
+	serverAddr, stop := startServer(t, server)
+	defer stop()
+
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+	assert.Equal(t, "abababab-abab-4bab-abab-abababababab", client.CurrentId().String(), "Id should have come from RandSource")
+
+	// RandSource is exhausted now
+	_, err = NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+	})
+	var rejectedErr *RejectedError
+	assert.True(t, errors.As(err, &rejectedErr), "Should have been rejected without entropy, not: %v", err)
+}
+
+func TestAllocator(t *testing.T) {
+	allocator := &testAllocator{ids: []PeerId{serverId, testInstanceId(7, 1), testInstanceId(7, 1), testInstanceId(7, 2)}}
+	server := &Server{Allocator: allocator}
+	serverAddr, stop := startServer(t, server)
+	defer stop()
+
+	newClient := func() (*Client, error) {
+		return NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+		})
+	}
+	client, err := newClient()
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+	assert.Equal(t, testInstanceId(7, 1), client.CurrentId(), "Reserved id should have been skipped")
+
+	client2, err := newClient()
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client2.Close()
+	assert.Equal(t, testInstanceId(7, 2), client2.CurrentId(), "Id that's already taken should have been skipped")
+	assert.Equal(t, byte(7), client2.CurrentId().toBytes()[0], "Id should carry instance bits")
+
+	// Allocator is out of ids now
+	_, err = newClient()
+	var rejectedErr *RejectedError
+	assert.True(t, errors.As(err, &rejectedErr), "Should have been rejected without an id, not: %v", err)
+}
+
+// testAllocator allocates a fixed sequence of ids.
+type testAllocator struct {
+	ids   []PeerId
+	mutex sync.Mutex
+}
+
+func (a *testAllocator) Allocate() (PeerId, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.ids) == 0 {
+		return PeerId{}, fmt.Errorf("Out of ids")
+	}
+	id := a.ids[0]
+	a.ids = a.ids[1:]
+	return id, nil
+}
+
+// testInstanceId builds a peer id whose first byte identifies the instance
+// that owns the peer.
+func testInstanceId(instance byte, seq byte) PeerId {
+	b := make([]byte, PeerIdLength)
+	b[0] = instance
+	b[PeerIdLength-1] = seq
+	id, _ := readPeerId(b)
+	return id
+}
+
+func TestIsReserved(t *testing.T) {
+	assert.True(t, IsReserved(serverId), "Server id should be reserved")
+	assert.True(t, IsReserved(EchoId), "Echo id should be reserved")
+	for i := 0; i < 10000; i++ {
+		if !assert.False(t, IsReserved(randomPeerId()), "Random ids should never be reserved") {
+			return
+		}
+	}
+
+	// Even a degenerate entropy source doesn't yield reserved ids
+	for _, b := range []byte{0x00, 0xff} {
+		id, err := randomPeerIdFrom(bytes.NewReader(bytes.Repeat([]byte{b}, 16)))
+		if assert.NoError(t, err) {
+			assert.False(t, IsReserved(id), "Id from constant entropy should not be reserved")
+		}
+	}
+}
+
 func TestTopicIdRoundTrip(t *testing.T) {
 	orig := TopicId(5)
 	read, err := readTopicId(orig.toBytes())
 	if err != nil {
-		t.Errorf("Error reading topic id: %s", err)
-	} else {
-		assert.Equal(t, orig, read)
+		t.Errorf("Error reading topic id: %s", err)
+	} else {
+		assert.Equal(t, orig, read)
+	}
+}
+
+func TestTopicIdTruncation(t *testing.T) {
+	orig := TopicId(5)
+	_, err := readTopicId(orig.toBytes()[:1])
+	assert.Error(t, err)
+}
+
+func TestBadDialerWithNoReconnect(t *testing.T) {
+	cfg := &ClientConfig{
+		ReconnectAttempts: 0,
+		Dial: func() (net.Conn, error) {
+			return nil, fmt.Errorf("I won't dial, no way!")
+		},
+	}
+	client, err := NewClient(cfg)
+	assert.Error(t, err, "Connecting with no reconnect attempts should have failed")
+	if err == nil {
+		client.Close()
+	}
+}
+
+func TestBadDialerWithMultipleReconnect(t *testing.T) {
+	cfg := &ClientConfig{
+		ReconnectAttempts: 2,
+		Dial: func() (net.Conn, error) {
+			return nil, fmt.Errorf("I won't dial, no way!")
+		},
+	}
+	start := time.Now()
+	client, err := NewClient(cfg)
+	defer client.Close()
+	delta := time.Now().Sub(start)
+	assert.Error(t, err, "Connecting with 2 reconnect attempts should have failed")
+	expectedDelta := reconnectDelayInterval * 3
+	assert.True(t, delta >= expectedDelta, fmt.Sprintf("Reconnecting didn't wait long enough. Should have waited %s, only waited %s", expectedDelta, delta))
+}
+
+func TestBadDialerWithNegativeReconnect(t *testing.T) {
+	dials := 0
+	cfg := &ClientConfig{
+		ReconnectAttempts: -1,
+		Dial: func() (net.Conn, error) {
+			dials++
+			return nil, fmt.Errorf("I won't dial, no way!")
+		},
+	}
+	_, err := NewClient(cfg)
+	assert.Error(t, err, "Connecting should have failed")
+	assert.Equal(t, 1, dials, "Negative reconnect attempts should dial once")
+}
+
+func TestNoReconnect(t *testing.T) {
+	dialErr := fmt.Errorf("I won't dial, no way!")
+	_, err := NewClient(&ClientConfig{
+		NoReconnect:       true,
+		ReconnectAttempts: 5,
+		Dial: func() (net.Conn, error) {
+			return nil, dialErr
+		},
+	})
+	assert.Equal(t, dialErr, err, "Should have gotten raw dial error")
+
+	server := &Server{}
+	serverAddr, stop := startServer(t, server)
+	defer stop()
+	disconnected := make(chan error, 1)
+	client, err := NewClient(&ClientConfig{
+		NoReconnect: true,
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+		OnDisconnect: func(err error) {
+			disconnected <- err
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+	assert.NoError(t, server.Disconnect(client.CurrentId()))
+	<-disconnected
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, Closed, client.State(), "Client should have closed instead of reconnecting")
+	assert.Empty(t, server.Peers(), "Client should not have reconnected")
+}
+
+func TestIdTimeout(t *testing.T) {
+	// Stub server that accepts connections but never assigns an id
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", l.Addr().String())
+		},
+		IdTimeout: 250 * time.Millisecond,
+	})
+	defer client.Close()
+	assert.True(t, errors.Is(err, ErrNoIdAssigned), "Should have gotten ErrNoIdAssigned, not: %v", err)
+	assert.True(t, time.Since(start) < 5*time.Second, "Should have failed fast")
+}
+
+func TestConnectionClosedCleanly(t *testing.T) {
+	err := doTestConnectionClosed(t, false)
+	assert.True(t, errors.Is(err, ErrConnectionClosed), "Clean close should be reported as ErrConnectionClosed, not: %v", err)
+}
+
+func TestConnectionReset(t *testing.T) {
+	err := doTestConnectionClosed(t, true)
+	assert.False(t, errors.Is(err, ErrConnectionClosed), "Reset should not be reported as ErrConnectionClosed")
+	var netErr net.Error
+	assert.True(t, errors.As(err, &netErr), "Reset should be reported as network error, not: %v", err)
+}
+
+// doTestConnectionClosed connects a client to a stub server that assigns an id
+// and then closes the connection, either cleanly or by resetting it, and
+// returns the error reported to OnDisconnect.
+func doTestConnectionClosed(t *testing.T, reset bool) error {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer l.Close()
+	closeConn := make(chan bool)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		w := framed.NewWriter(conn)
+		w.WritePieces(randomPeerId().toBytes(), TopicId(ProtocolVersion).toBytes())
+		<-closeConn
+		if reset {
+			conn.(*net.TCPConn).SetLinger(0)
+		}
+		conn.Close()
+	}()
+
+	disconnected := make(chan error, 1)
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", l.Addr().String())
+		},
+		NoReconnect: true,
+		OnDisconnect: func(err error) {
+			disconnected <- err
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+	close(closeConn)
+	select {
+	case err := <-disconnected:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client should have been disconnected")
+		return nil
+	}
+}
+
+func TestFairSemaphore(t *testing.T) {
+	s := newFairSemaphore(1)
+	s.acquire(0)
+	order := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			s.acquire(0)
+			order <- i
+			s.release()
+		}(i)
+		// Make sure goroutines queue up in order
+		time.Sleep(50 * time.Millisecond)
+	}
+	s.release()
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, i, <-order, "Slots should be granted in order of request")
+	}
+}
+
+func TestFairSemaphorePriorityClasses(t *testing.T) {
+	s := newFairSemaphore(1)
+	s.acquire(0)
+	order := make(chan int, 4)
+	// Requests alternate between class 0 and class 1
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			s.acquire(i % 2)
+			order <- i
+			s.release()
+		}(i)
+		// Make sure goroutines queue up in order
+		time.Sleep(50 * time.Millisecond)
+	}
+	s.release()
+	for _, expected := range []int{1, 3, 0, 2} {
+		assert.Equal(t, expected, <-order, "Higher class should go first, in order of request within class")
+	}
+}
+
+func TestPriorityClass(t *testing.T) {
+	server := &Server{
+		FairRelayConcurrency: 1,
+		PriorityClass: func(p *PeerInfo) int {
+			if p.ServerName == "" {
+				return 2
+			}
+			return 0
+		},
+	}
+	serverAddr, stop := startServer(t, server)
+	defer stop()
+
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+	info := server.Peer(client.CurrentId())
+	if assert.NotNil(t, info) {
+		assert.Equal(t, 2, info.PriorityClass)
+	}
+
+	// Relaying still works
+	in := client.In(TestTopic)
+	client.Out(TestTopic) <- Message(client.CurrentId(), []byte(Hello))
+	assert.Equal(t, Hello, string((<-in).Body))
+}
+
+func TestRateCounter(t *testing.T) {
+	rc := &rateCounter{}
+	start := time.Unix(1000, 0)
+	for i := 0; i < 10; i++ {
+		// 2 messages of 100 bytes per second
+		rc.add(start.Add(time.Duration(i)*time.Second), 100)
+		rc.add(start.Add(time.Duration(i)*time.Second+500*time.Millisecond), 100)
+	}
+	messages, bytes := rc.rates(start.Add(10 * time.Second))
+	assert.Equal(t, float64(2), messages)
+	assert.Equal(t, float64(200), bytes)
+
+	// Current second isn't counted, older seconds drop out of the window
+	rc.add(start.Add(12*time.Second), 1000)
+	messages, bytes = rc.rates(start.Add(12 * time.Second))
+	assert.Equal(t, float64(6)/rateWindow, messages)
+	assert.Equal(t, float64(600)/rateWindow, bytes)
+	messages, _ = rc.rates(start.Add(30 * time.Second))
+	assert.Equal(t, float64(0), messages, "Old counts should have expired")
+}
+
+func TestPending(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+		InBufferSize: 5,
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+
+	in := client.In(TestTopic)
+	assert.Equal(t, 0, client.Pending(), "Nothing should be pending before sending")
+	for i := 0; i < 3; i++ {
+		client.Out(TestTopic) <- Message(client.CurrentId(), []byte(Hello))
+	}
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal(t, 3, client.Pending(), "All sent messages should be pending")
+	<-in
+	assert.Equal(t, 2, client.Pending(), "Reading a message should reduce pending")
+	assert.Equal(t, 2, client.DrainPending(), "Should have drained remaining messages")
+	assert.Equal(t, 0, client.Pending(), "Nothing should be pending after draining")
+
+	client.Out(TestTopic) <- Message(client.CurrentId(), []byte(HelloYourself))
+	msg := <-in
+	assert.Equal(t, HelloYourself, string(msg.Body), "New messages should arrive after draining")
+
+	// Messages buffered for Handles are pending too
+	handle := client.Dup()
+	defer handle.Close()
+	handle.In(TestTopic + 1)
+	client.Out(TestTopic + 1) <- Message(client.CurrentId(), []byte(Hello))
+	client.Out(TestTopic) <- Message(client.CurrentId(), []byte(Hello))
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal(t, 2, client.Pending(), "Messages buffered for Handles should be pending")
+	assert.Equal(t, 2, client.DrainPending(), "Should have drained messages buffered for Handles")
+	assert.Equal(t, 0, client.Pending(), "Nothing should be pending after draining")
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waddell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "waddell.sock")
+	listener, err := ListenUnix(path)
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer func() {
+		listener.Close()
+		// Wait a short time to let sockets finish closing
+		time.Sleep(250 * time.Millisecond)
+	}()
+	go (&Server{}).Serve(listener)
+
+	dial := func() (net.Conn, error) {
+		return net.Dial("unix", path)
+	}
+	a, err := NewClient(&ClientConfig{Dial: dial})
+	if err != nil {
+		t.Fatalf("Unable to connect client a: %s", err)
+	}
+	defer a.Close()
+	b, err := NewClient(&ClientConfig{Dial: dial})
+	if err != nil {
+		t.Fatalf("Unable to connect client b: %s", err)
+	}
+	defer b.Close()
+
+	in := b.In(TestTopic)
+	a.Out(TestTopic) <- Message(b.CurrentId(), []byte(Hello))
+	msg := <-in
+	assert.Equal(t, Hello, string(msg.Body), "Message should match expected")
+	assert.Equal(t, a.CurrentId(), msg.From, "Peer on message should match expected")
+}
+
+func TestListenWith(t *testing.T) {
+	var controlled int32
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			atomic.AddInt32(&controlled, 1)
+			return nil
+		},
+	}
+	_, err := ListenWith(lc, "localhost:0", "pk.pem", "")
+	assert.Error(t, err, "Listening with only a pkfile should fail")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&controlled), "Socket shouldn't have been created")
+
+	listener, err := ListenWith(lc, "localhost:0", "", "")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer listener.Close()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&controlled), "ListenConfig should have been used to create socket")
+	go (&Server{}).Serve(listener)
+
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", listener.Addr().String())
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+	assert.NoError(t, client.SendKeepAlive(), "Client should be able to talk to server")
+}
+
+func TestMigrate(t *testing.T) {
+	server1 := &Server{}
+	addr1, stop1 := startServer(t, server1)
+	defer stop1()
+	addr2, stop2 := startServer(t, &Server{})
+	defer stop2()
+
+	redirectedTo := make(chan string, 1)
+	ids := make(chan PeerId, 2)
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", addr1)
+		},
+		DialRedirect: func(addr string) (net.Conn, error) {
+			return net.Dial("tcp", addr)
+		},
+		OnRedirect: func(addr string, reason string) {
+			assert.Equal(t, "maintenance", reason, "Reason should match expected")
+			redirectedTo <- addr
+		},
+		OnId: func(id PeerId) {
+			ids <- id
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+	in := client.In(TestTopic)
+	<-ids
+
+	server1.Migrate(addr2, "maintenance")
+	assert.Equal(t, addr2, <-redirectedTo, "Client should have been redirected to server 2")
+	newId := <-ids
+
+	other, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", addr2)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect other client: %s", err)
+	}
+	defer other.Close()
+	other.Out(TestTopic) <- Message(newId, []byte(Hello))
+	msg := <-in
+	assert.Equal(t, Hello, string(msg.Body), "Client should have received message via server 2")
+}
+
+func TestFromCannotBeForged(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	victim, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect victim: %s", err)
+	}
+	defer victim.Close()
+	in := victim.In(TestTopic)
+
+	// Connect a raw attacker that speaks the wire protocol directly
+	conn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Unable to connect attacker: %s", err)
+	}
+	defer conn.Close()
+	frame, err := framed.NewReader(conn).ReadFrame()
+	if err != nil {
+		t.Fatalf("Unable to read attacker's id: %s", err)
+	}
+	attackerId, err := readPeerId(frame)
+	if err != nil {
+		t.Fatalf("Unable to parse attacker's id: %s", err)
+	}
+
+	// Try to sneak a spoofed sender id into the message
+	spoofedId := randomPeerId()
+	_, err = framed.NewWriter(conn).WritePieces(victim.CurrentId().toBytes(), TestTopic.toBytes(), spoofedId.toBytes())
+	if err != nil {
+		t.Fatalf("Unable to write spoofed message: %s", err)
+	}
+
+	msg := <-in
+	assert.Equal(t, attackerId, msg.From, "From should be the attacker's assigned id")
+	assert.NotEqual(t, spoofedId, msg.From, "From should not be spoofable")
+}
+
+func TestReconnect(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", serverAddr)
+	}
+	client, err := NewClient(&ClientConfig{Dial: dial})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+	other, err := NewClient(&ClientConfig{Dial: dial})
+	if err != nil {
+		t.Fatalf("Unable to connect other client: %s", err)
+	}
+	defer other.Close()
+
+	in := client.In(TestTopic)
+	oldId := client.CurrentId()
+	err = client.Reconnect()
+	if assert.NoError(t, err, "Reconnecting should succeed") {
+		assert.NotEqual(t, oldId, client.CurrentId(), "Reconnecting should yield a new id")
+	}
+
+	other.Out(TestTopic) <- Message(client.CurrentId(), []byte(Hello))
+	msg := <-in
+	assert.Equal(t, Hello, string(msg.Body), "Client should receive messages on new id")
+}
+
+func TestReconnectCount(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	type reconnect struct {
+		attempt int
+		id      PeerId
+	}
+	reconnected := make(chan reconnect, 10)
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+		OnReconnect: func(attempt int, newId PeerId) {
+			reconnected <- reconnect{attempt, newId}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+	assert.Equal(t, 0, client.ReconnectCount(), "Initial connection isn't a reconnect")
+
+	for i := 1; i <= 2; i++ {
+		if !assert.NoError(t, client.Reconnect(), "Reconnecting should succeed") {
+			return
+		}
+		select {
+		case r := <-reconnected:
+			assert.Equal(t, i, r.attempt)
+			assert.Equal(t, client.CurrentId(), r.id)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("OnReconnect not called for reconnect %d", i)
+		}
+		assert.Equal(t, i, client.ReconnectCount())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := &Metrics{}
+	serverAddr, stop := startServer(t, &Server{Metrics: metrics})
+	defer stop()
+
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+
+	in := client.In(TestTopic)
+	for i := 0; i < 3; i++ {
+		err := client.SendKeepAlive()
+		if err != nil {
+			t.Fatalf("Unable to send keepalive: %s", err)
+		}
+	}
+	client.Out(TestTopic) <- Message(client.CurrentId(), []byte(Hello))
+	<-in
+	client.Out(TestTopic) <- Message(client.CurrentId(), make([]byte, 2000))
+	<-in
+
+	snapshot := metrics.Snapshot()
+	assert.Equal(t, int64(2), snapshot.Messages, "Should have counted messages")
+	assert.Equal(t, int64(3), snapshot.KeepAlives, "Should have counted keepalives")
+	assert.Equal(t, int64(0), snapshot.Invalid, "Should have counted no invalid frames")
+	assert.Equal(t, [len(SizeBuckets) + 1]int64{1, 0, 0, 1, 0, 0}, snapshot.MessageSizes, "Should have bucketed message sizes")
+	var intervals int64
+	for _, count := range snapshot.MessageIntervals {
+		intervals += count
+	}
+	assert.Equal(t, int64(1), intervals, "Should have counted interval between messages")
+}
+
+func TestShortFrames(t *testing.T) {
+	metrics := &Metrics{}
+	serverAddr, stop := startServer(t, &Server{Metrics: metrics})
+	defer stop()
+
+	conn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Unable to dial server: %s", err)
+	}
+	defer conn.Close()
+	reader := framed.NewReader(conn)
+	idFrame, err := reader.ReadFrame()
+	if !assert.NoError(t, err, "Should have received id frame") {
+		return
+	}
+	id := idFrame[:PeerIdLength]
+
+	// Frames that have a recipient but no (complete) topic are dropped
+	writer := framed.NewWriter(conn)
+	writer.WritePieces(id)
+	writer.WritePieces(id, []byte{1})
+	writer.WritePieces(id, TestTopic.toBytes(), []byte(Hello))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	frame, err := reader.ReadFrame()
+	if assert.NoError(t, err, "Should have received valid message") {
+		assert.Equal(t, Hello, string(frame[WaddellHeaderLength:]), "Only the valid message should have been relayed")
+	}
+	snapshot := metrics.Snapshot()
+	assert.Equal(t, int64(2), snapshot.Invalid, "Should have counted short frames as invalid")
+	assert.Equal(t, int64(1), snapshot.Messages, "Should have counted only the valid message")
+}
+
+func TestMaxBufferedBytes(t *testing.T) {
+	metrics := &Metrics{}
+	server := &Server{Metrics: metrics, MaxBufferedBytes: 100}
+	serverAddr, stop := startServer(t, server)
+	defer stop()
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	sender := newClient()
+	defer sender.Close()
+	receiver := newClient()
+	defer receiver.Close()
+
+	in := receiver.In(TestTopic)
+	out := sender.Out(TestTopic)
+	out <- Message(receiver.CurrentId(), make([]byte, 200))
+	out <- Message(receiver.CurrentId(), []byte(Hello))
+	msg := <-in
+	assert.Equal(t, Hello, string(msg.Body), "Oversized message should have been dropped")
+	assert.Equal(t, int64(1), metrics.Snapshot().Dropped)
+	assert.Equal(t, int64(0), server.BufferedBytes(), "Nothing should be buffered anymore")
+}
+
+func TestTraceRelay(t *testing.T) {
+	type relay struct {
+		from  PeerId
+		to    PeerId
+		topic TopicId
+		size  int
+		err   error
+	}
+	relays := make(chan *relay, 10)
+	server := &Server{
+		TraceRelay: func(from PeerId, to PeerId, topic TopicId, size int) func(error) {
+			r := &relay{from: from, to: to, topic: topic, size: size}
+			return func(err error) {
+				r.err = err
+				relays <- r
+			}
+		},
+	}
+	serverAddr, stop := startServer(t, server)
+	defer stop()
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	sender := newClient()
+	defer sender.Close()
+	receiver := newClient()
+	defer receiver.Close()
+
+	in := receiver.In(TestTopic)
+	sender.Out(TestTopic) <- Message(receiver.CurrentId(), []byte(Hello))
+	<-in
+	r := <-relays
+	assert.Equal(t, sender.CurrentId(), r.from)
+	assert.Equal(t, receiver.CurrentId(), r.to)
+	assert.Equal(t, TestTopic, r.topic)
+	assert.Equal(t, len(Hello), r.size)
+	assert.NoError(t, r.err)
+
+	sender.Out(TestTopic) <- Message(randomPeerId(), []byte(Hello))
+	r = <-relays
+	assert.Error(t, r.err, "Relaying to unknown peer should fail")
+}
+
+func TestWelcome(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{
+		Welcome: func(id PeerId) []byte {
+			return []byte(fmt.Sprintf(HelloYourself, id))
+		},
+	})
+	defer stop()
+
+	start := time.Now()
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+	assert.Equal(t, fmt.Sprintf(HelloYourself, client.CurrentId()), string(client.Welcome()))
+	info := client.Info()
+	assert.Equal(t, client.CurrentId(), info.Id)
+	assert.Equal(t, ProtocolVersion, info.ProtocolVersion)
+	assert.Equal(t, client.Welcome(), info.Welcome)
+	assert.False(t, info.ConnectedAt.Before(start), "ConnectedAt should be set on connect")
+	assert.False(t, info.ConnectedAt.After(time.Now()), "ConnectedAt should be set on connect")
+
+	plainAddr, stopPlain := startServer(t, &Server{})
+	defer stopPlain()
+	plain, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", plainAddr)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer plain.Close()
+	assert.Nil(t, plain.Welcome(), "Server without Welcome should send no welcome")
+	assert.Nil(t, plain.Info().Welcome, "Server without Welcome should send no welcome")
+
+	// The id frame tells clients whether to expect a welcome frame
+	readVersion := func(addr string) (TopicId, bool) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Unable to dial: %s", err)
+		}
+		defer conn.Close()
+		r := framed.NewReader(conn)
+		frame, err := r.ReadFrame()
+		if err != nil {
+			t.Fatalf("Unable to read id frame: %s", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+		_, err = r.ReadFrame()
+		return TopicId(endianness.Uint16(frame[PeerIdLength:])), err == nil
+	}
+	version, followed := readVersion(serverAddr)
+	assert.Equal(t, TopicId(ProtocolVersion)|welcomeFlag, version, "Id frame should flag welcome")
+	assert.True(t, followed, "Welcome frame should follow id frame")
+	version, followed = readVersion(plainAddr)
+	assert.Equal(t, TopicId(ProtocolVersion), version, "Id frame shouldn't flag welcome")
+	assert.False(t, followed, "No frame should follow id frame")
+}
+
+func TestTraceSampleRate(t *testing.T) {
+	count := func(rate float64) int {
+		server := &Server{TraceSampleRate: rate}
+		sampled := 0
+		for i := 0; i < 1000; i++ {
+			if server.sample() {
+				sampled++
+			}
+		}
+		return sampled
+	}
+	assert.Equal(t, 0, count(0), "Nothing should be sampled by default")
+	assert.Equal(t, 1000, count(1), "Everything should be sampled at rate 1")
+	half := count(0.5)
+	assert.True(t, half > 350 && half < 650, "About half should be sampled at rate 0.5, got %d", half)
+}
+
+func TestEcho(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{Echo: true})
+	defer stop()
+
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+
+	msg, err := client.Echo([]byte(Hello))
+	if assert.NoError(t, err, "Echo should succeed") {
+		assert.Equal(t, EchoId, msg.From, "Echo should come from EchoId")
+		assert.Equal(t, Hello, string(msg.Body), "Echo should match what we sent")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		rtt, err := client.Heartbeat()
+		if assert.NoError(t, err, "Heartbeat should succeed") {
+			assert.True(t, rtt > 0, "RTT should be positive")
+		}
+	}
+}
+
+func TestSendFrom(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	sender := newClient()
+	defer sender.Close()
+	receiver := newClient()
+	defer receiver.Close()
+
+	in := receiver.In(TestTopic)
+	r := strings.NewReader(Hello + " and more")
+	if !assert.NoError(t, sender.SendFrom(TestTopic, receiver.CurrentId(), r, len(Hello)), "SendFrom should succeed") {
+		return
+	}
+	msg := <-in
+	assert.Equal(t, Hello, string(msg.Body), "Should have received exactly length bytes")
+	assert.Equal(t, sender.CurrentId(), msg.From)
+	assert.Equal(t, len(" and more"), r.Len(), "Remainder of reader should be unread")
+
+	assert.Error(t, sender.SendFrom(TestTopic, receiver.CurrentId(), strings.NewReader("short"), 100), "Short reader should fail")
+	assert.Error(t, sender.SendFrom(TestTopic, receiver.CurrentId(), r, MaxDataLength+1), "Oversized message should fail")
+
+	// Sender reconnects after a failed SendFrom
+	in = receiver.In(TestTopic)
+	sender.Out(TestTopic) <- Message(receiver.CurrentId(), []byte(Hello))
+	msg = <-in
+	assert.Equal(t, Hello, string(msg.Body))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	// Find an address on which nothing is listening
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	serverAddr := l.Addr().String()
+	l.Close()
+
+	var dials int32
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return net.Dial("tcp", serverAddr)
+		},
+		ReconnectAttempts:    5,
+		BreakerThreshold:     2,
+		BreakerProbeInterval: 500 * time.Millisecond,
+	})
+	defer client.Close()
+	assert.Equal(t, ErrCircuitOpen, err, "Should have tripped circuit breaker")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&dials), "Should have stopped dialing once circuit opened")
+	assert.Equal(t, CircuitOpen, client.State())
+	assert.Equal(t, ErrCircuitOpen, client.SendKeepAlive(), "Should fail fast while circuit is open")
+
+	// Once the server comes up, the next probe connects
+	l, err = net.Listen("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Unable to listen again: %s", err)
+	}
+	go (&Server{}).Serve(l)
+	defer l.Close()
+	time.Sleep(1 * time.Second)
+	assert.Equal(t, Connected, client.State(), "Should have reconnected after probing")
+	assert.NoError(t, client.SendKeepAlive())
+	client.Close()
+	assert.Equal(t, Closed, client.State())
+}
+
+func TestOrdering(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	receiver := newClient()
+	defer receiver.Close()
+	in := receiver.In(TestTopic)
+
+	numSenders := 10
+	numMessages := 1000
+	for i := 0; i < numSenders; i++ {
+		sender := newClient()
+		defer sender.Close()
+		go func() {
+			out := sender.Out(TestTopic)
+			for j := 0; j < numMessages; j++ {
+				out <- Message(receiver.CurrentId(), []byte(fmt.Sprint(j)))
+			}
+		}()
+	}
+
+	next := make(map[PeerId]int)
+	for i := 0; i < numSenders*numMessages; i++ {
+		msg := <-in
+		if !assert.Equal(t, fmt.Sprint(next[msg.From]), string(msg.Body), "Messages from %s arrived out of order", msg.From) {
+			return
+		}
+		next[msg.From]++
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{MaxConnections: 1})
+	defer stop()
+
+	cfg := &ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+	}
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+
+	rejected, err := NewClient(cfg)
+	defer rejected.Close()
+	var rejectedErr *RejectedError
+	if assert.True(t, errors.As(err, &rejectedErr), "Should have gotten RejectedError, not: %v", err) {
+		assert.Equal(t, RejectServerFull, rejectedErr.Reason, "Should have been rejected because server is full")
+		assert.True(t, rejectedErr.Temporary(), "Server being full should be temporary")
+	}
+}
+
+func TestAcceptRate(t *testing.T) {
+	dialer := func(serverAddr string) *ClientConfig {
+		return &ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+		}
+	}
+
+	serverAddr, stop := startServer(t, &Server{AcceptRate: 5})
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		client, err := NewClient(dialer(serverAddr))
+		if assert.NoError(t, err, "Throttled client should eventually connect") {
+			client.Close()
+		}
+	}
+	assert.True(t, time.Since(start) >= 400*time.Millisecond, "Connections should have been paced")
+	stop()
+
+	serverAddr, stop = startServer(t, &Server{AcceptRate: 1, RejectExcessConnections: true})
+	defer stop()
+	client, err := NewClient(dialer(serverAddr))
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+	rejected, err := NewClient(dialer(serverAddr))
+	defer rejected.Close()
+	var rejectedErr *RejectedError
+	if assert.True(t, errors.As(err, &rejectedErr), "Should have gotten RejectedError, not: %v", err) {
+		assert.Equal(t, RejectRateLimited, rejectedErr.Reason, "Should have been rate limited")
+	}
+}
+
+func TestOnConnect(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{
+		OnConnect: func(id PeerId, remoteAddr net.Addr) error {
+			return fmt.Errorf("Quota exceeded")
+		},
+	})
+	defer stop()
+
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+	})
+	defer client.Close()
+	var rejectedErr *RejectedError
+	if assert.True(t, errors.As(err, &rejectedErr), "Should have gotten RejectedError, not: %v", err) {
+		assert.Equal(t, RejectDenied, rejectedErr.Reason, "Should have been denied")
+		assert.Equal(t, "Quota exceeded", rejectedErr.Message, "Should have gotten message from OnConnect")
+	}
+}
+
+func TestAdmitAfterId(t *testing.T) {
+	connecting := make(chan PeerId, 1)
+	admit := make(chan struct{})
+	server := &Server{
+		OnConnect: func(id PeerId, remoteAddr net.Addr) error {
+			connecting <- id
+			<-admit
+			return nil
+		},
+	}
+	serverAddr, stop := startServer(t, server)
+	defer stop()
+
+	connected := make(chan *Client, 1)
+	go func() {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+		})
+		if err != nil {
+			t.Errorf("Unable to connect client: %s", err)
+		}
+		connected <- client
+	}()
+
+	id := <-connecting
+	assert.Nil(t, server.Peer(id), "Peer shouldn't be routable before it's been told its id")
+	assert.Empty(t, server.Peers(), "Peer shouldn't be listed before it's been told its id")
+	assert.Equal(t, 0, server.Stats().Connections, "Peer shouldn't be counted before it's been told its id")
+	assert.Equal(t, 1, server.Stats().Handshaking, "Peer should be handshaking until it's been told its id")
+	assert.Error(t, server.Disconnect(id), "Shouldn't be able to disconnect peer before it's been told its id")
+
+	close(admit)
+	client := <-connected
+	if client == nil {
+		return
+	}
+	defer client.Close()
+	assert.Equal(t, id, client.CurrentId())
+	assert.NotNil(t, server.Peer(id), "Peer should be routable once it's been told its id")
+	assert.Equal(t, 1, server.Stats().Connections)
+	assert.Equal(t, 0, server.Stats().Handshaking)
+
+	assert.NoError(t, server.Disconnect(id))
+	for i := 0; i < 100 && server.Stats().Connections > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, server.Stats().Connections, "Disconnected peer shouldn't be counted")
+}
+
+func TestCompression(t *testing.T) {
+	doTestCompression(t, true)
+}
+
+func TestCompressionDeclined(t *testing.T) {
+	doTestCompression(t, false)
+}
+
+func doTestCompression(t *testing.T, allowCompression bool) {
+	serverAddr, stop := startServer(t, &Server{AllowCompression: allowCompression})
+	defer stop()
+
+	connect := func(compress bool) *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+			Compress: compress,
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	compressed := connect(true)
+	defer compressed.Close()
+	uncompressed := connect(false)
+	defer uncompressed.Close()
+	if allowCompression {
+		assert.Equal(t, compressionFlate, compressed.Info().Compression, "Compressed client should report compression")
+	} else {
+		assert.Equal(t, "", compressed.Info().Compression, "Declined compression should be reported as no compression")
+	}
+	assert.Equal(t, "", uncompressed.Info().Compression, "Uncompressed client should report no compression")
+
+	compressedIn := compressed.In(TestTopic)
+	uncompressedIn := uncompressed.In(TestTopic)
+	for i := 0; i < 10; i++ {
+		compressed.Out(TestTopic) <- Message(uncompressed.CurrentId(), []byte(Hello))
+		msg := <-uncompressedIn
+		assert.Equal(t, Hello, string(msg.Body), "Uncompressed client should receive message from compressed client")
+		uncompressed.Out(TestTopic) <- Message(compressed.CurrentId(), []byte(HelloYourself))
+		msg = <-compressedIn
+		assert.Equal(t, HelloYourself, string(msg.Body), "Compressed client should receive message from uncompressed client")
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	doTestFlushInterval(t, false)
+}
+
+func TestFlushIntervalCompressed(t *testing.T) {
+	doTestFlushInterval(t, true)
+}
+
+func doTestFlushInterval(t *testing.T, compress bool) {
+	serverAddr, stop := startServer(t, &Server{AllowCompression: true})
+	defer stop()
+
+	connect := func(flushInterval time.Duration) *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+			Compress:      compress,
+			FlushInterval: flushInterval,
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	sender := connect(100 * time.Millisecond)
+	receiver := connect(0)
+	defer receiver.Close()
+	in := receiver.In(TestTopic)
+
+	_, err := sender.Heartbeat()
+	assert.NoError(t, err, "Heartbeat should be flushed right away")
+
+	for i := 0; i < 10; i++ {
+		sender.Out(TestTopic) <- Message(receiver.CurrentId(), []byte(fmt.Sprint(i)))
+	}
+	for i := 0; i < 10; i++ {
+		msg := <-in
+		assert.Equal(t, fmt.Sprint(i), string(msg.Body), "Coalesced messages should arrive in order")
+	}
+
+	// Closing should flush whatever is still buffered
+	err = sender.SendFrom(TestTopic, receiver.CurrentId(), strings.NewReader(Hello), len(Hello))
+	assert.NoError(t, err)
+	sender.Close()
+	select {
+	case msg := <-in:
+		assert.Equal(t, Hello, string(msg.Body))
+	case <-time.After(5 * time.Second):
+		t.Fatal("Buffered message should have been flushed on close")
+	}
+}
+
+func TestNetworkFailures(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	network := faultnet.New()
+	ids := make(chan PeerId, 10)
+	client, err := NewClient(&ClientConfig{
+		Dial: network.Dial(func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		}),
+		OnId: func(id PeerId) {
+			ids <- id
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+	<-ids
+	receiver, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect receiver: %s", err)
+	}
+	defer receiver.Close()
+	in := receiver.In(TestTopic)
+
+	// Messages sent during a partition are delivered once it heals
+	network.Partition()
+	client.Out(TestTopic) <- Message(receiver.CurrentId(), []byte(Hello))
+	select {
+	case <-in:
+		t.Fatal("Message should not be delivered during partition")
+	case <-time.After(250 * time.Millisecond):
+	}
+	network.Heal()
+	msg := <-in
+	assert.Equal(t, Hello, string(msg.Body), "Message should be delivered once partition heals")
+	assert.Equal(t, client.CurrentId(), msg.From)
+
+	// When the connection drops, the client reconnects with a new id
+	oldId := client.CurrentId()
+	network.Drop()
+	select {
+	case newId := <-ids:
+		assert.NotEqual(t, oldId, newId, "Should have gotten new id after reconnecting")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client should have reconnected after connection dropped")
+	}
+	client.Out(TestTopic) <- Message(receiver.CurrentId(), []byte(HelloYourself))
+	msg = <-in
+	assert.Equal(t, HelloYourself, string(msg.Body), "Message should be delivered after reconnecting")
+	assert.Equal(t, client.CurrentId(), msg.From)
+}
+
+func TestBoundDialer(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	_, err := BoundDialer("not an ip", serverAddr)
+	assert.Error(t, err, "Invalid local address should be rejected")
+
+	dial, err := BoundDialer("127.0.0.1", serverAddr)
+	if err != nil {
+		t.Fatalf("Unable to create dialer: %s", err)
+	}
+	conn, err := dial()
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	defer conn.Close()
+	assert.Equal(t, "127.0.0.1", conn.LocalAddr().(*net.TCPAddr).IP.String(), "Should have dialed from bound address")
+}
+
+func TestShutdown(t *testing.T) {
+	listener, err := Listen("localhost:0", "", "")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	server := &Server{}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	disconnected := make(chan error, 1)
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", listener.Addr().String())
+		},
+		OnDisconnect: func(err error) {
+			disconnected <- err
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+
+	assert.NoError(t, server.Shutdown(), "Shutting down should succeed")
+	assert.NoError(t, <-serveErr, "Serve should return without error after shutdown")
+	var disconnectedErr *DisconnectedError
+	if assert.True(t, errors.As(<-disconnected, &disconnectedErr), "Should have gotten DisconnectedError") {
+		assert.Equal(t, CloseShutdown, disconnectedErr.Reason, "Should have been disconnected due to shutdown")
+	}
+}
+
+func TestMaxConnectionLifetime(t *testing.T) {
+	lifetime := 300 * time.Millisecond
+	serverAddr, stop := startServer(t, &Server{MaxConnectionLifetime: lifetime})
+	defer stop()
+
+	disconnected := make(chan error, 10)
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+		OnDisconnect: func(err error) {
+			disconnected <- err
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+	firstId := client.CurrentId()
+
+	select {
+	case err := <-disconnected:
+		var disconnectedErr *DisconnectedError
+		if assert.True(t, errors.As(err, &disconnectedErr), "Should have gotten DisconnectedError") {
+			assert.Equal(t, CloseExpired, disconnectedErr.Reason, "Connection should have expired")
+		}
+	case <-time.After(2 * lifetime):
+		// Generous bound, so that scheduling delays don't fail the test
+		t.Fatal("Connection should have expired within its lifetime")
+	}
+	assert.NoError(t, client.SendKeepAlive(), "Client should reconnect")
+	assert.NotEqual(t, firstId, client.CurrentId(), "Client should have gotten a fresh id")
+}
+
+func TestSendAndClose(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	receiver := newClient()
+	defer receiver.Close()
+	in := receiver.In(TestTopic)
+
+	for i := 0; i < 10; i++ {
+		sender := newClient()
+		if !assert.NoError(t, sender.SendAndClose(TestTopic, receiver.CurrentId(), []byte(fmt.Sprint(i))), "SendAndClose should succeed") {
+			return
+		}
+		assert.Equal(t, Closed, sender.State(), "Sender should be closed")
+		msg := <-in
+		assert.Equal(t, fmt.Sprint(i), string(msg.Body))
+	}
+
+	// Goodbyes are sent after the message
+	sender := newClient()
+	sender.SetGoodbye(TestTopic, receiver.CurrentId(), []byte(HelloYourself))
+	if !assert.NoError(t, sender.SendAndClose(TestTopic, receiver.CurrentId(), []byte(Hello)), "SendAndClose should succeed") {
+		return
+	}
+	for _, expected := range []string{Hello, HelloYourself} {
+		select {
+		case msg := <-in:
+			assert.Equal(t, expected, string(msg.Body))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %q", expected)
+		}
+	}
+
+	receiveOnly, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+		Mode: ReceiveOnly,
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer receiveOnly.Close()
+	assert.Error(t, receiveOnly.SendAndClose(TestTopic, receiver.CurrentId(), []byte(Hello)), "Receive only client shouldn't send")
+	assert.NotEqual(t, Closed, receiveOnly.State(), "Refusing to send shouldn't close client")
+}
+
+func TestSendWithReceipt(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	sender := newClient()
+	defer sender.Close()
+	receiver := newClient()
+	defer receiver.Close()
+
+	in := receiver.In(TestTopic)
+	received := make(chan *MessageIn, 1)
+	go func() {
+		received <- <-in
+	}()
+	err := sender.SendWithReceipt(TestTopic, receiver.CurrentId(), 5*time.Second, []byte(Hello))
+	assert.NoError(t, err, "Should have gotten receipt")
+	msg := <-received
+	assert.Equal(t, Hello, string(msg.Body), "Receipt request should be transparent to recipient")
+	assert.Equal(t, sender.CurrentId(), msg.From)
+
+	// Nobody's listening on this topic, so no receipt
+	err = sender.SendWithReceipt(TestTopic+1, receiver.CurrentId(), 250*time.Millisecond, []byte(Hello))
+	assert.Error(t, err, "Should not have gotten receipt for undelivered message")
+}
+
+func TestKeepAliveIdle(t *testing.T) {
+	metrics := &Metrics{}
+	serverAddr, stop := startServer(t, &Server{Metrics: metrics})
+	defer stop()
+
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+		KeepAliveIdle: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+
+	time.Sleep(550 * time.Millisecond)
+	idleKeepAlives := metrics.Snapshot().KeepAlives
+	assert.True(t, idleKeepAlives >= 3, "Idle client should have sent keepalives, sent %d", idleKeepAlives)
+
+	// Sending messages resets the timer
+	for i := 0; i < 20; i++ {
+		client.Out(TestTopic) <- Message(randomPeerId(), []byte(Hello))
+		time.Sleep(25 * time.Millisecond)
+	}
+	busyKeepAlives := metrics.Snapshot().KeepAlives - idleKeepAlives
+	assert.True(t, busyKeepAlives <= 1, "Busy client should not have sent keepalives, sent %d", busyKeepAlives)
+}
+
+func TestKeepAliveTarget(t *testing.T) {
+	metrics := &Metrics{}
+	server := &Server{Metrics: metrics}
+	serverAddr, stop := startServer(t, server)
+	defer stop()
+
+	newClient := func(target PeerId) (*Client, error) {
+		return NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+			KeepAliveTarget: target,
+		})
+	}
+	_, err := newClient(randomPeerId())
+	assert.Error(t, err, "Target that could be a peer should be rejected")
+	_, err = newClient(EchoId)
+	assert.Error(t, err, "Target with another meaning should be rejected")
+
+	client, err := newClient(KeepAliveId)
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+	assert.NoError(t, client.SendKeepAlive())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int64(1), metrics.Snapshot().KeepAlives, "Server should have counted keepalive")
+	assert.Equal(t, int64(0), server.Stats().Dropped, "Keepalive shouldn't have been treated as a message")
+}
+
+func TestPause(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+			InBufferSize: 10,
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	sender := newClient()
+	defer sender.Close()
+	receiver := newClient()
+	defer receiver.Close()
+	in := receiver.In(TestTopic)
+
+	// Make sure receiver is reading before pausing
+	sender.Out(TestTopic) <- Message(receiver.CurrentId(), []byte("0"))
+	assert.Equal(t, "0", string((<-in).Body))
+
+	receiver.Pause()
+	receiver.Pause()
+	// The read that's already in flight still delivers one message
+	sender.Out(TestTopic) <- Message(receiver.CurrentId(), []byte("1"))
+	sender.Out(TestTopic) <- Message(receiver.CurrentId(), []byte("2"))
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal(t, 1, receiver.Pending(), "Paused client should only have received in-flight message")
+
+	receiver.Resume()
+	receiver.Resume()
+	assert.Equal(t, "1", string((<-in).Body))
+	assert.Equal(t, "2", string((<-in).Body))
+
+	// Closing a paused client works
+	receiver.Pause()
+	assert.NoError(t, receiver.Close())
+}
+
+func TestPartialWrites(t *testing.T) {
+	listener, err := Listen("localhost:0", "", "")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer listener.Close()
+	go (&Server{}).Serve(&throttledListener{listener})
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", listener.Addr().String())
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	sender := newClient()
+	defer sender.Close()
+	receiver := newClient()
+	defer receiver.Close()
+	in := receiver.In(TestTopic)
+	out := sender.Out(TestTopic)
+
+	for i := 0; i < 5; i++ {
+		out <- Message(receiver.CurrentId(), []byte(fmt.Sprintf("Message %d", i)))
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case msg := <-in:
+			assert.Equal(t, fmt.Sprintf("Message %d", i), string(msg.Body))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for message %d", i)
+		}
+	}
+}
+
+// throttledListener accepts connections that only write a few bytes at a time,
+// like a congested connection might.
+type throttledListener struct {
+	net.Listener
+}
+
+func (l *throttledListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &throttledConn{conn}, nil
+}
+
+type throttledConn struct {
+	net.Conn
+}
+
+// Write writes at most 3 bytes, without reporting an error if it didn't write
+// all of b.
+func (c *throttledConn) Write(b []byte) (int, error) {
+	if len(b) > 3 {
+		b = b[:3]
+	}
+	time.Sleep(time.Millisecond)
+	return c.Conn.Write(b)
+}
+
+func TestCoalesceWindow(t *testing.T) {
+	listener, err := Listen("localhost:0", "", "")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer listener.Close()
+	counting := &countingListener{Listener: listener}
+	go (&Server{CoalesceWindow: 50 * time.Millisecond}).Serve(counting)
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", listener.Addr().String())
+			},
+			FlushInterval: 50 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	sender := newClient()
+	defer sender.Close()
+	receiver := newClient()
+	defer receiver.Close()
+	in := receiver.In(TestTopic)
+	time.Sleep(100 * time.Millisecond)
+
+	out := sender.Out(TestTopic)
+	before := counting.writes()
+	for i := 0; i < 10; i++ {
+		out <- Message(receiver.CurrentId(), []byte(fmt.Sprintf("Message %d", i)))
+	}
+	for i := 0; i < 10; i++ {
+		select {
+		case msg := <-in:
+			assert.Equal(t, fmt.Sprintf("Message %d", i), string(msg.Body))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for message %d", i)
+		}
+	}
+	assert.True(t, counting.writes()-before < 10, "Messages should have been coalesced into fewer writes")
+}
+
+func TestAutoTune(t *testing.T) {
+	server := &Server{AutoTune: true, BufferBytes: 4096}
+	at := server.newAutoTuner()
+	server.tuner = at
+	assert.Equal(t, time.Duration(0), server.coalesceWindow(), "Should start from the configured CoalesceWindow")
+	assert.Equal(t, 0, server.minReadBuffer(), "Should start from the configured MinReadBuffer")
+
+	// Busy connections with few drops coalesce writes
+	at.tune(Stats{Connections: 2, MessagesRelayed: 1000, BytesRelayed: 1000 * 1000}, 10*time.Second)
+	assert.Equal(t, autoCoalesceWindow, server.coalesceWindow())
+	assert.Equal(t, 1024, server.minReadBuffer(), "Read buffers should fit the average message")
+
+	// Nothing happening leaves things alone
+	at.last = Stats{Connections: 2, MessagesRelayed: 1000, BytesRelayed: 1000 * 1000}
+	at.tune(at.last, 10*time.Second)
+	assert.Equal(t, autoCoalesceWindow, server.coalesceWindow())
+
+	// Drops stop coalescing
+	at.tune(Stats{Connections: 2, MessagesRelayed: 2000, BytesRelayed: 2000 * 1000, Dropped: 100}, 10*time.Second)
+	assert.Equal(t, time.Duration(0), server.coalesceWindow(), "Should stop coalescing when recipients fall behind")
+
+	// Quiet connections don't coalesce and large messages are capped at
+	// BufferBytes
+	at.last = Stats{}
+	at.tune(Stats{Connections: 10, MessagesRelayed: 10, BytesRelayed: 10 * 10000}, 10*time.Second)
+	assert.Equal(t, time.Duration(0), server.coalesceWindow())
+	assert.Equal(t, 4096, server.minReadBuffer())
+	assert.NotNil(t, server.newReadBuffer(), "New connections should use the tuned MinReadBuffer")
+}
+
+// countingListener counts the writes to the connections it accepts.
+type countingListener struct {
+	net.Listener
+	count int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{conn, l}, nil
+}
+
+func (l *countingListener) writes() int64 {
+	return atomic.LoadInt64(&l.count)
+}
+
+type countingConn struct {
+	net.Conn
+	l *countingListener
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.l.count, 1)
+	return c.Conn.Write(b)
+}
+
+func TestAdaptiveReadBuffer(t *testing.T) {
+	server := &Server{MinReadBuffer: 256, ReadBufferShrinkAfter: 250 * time.Millisecond}
+	serverAddr, stop := startServer(t, server)
+	defer stop()
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	sender := newClient()
+	defer sender.Close()
+	receiver := newClient()
+	defer receiver.Close()
+	in := receiver.In(TestTopic)
+	out := sender.Out(TestTopic)
+	readBuf := server.getPeer(sender.CurrentId()).readBuf
+
+	receive := func(expected []byte) {
+		select {
+		case msg := <-in:
+			assert.Equal(t, expected, msg.Body)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for message")
+		}
+	}
+	small := []byte("Small message")
+	out <- Message(receiver.CurrentId(), small)
+	receive(small)
+	assert.Equal(t, 256, readBuf.size(), "Buffer should start out small")
+
+	large := largeData()
+	out <- Message(receiver.CurrentId(), large)
+	receive(large)
+	assert.True(t, readBuf.size() >= WaddellHeaderLength+len(large), "Buffer should have grown to fit large message")
+	out <- Message(receiver.CurrentId(), small)
+	receive(small)
+	assert.True(t, readBuf.size() > 256, "Buffer should stay grown for a while")
+
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, 256, readBuf.size(), "Buffer should have shrunk after quiet period")
+	out <- Message(receiver.CurrentId(), small)
+	receive(small)
+	assert.Equal(t, 256, readBuf.size(), "Small messages shouldn't grow buffer")
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+	id := client.CurrentId()
+	in := client.In(TestTopic)
+
+	tooLarge := make([]byte, MaxDataLength+1)
+	err = client.SendFrom(TestTopic, id, bytes.NewReader(tooLarge), len(tooLarge))
+	assert.True(t, errors.Is(err, ErrMessageTooLarge), "Expected ErrMessageTooLarge, got %v", err)
+	assert.Contains(t, err.Error(), fmt.Sprint(MaxDataLength), "Error should state the maximum")
+	err = client.SendWithReceipt(TestTopic, id, time.Second, make([]byte, MaxDataLength))
+	assert.True(t, errors.Is(err, ErrMessageTooLarge), "Receipt overhead should count against the limit, got %v", err)
+	err = client.SendAndClose(TestTopic, id, tooLarge[:1], tooLarge[1:])
+	assert.True(t, errors.Is(err, ErrMessageTooLarge), "Expected ErrMessageTooLarge, got %v", err)
+
+	// Oversized messages on Out topics are discarded without disrupting the
+	// connection
+	out := client.Out(TestTopic)
+	out <- Message(id, tooLarge)
+	out <- Message(id, tooLarge[:MaxDataLength])
+	msg := <-in
+	assert.Equal(t, MaxDataLength, len(msg.Body))
+	assert.Equal(t, id, client.CurrentId(), "Client should not have reconnected")
+}
+
+func TestSendBatch(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	sender := newClient()
+	defer sender.Close()
+	receiverA := newClient()
+	defer receiverA.Close()
+	receiverB := newClient()
+	defer receiverB.Close()
+	inA := receiverA.In(TestTopic)
+	inB := receiverB.In(TestTopic)
+
+	err := sender.SendBatch(TestTopic, []*MessageOut{
+		Message(receiverA.CurrentId(), []byte("1")),
+		Message(receiverB.CurrentId(), []byte("2")),
+		Message(receiverA.CurrentId(), make([]byte, MaxDataLength+1)),
+		Message(receiverA.CurrentId(), []byte("3")),
+	})
+	if assert.Error(t, err, "Batch with oversized message should fail") {
+		batchErr, ok := err.(*BatchError)
+		if assert.True(t, ok, "Should have gotten BatchError, not %v", err) {
+			assert.NoError(t, batchErr.Errs[0])
+			assert.NoError(t, batchErr.Errs[1])
+			assert.Error(t, batchErr.Errs[2], "Oversized message should fail")
+			assert.NoError(t, batchErr.Errs[3])
+		}
+	}
+	assert.Equal(t, "1", string((<-inA).Body))
+	assert.Equal(t, "3", string((<-inA).Body))
+	assert.Equal(t, "2", string((<-inB).Body))
+
+	assert.NoError(t, sender.SendBatch(TestTopic, []*MessageOut{
+		Message(receiverB.CurrentId(), []byte("4")),
+		Message(receiverB.CurrentId(), []byte("5")),
+	}))
+	assert.Equal(t, "4", string((<-inB).Body))
+	assert.Equal(t, "5", string((<-inB).Body))
+}
+
+func TestPoolMessages(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+		PoolMessages: true,
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+	in := client.In(TestTopic)
+	out := client.Out(TestTopic)
+
+	for i := 0; i < 10; i++ {
+		body := fmt.Sprintf("Message %d", i)
+		out <- Message(client.CurrentId(), []byte(body))
+		msg := <-in
+		assert.Equal(t, body, string(msg.Body))
+		assert.Equal(t, client.CurrentId(), msg.From)
+		msg.Release()
+		assert.Nil(t, msg.Body, "Released message should be cleared")
+	}
+
+	// Releasing messages that weren't pooled does nothing
+	msg := &MessageIn{Body: []byte("Hello")}
+	msg.Release()
+	assert.Equal(t, "Hello", string(msg.Body))
+}
+
+func TestOnDrop(t *testing.T) {
+	type drop struct {
+		from   PeerId
+		to     PeerId
+		reason DropReason
+	}
+	drops := make(chan drop, 10)
+	serverAddr, stop := startServer(t, &Server{
+		OnDrop: func(from PeerId, to PeerId, reason DropReason) {
+			drops <- drop{from, to, reason}
+		},
+	})
+	defer stop()
+
+	sender, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer sender.Close()
+
+	nobody := randomPeerId()
+	start := time.Now()
+	err = sender.SendWithReceipt(TestTopic, nobody, 5*time.Second, []byte(Hello))
+	if assert.Error(t, err, "Sending to unconnected peer should fail") {
+		dropped, ok := err.(*DroppedError)
+		if assert.True(t, ok, "Should have gotten DroppedError, not %v", err) {
+			assert.Equal(t, DropRecipientNotConnected, dropped.Reason)
+		}
+	}
+	assert.True(t, time.Now().Sub(start) < 5*time.Second, "Should not have waited for timeout")
+
+	select {
+	case d := <-drops:
+		assert.Equal(t, drop{sender.CurrentId(), nobody, DropRecipientNotConnected}, d)
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnDrop not called")
+	}
+}
+
+func TestInboxFull(t *testing.T) {
+	doTestInboxFull(t, false)
+}
+
+func TestInboxFullBackpressure(t *testing.T) {
+	doTestInboxFull(t, true)
+}
+
+func doTestInboxFull(t *testing.T, backpressure bool) {
+	drops := make(chan DropReason, 1000)
+	metrics := &Metrics{}
+	serverAddr, stop := startServer(t, &Server{
+		Metrics:             metrics,
+		InboxCapacity:       1,
+		Backpressure:        backpressure,
+		BackpressureTimeout: 250 * time.Millisecond,
+		OnDrop: func(from PeerId, to PeerId, reason DropReason) {
+			drops <- reason
+		},
+	})
+	defer stop()
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+
+	// The stalled recipient never reads after getting its id
+	stalled, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Unable to dial stalled recipient: %s", err)
+	}
+	defer stalled.Close()
+	idFrame, err := framed.NewReader(stalled).ReadFrame()
+	if err != nil {
+		t.Fatalf("Unable to read stalled recipient's id: %s", err)
+	}
+	stalledId, err := readPeerId(idFrame)
+	if err != nil {
+		t.Fatalf("Unable to parse stalled recipient's id: %s", err)
+	}
+
+	flooder := newClient()
+	defer flooder.Close()
+	sender := newClient()
+	defer sender.Close()
+	// Stop sending before closing the clients
+	stopSending := make(chan bool)
+	var wg sync.WaitGroup
+	defer func() {
+		close(stopSending)
+		wg.Wait()
+	}()
+	send := func(client *Client, body []byte) {
+		defer wg.Done()
+		out := client.Out(TestTopic)
+		for {
+			select {
+			case <-stopSending:
+				return
+			case out <- Message(stalledId, body):
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+	wg.Add(2)
+	go send(flooder, largeData())
+	go send(sender, []byte(Hello))
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case reason := <-drops:
+			if reason == DropInboxFull {
+				assert.True(t, metrics.Snapshot().Dropped > 0, "Drop should have been counted")
+				return
+			}
+		case <-timeout:
+			t.Fatal("Messages to stalled recipient should have been dropped because of full inbox")
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	var pairs sync.Map
+	serverAddr, stop := startServer(t, &Server{
+		Authorize: func(from PeerId, to PeerId) bool {
+			paired, ok := pairs.Load(from)
+			return ok && paired.(PeerId) == to
+		},
+	})
+	defer stop()
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	a := newClient()
+	defer a.Close()
+	b := newClient()
+	defer b.Close()
+	stranger := newClient()
+	defer stranger.Close()
+	pairs.Store(a.CurrentId(), b.CurrentId())
+	pairs.Store(b.CurrentId(), a.CurrentId())
+
+	in := b.In(TestTopic)
+	err := stranger.SendWithReceipt(TestTopic, b.CurrentId(), 5*time.Second, []byte(Hello))
+	if assert.Error(t, err, "Unpaired peer should not be able to send") {
+		dropped, ok := err.(*DroppedError)
+		if assert.True(t, ok, "Should have gotten DroppedError, not %v", err) {
+			assert.Equal(t, DropUnauthorized, dropped.Reason)
+		}
+	}
+	a.Out(TestTopic) <- Message(b.CurrentId(), []byte(HelloYourself))
+	msg := <-in
+	assert.Equal(t, HelloYourself, string(msg.Body), "Paired peer should be able to send")
+	assert.Equal(t, a.CurrentId(), msg.From, "Only message should be from paired peer")
+}
+
+func TestRecentEvents(t *testing.T) {
+	var reject int32
+	server := &Server{
+		AuditEvents: 3,
+		OnConnect: func(id PeerId, remoteAddr net.Addr) error {
+			if atomic.LoadInt32(&reject) == 1 {
+				return fmt.Errorf("Go away")
+			}
+			return nil
+		},
+	}
+	serverAddr, stop := startServer(t, server)
+	defer stop()
+	assert.Empty(t, server.RecentEvents(10))
+
+	newClient := func() (*Client, error) {
+		return NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+		})
+	}
+	client, err := newClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	id := client.CurrentId()
+	client.Close()
+	time.Sleep(250 * time.Millisecond)
+
+	atomic.StoreInt32(&reject, 1)
+	_, err = newClient()
+	assert.Error(t, err, "Connection should have been rejected")
+	time.Sleep(250 * time.Millisecond)
+
+	events := server.RecentEvents(10)
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, AuditConnect, events[0].Type)
+		assert.Equal(t, id, events[0].Id)
+		assert.Equal(t, AuditDisconnect, events[1].Type)
+		assert.Equal(t, id, events[1].Id)
+		assert.Equal(t, CloseNetwork, events[1].Reason)
+		assert.Equal(t, AuditReject, events[2].Type)
+		if assert.NotNil(t, events[2].Rejection) {
+			assert.Equal(t, RejectDenied, events[2].Rejection.Reason)
+		}
+	}
+
+	// Only the most recent events are kept
+	atomic.StoreInt32(&reject, 0)
+	client, err = newClient()
+	if assert.NoError(t, err) {
+		defer client.Close()
+	}
+	time.Sleep(250 * time.Millisecond)
+	events = server.RecentEvents(10)
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, AuditDisconnect, events[0].Type)
+		assert.Equal(t, AuditConnect, events[2].Type)
+		assert.Equal(t, client.CurrentId(), events[2].Id)
+	}
+	events = server.RecentEvents(1)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, AuditConnect, events[0].Type)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	server := &Server{MaxConnections: 1}
+	check := func(expectedStatus int, expectedBody string) {
+		rec := httptest.NewRecorder()
+		server.HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		assert.Equal(t, expectedStatus, rec.Code)
+		assert.True(t, strings.HasPrefix(rec.Body.String(), expectedBody), rec.Body.String())
+	}
+	check(http.StatusServiceUnavailable, "not serving")
+
+	serverAddr, stop := startServer(t, server)
+	defer stop()
+	time.Sleep(50 * time.Millisecond)
+	check(http.StatusOK, "ok")
+
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	check(http.StatusServiceUnavailable, "overloaded")
+	client.Close()
+	time.Sleep(100 * time.Millisecond)
+	check(http.StatusOK, "ok")
+
+	server.Migrate("localhost:0", "Testing")
+	check(http.StatusServiceUnavailable, "draining")
+}
+
+func TestProfileRelay(t *testing.T) {
+	server := &Server{ProfileRelay: true}
+	serverAddr, stop := startServer(t, server)
+	defer stop()
+
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+	in := client.In(TestTopic)
+	out := client.Out(TestTopic)
+	for i := 0; i < 10; i++ {
+		out <- Message(client.CurrentId(), []byte(Hello))
+		<-in
+	}
+
+	profile := server.RelayProfile()
+	if !assert.NotNil(t, profile, "Should have profiled relaying") {
+		return
+	}
+	for name, stage := range map[string]StageTimings{
+		"read":    profile.Read,
+		"parse":   profile.Parse,
+		"lookup":  profile.Lookup,
+		"enqueue": profile.Enqueue,
+		"write":   profile.Write,
+	} {
+		assert.Equal(t, 10, stage.Samples, "Wrong number of samples for %s", name)
+		assert.True(t, stage.P50 <= stage.P90 && stage.P90 <= stage.P99 && stage.P99 <= stage.Max, "Percentiles of %s out of order: %+v", name, stage)
+	}
+	assert.True(t, profile.Write.Max > 0, "Writing should take some time")
+
+	assert.Nil(t, (&Server{}).RelayProfile(), "Shouldn't profile unless enabled")
+}
+
+func TestStats(t *testing.T) {
+	server := &Server{MaxConnections: 4}
+	serverAddr, stop := startServer(t, server)
+	defer stop()
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	sender := newClient()
+	defer sender.Close()
+	receiver := newClient()
+	defer receiver.Close()
+
+	in := receiver.In(TestTopic)
+	sender.Out(TestTopic) <- Message(receiver.CurrentId(), []byte(Hello))
+	<-in
+	err := sender.SendWithReceipt(TestTopic, randomPeerId(), 5*time.Second, []byte(Hello))
+	assert.Error(t, err, "Sending to unconnected peer should fail")
+
+	stats := server.Stats()
+	assert.Equal(t, 2, stats.Connections)
+	assert.Equal(t, int64(1), stats.MessagesRelayed)
+	assert.Equal(t, int64(len(Hello)), stats.BytesRelayed)
+	assert.Equal(t, int64(1), stats.Dropped)
+	assert.Equal(t, int64(0), stats.BufferedBytes)
+	assert.True(t, stats.Uptime > 0, "Uptime should be positive")
+	assert.Equal(t, float64(50), stats.Utilization.Connections)
+	assert.Equal(t, float64(0), stats.Utilization.BufferedBytes, "Unlimited buffers should have no utilization")
+
+	limited := &Server{MaxConnections: 4, MaxBufferedBytes: 1000, AcceptRate: 10}
+	u := limited.utilization(Stats{Connections: 1, BufferedBytes: 900, AcceptRate: 2})
+	assert.Equal(t, float64(25), u.Connections)
+	assert.Equal(t, float64(50), limited.utilization(Stats{Connections: 1, Handshaking: 1}).Connections, "Handshaking peers count towards MaxConnections")
+	assert.Equal(t, float64(90), u.BufferedBytes)
+	assert.Equal(t, float64(20), u.AcceptRate)
+	assert.Equal(t, float64(90), u.Max())
+}
+
+func TestCachingDialer(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+	_, port, _ := net.SplitHostPort(serverAddr)
+
+	// The first lookup resolves to an address that nobody listens on
+	var lookups int32
+	oldLookupHost := lookupHost
+	lookupHost = func(host string) ([]string, error) {
+		if atomic.AddInt32(&lookups, 1) == 1 {
+			return []string{"127.0.0.2"}, nil
+		}
+		return []string{"127.0.0.1"}, nil
+	}
+	defer func() {
+		lookupHost = oldLookupHost
+	}()
+
+	_, err := CachingDialer("waddell.test", time.Minute)
+	assert.Error(t, err, "Address without port should be rejected")
+
+	dial, err := CachingDialer(net.JoinHostPort("waddell.test", port), 250*time.Millisecond)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = dial()
+	assert.Error(t, err, "Freshly resolved address that can't be reached should fail")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&lookups))
+
+	// The stale cached address forces a new lookup, which is then cached
+	for i := 0; i < 3; i++ {
+		conn, err := dial()
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&lookups))
+
+	// Expiry forces a new lookup too
+	time.Sleep(300 * time.Millisecond)
+	conn, err := dial()
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&lookups))
+}
+
+func TestSRVDialer(t *testing.T) {
+	listen := func() (net.Listener, uint16) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Unable to listen: %s", err)
+		}
+		return l, uint16(l.Addr().(*net.TCPAddr).Port)
+	}
+	first, firstPort := listen()
+	defer first.Close()
+	second, secondPort := listen()
+	defer second.Close()
+
+	var lookups int32
+	var failLookups int32
+	oldLookupSRV := lookupSRV
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		atomic.AddInt32(&lookups, 1)
+		if atomic.LoadInt32(&failLookups) == 1 {
+			return "", nil, fmt.Errorf("Lookup failed")
+		}
+		if name == "empty.test" {
+			return "", nil, nil
+		}
+		return "", []*net.SRV{{Target: "127.0.0.1.", Port: firstPort}, {Target: "127.0.0.1.", Port: secondPort}}, nil
+	}
+	defer func() {
+		lookupSRV = oldLookupSRV
+	}()
+
+	_, err := SRVDialer("waddell", "tcp", "empty.test")
+	assert.Error(t, err, "Name without SRV targets should be rejected")
+	atomic.StoreInt32(&lookups, 0)
+
+	dial, err := SRVDialer("waddell", "tcp", "waddell.test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	accepted := func(l net.Listener) bool {
+		l.(*net.TCPListener).SetDeadline(time.Now().Add(250 * time.Millisecond))
+		conn, err := l.Accept()
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+
+	// Targets are tried in order
+	conn, err := dial()
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.True(t, accepted(first), "Should have connected to first target")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&lookups), "Record should be looked up again on dial")
+
+	// Unreachable targets fail over to the next one, also when falling back
+	// to the original targets because the lookup failed
+	first.Close()
+	atomic.StoreInt32(&failLookups, 1)
+	conn, err = dial()
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.True(t, accepted(second), "Should have failed over to second target")
+
+	second.Close()
+	_, err = dial()
+	assert.Error(t, err, "Dialing should fail once no target is reachable")
+}
+
+func TestAliases(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	newClient := func(alias string) (*Client, error) {
+		return NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+			Alias: alias,
+		})
+	}
+	alice, err := newClient("alice")
+	if err != nil {
+		t.Fatalf("Unable to connect alice: %s", err)
+	}
+	in := alice.In(TestTopic)
+	_, err = newClient("alice")
+	assert.True(t, errors.Is(err, ErrAliasTaken), "Duplicate alias should be rejected, got %v", err)
+	_, err = newClient(strings.Repeat("a", MaxAliasLength+1))
+	assert.Error(t, err, "Overly long alias should be rejected")
+
+	bob, err := newClient("")
+	if err != nil {
+		t.Fatalf("Unable to connect bob: %s", err)
+	}
+	defer bob.Close()
+	assert.NoError(t, bob.SendToAlias(TestTopic, "nobody", []byte("Lost")))
+	assert.NoError(t, bob.SendToAlias(TestTopic, "alice", []byte("Hello "), []byte("alice")))
+	msg := <-in
+	assert.Equal(t, bob.CurrentId(), msg.From)
+	assert.Equal(t, "Hello alice", string(msg.Body))
+
+	// Aliases are released on disconnect
+	alice.Close()
+	time.Sleep(250 * time.Millisecond)
+	alice, err = newClient("alice")
+	if assert.NoError(t, err, "Alias should have been released") {
+		alice.Close()
+	}
+}
+
+func TestCredits(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	newClient := func(flowControl bool) *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+			FlowControl:   flowControl,
+			CreditTimeout: 1 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	sender := newClient(true)
+	defer sender.Close()
+	receiver := newClient(false)
+	defer receiver.Close()
+	bystander := newClient(false)
+	defer bystander.Close()
+	in := receiver.In(TestTopic)
+	bystanderIn := bystander.In(TestTopic)
+	out := sender.Out(TestTopic)
+
+	assert.Error(t, receiver.GrantCredits(sender.CurrentId(), 0), "Granting no credits should fail")
+	assert.NoError(t, receiver.GrantCredits(sender.CurrentId(), 2))
+	time.Sleep(250 * time.Millisecond)
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			out <- Message(receiver.CurrentId(), []byte(fmt.Sprintf("Message %d", i)))
+		}
+		// Messages to other peers don't wait behind the receiver's credits
+		out <- Message(bystander.CurrentId(), []byte(Hello))
+	}()
+	receive := func(in <-chan *MessageIn, expected string) {
+		select {
+		case msg := <-in:
+			assert.Equal(t, expected, string(msg.Body))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %q", expected)
+		}
+	}
+	receive(in, "Message 0")
+	receive(in, "Message 1")
+	receive(bystanderIn, Hello)
+	select {
+	case msg := <-in:
+		t.Fatalf("Sender should have run out of credits, but got %q", msg.Body)
+	case <-time.After(250 * time.Millisecond):
+		// expected
+	}
+	assert.NoError(t, receiver.GrantCredits(sender.CurrentId(), 1))
+	receive(in, "Message 2")
+
+	// Peers that don't grant more credits are eventually forgotten
+	start := time.Now()
+	err := sender.SendBatch(TestTopic, []*MessageOut{
+		Message(receiver.CurrentId(), []byte("Blocked")),
+		Message(bystander.CurrentId(), []byte(HelloYourself)),
+	})
+	var batchErr *BatchError
+	if assert.True(t, errors.As(err, &batchErr), "Should have gotten BatchError, not: %v", err) {
+		assert.Error(t, batchErr.Errs[0], "Waiting for credits should time out")
+		assert.NoError(t, batchErr.Errs[1], "Rest of batch should have been sent")
+	}
+	assert.True(t, time.Since(start) >= time.Second, "Should have waited for CreditTimeout")
+	receive(bystanderIn, HelloYourself)
+	assert.NoError(t, sender.SendFrom(TestTopic, receiver.CurrentId(), bytes.NewReader([]byte("Free")), 4))
+	receive(in, "Free")
+
+	// Credits are only honored with FlowControl
+	assert.NoError(t, sender.GrantCredits(bystander.CurrentId(), 1))
+	time.Sleep(250 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, bystander.SendFrom(TestTopic, sender.CurrentId(), bytes.NewReader([]byte(Hello)), len(Hello)), "Sender without FlowControl shouldn't wait for credits")
+	}
+
+	// Reconnecting forgets balances, which were granted to the previous id
+	assert.NoError(t, receiver.GrantCredits(sender.CurrentId(), 1))
+	time.Sleep(250 * time.Millisecond)
+	assert.NoError(t, sender.SendFrom(TestTopic, receiver.CurrentId(), bytes.NewReader([]byte(Hello)), len(Hello)))
+	receive(in, Hello)
+	assert.NoError(t, sender.Reconnect())
+	assert.NoError(t, sender.SendFrom(TestTopic, receiver.CurrentId(), bytes.NewReader([]byte(HelloYourself)), len(HelloYourself)), "Reconnecting should have forgotten balance")
+	receive(in, HelloYourself)
+
+	// Sends that are waiting for credits end when the client is closed
+	assert.NoError(t, receiver.GrantCredits(sender.CurrentId(), 1))
+	time.Sleep(250 * time.Millisecond)
+	assert.NoError(t, sender.SendFrom(TestTopic, receiver.CurrentId(), bytes.NewReader([]byte(Hello)), len(Hello)))
+	receive(in, Hello)
+	errCh := make(chan error)
+	go func() {
+		errCh <- sender.SendFrom(TestTopic, receiver.CurrentId(), bytes.NewReader([]byte("Blocked")), 7)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	sender.Close()
+	select {
+	case err := <-errCh:
+		assert.Equal(t, closedError, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send waiting for credits didn't end on close")
+	}
+}
+
+func TestIntercept(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	newClient := func(intercept func(to PeerId, body []byte) ([]byte, bool)) *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+			Intercept: intercept,
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	receiver := newClient(nil)
+	defer receiver.Close()
+	var intercepted []PeerId
+	var interceptedMutex sync.Mutex
+	sender := newClient(func(to PeerId, body []byte) ([]byte, bool) {
+		interceptedMutex.Lock()
+		intercepted = append(intercepted, to)
+		interceptedMutex.Unlock()
+		if string(body) == "Drop me" {
+			return nil, false
+		}
+		return append([]byte("Intercepted "), body...), true
+	})
+	defer sender.Close()
+	in := receiver.In(TestTopic)
+	to := receiver.CurrentId()
+
+	sender.Out(TestTopic) <- Message(to, []byte("Drop me"))
+	sender.Out(TestTopic) <- Message(to, []byte("Out "), []byte("message"))
+	assert.NoError(t, sender.SendFrom(TestTopic, to, strings.NewReader("SendFrom message"), 16))
+	assert.NoError(t, sender.SendBatch(TestTopic, []*MessageOut{Message(to, []byte("Drop me")), Message(to, []byte("Batch message"))}))
+	assert.Error(t, sender.SendWithReceipt(TestTopic, to, time.Second, []byte("Drop me")), "Dropped message should get no receipt")
+
+	// Out isn't ordered with respect to the other ways of sending
+	received := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-in:
+			received[string(msg.Body)] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for message %d", i)
+		}
+	}
+	assert.Equal(t, map[string]bool{"Intercepted Out message": true, "Intercepted SendFrom message": true, "Intercepted Batch message": true}, received)
+	select {
+	case msg := <-in:
+		t.Fatalf("Dropped message shouldn't have been delivered, got %q", msg.Body)
+	case <-time.After(250 * time.Millisecond):
+		// expected
+	}
+	interceptedMutex.Lock()
+	defer interceptedMutex.Unlock()
+	assert.Equal(t, 6, len(intercepted))
+	for _, id := range intercepted {
+		assert.Equal(t, to, id)
+	}
+}
+
+func TestIntroduce(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	newClient := func() (*Client, chan PeerId) {
+		introductions := make(chan PeerId, 10)
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+			OnIntroduction: func(peer PeerId) {
+				introductions <- peer
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client, introductions
+	}
+	introducer, introducerIntroductions := newClient()
+	defer introducer.Close()
+	peer, peerIntroductions := newClient()
+	defer peer.Close()
+
+	assert.NoError(t, introducer.Introduce(peer.CurrentId()))
+	expect := func(introductions chan PeerId, id PeerId) {
+		select {
+		case introduced := <-introductions:
+			assert.Equal(t, id, introduced)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for introduction")
+		}
+	}
+	expect(peerIntroductions, introducer.CurrentId())
+	expect(introducerIntroductions, peer.CurrentId())
+
+	select {
+	case introduced := <-introducerIntroductions:
+		t.Fatalf("Answer to introduction shouldn't have been answered, got introduction from %s", introduced)
+	case introduced := <-peerIntroductions:
+		t.Fatalf("Peer should have been introduced only once, got introduction from %s", introduced)
+	case <-time.After(250 * time.Millisecond):
+		// expected
+	}
+}
+
+func TestReservedTopics(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+	to := client.CurrentId()
+
+	for _, topic := range []TopicId{introTopic, creditTopic, receiptRequestTopic, receiptTopic} {
+		assert.Panics(t, func() { client.Out(topic) }, "Out should refuse reserved topic %d", topic)
+		assert.Panics(t, func() { client.In(topic) }, "In should refuse reserved topic %d", topic)
+		assert.Panics(t, func() { client.Dup().In(topic) }, "Handle.In should refuse reserved topic %d", topic)
+		assert.Error(t, client.SendFrom(topic, to, strings.NewReader(Hello), len(Hello)), "SendFrom should refuse reserved topic %d", topic)
+		assert.Error(t, client.SendBatch(topic, []*MessageOut{Message(to, []byte(Hello))}), "SendBatch should refuse reserved topic %d", topic)
+		assert.Error(t, client.SendWithReceipt(topic, to, time.Second, []byte(Hello)), "SendWithReceipt should refuse reserved topic %d", topic)
+		assert.Error(t, client.SendToAlias(topic, "alias", []byte(Hello)), "SendToAlias should refuse reserved topic %d", topic)
+		assert.Error(t, client.SendAndClose(topic, to, []byte(Hello)), "SendAndClose should refuse reserved topic %d", topic)
+	}
+	assert.False(t, client.isClosed(), "Refusing reserved topics shouldn't close client")
+	assert.NotPanics(t, func() { client.Out(firstReservedTopic - 1) }, "Topics below the reserved range should be usable")
+}
+
+func TestGoodbye(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	receiver := newClient()
+	defer receiver.Close()
+	in := receiver.In(TestTopic)
+
+	leaver := newClient()
+	leaver.SetGoodbye(TestTopic, receiver.CurrentId(), []byte("Bye"))
+	assert.NoError(t, leaver.Close())
+	select {
+	case msg := <-in:
+		assert.Equal(t, leaver.CurrentId(), msg.From)
+		assert.Equal(t, "Bye", string(msg.Body))
+	case <-time.After(5 * time.Second):
+		t.Fatal("Didn't receive goodbye")
+	}
+
+	leaver = newClient()
+	leaver.SetGoodbye(TestTopic, receiver.CurrentId(), []byte("Bye"))
+	leaver.ClearGoodbye()
+	assert.NoError(t, leaver.Close())
+	select {
+	case msg := <-in:
+		t.Fatalf("Unexpected goodbye %q", msg.Body)
+	case <-time.After(250 * time.Millisecond):
+		// expected
+	}
+}
+
+func TestDup(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	sender := newClient()
+	defer sender.Close()
+	receiver := newClient()
+	defer receiver.Close()
+	in := receiver.In(TestTopic)
+
+	signaling := receiver.Dup()
+	signaling.SetFilter(func(msg *MessageIn) bool {
+		return strings.HasPrefix(string(msg.Body), "sdp")
+	})
+	signalingIn := signaling.In(TestTopic)
+	other := receiver.Dup()
+	otherIn := other.In(TestTopic)
+	assert.Equal(t, receiver.CurrentId(), other.CurrentId())
+
+	out := sender.Out(TestTopic)
+	expect := func(ch <-chan *MessageIn, expected string) {
+		select {
+		case msg, ok := <-ch:
+			if assert.True(t, ok, "Channel shouldn't be closed") {
+				assert.Equal(t, expected, string(msg.Body))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %q", expected)
+		}
+	}
+	out <- Message(receiver.CurrentId(), []byte("sdp offer"))
+	expect(signalingIn, "sdp offer")
+	out <- Message(receiver.CurrentId(), []byte("candidate"))
+	expect(otherIn, "candidate")
+
+	// Handles share sends
+	signaling.Out(TestTopic) <- Message(receiver.CurrentId(), []byte("sdp answer"))
+	expect(signalingIn, "sdp answer")
+
+	assert.NoError(t, other.Close())
+	_, ok := <-otherIn
+	assert.False(t, ok, "Closing handle should close its in topics")
+	out <- Message(receiver.CurrentId(), []byte("candidate"))
+	expect(in, "candidate")
+
+	assert.NoError(t, receiver.Close())
+	_, ok = <-signalingIn
+	assert.False(t, ok, "Closing client should close its handles")
+}
+
+func TestFilter(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	sender := newClient()
+	defer sender.Close()
+	receiver := newClient()
+	defer receiver.Close()
+	in := receiver.In(TestTopic)
+	out := sender.Out(TestTopic)
+
+	receiver.SetFilter(func(msg *MessageIn) bool {
+		return msg.From == sender.CurrentId() && string(msg.Body) != "Unwanted"
+	})
+	out <- Message(receiver.CurrentId(), []byte("Unwanted"))
+	out <- Message(receiver.CurrentId(), []byte("Wanted"))
+	assert.Equal(t, "Wanted", string((<-in).Body))
+	assert.Equal(t, int64(1), receiver.Filtered())
+
+	// Removing the filter delivers everything again
+	receiver.SetFilter(nil)
+	out <- Message(receiver.CurrentId(), []byte("Unwanted"))
+	assert.Equal(t, "Unwanted", string((<-in).Body))
+	assert.Equal(t, int64(1), receiver.Filtered())
+}
+
+func TestSelector(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	sender := newClient()
+	defer sender.Close()
+	clientA := newClient()
+	defer clientA.Close()
+	clientB := newClient()
+	defer clientB.Close()
+
+	selector := NewSelector(TestTopic)
+	_, _, err := selector.Select()
+	assert.Equal(t, ErrNoClients, err)
+
+	selector.Add(clientA)
+	selector.Add(clientB)
+	out := sender.Out(TestTopic)
+	out <- Message(clientA.CurrentId(), []byte("A"))
+	out <- Message(clientB.CurrentId(), []byte("B"))
+	received := make(map[*Client]string)
+	for i := 0; i < 2; i++ {
+		msg, client, err := selector.Select()
+		if assert.NoError(t, err) {
+			received[client] = string(msg.Body)
+		}
+	}
+	assert.Equal(t, map[*Client]string{clientA: "A", clientB: "B"}, received)
+
+	// Clients added while selecting are picked up
+	clientC := newClient()
+	defer clientC.Close()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		selector.Add(clientC)
+		out <- Message(clientC.CurrentId(), []byte("C"))
+	}()
+	msg, client, err := selector.Select()
+	if assert.NoError(t, err) {
+		assert.Equal(t, clientC, client)
+		assert.Equal(t, "C", string(msg.Body))
+	}
+
+	selector.Remove(clientC)
+	clientA.Close()
+	_, client, err = selector.Select()
+	assert.Error(t, err, "Selecting from closed client should fail")
+	assert.Equal(t, clientA, client)
+
+	selector.Remove(clientB)
+	_, _, err = selector.Select()
+	assert.Equal(t, ErrNoClients, err)
+}
+
+func TestCloseWhileReceiving(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	sender := newClient()
+	defer sender.Close()
+	out := sender.Out(TestTopic)
+	time.Sleep(100 * time.Millisecond)
+	goroutines := runtime.NumGoroutine()
+
+	for i := 0; i < 20; i++ {
+		client := newClient()
+		session := NewSession(client, sender.CurrentId(), TestTopic)
+		other := client.In(TestTopic + 1)
+		// Keep the client busy delivering messages that nobody receives
+		for j := 0; j < 5; j++ {
+			out <- Message(client.CurrentId(), []byte("Flood"))
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for {
+				_, err := session.Receive()
+				if err != nil {
+					assert.Equal(t, ErrClientClosed, err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range other {
+			}
+		}()
+		time.Sleep(time.Duration(rand.Intn(10)) * time.Millisecond)
+		assert.NoError(t, client.Close())
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Receives didn't end on close")
+		}
+	}
+
+	// Client goroutines (and the server's goroutines for them) should all exit
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.True(t, runtime.NumGoroutine() <= goroutines, "Leaked %d goroutines", runtime.NumGoroutine()-goroutines)
+}
+
+func TestSession(t *testing.T) {
+	doTestSession(t, false)
+}
+
+func TestSessionPooled(t *testing.T) {
+	doTestSession(t, true)
+}
+
+func doTestSession(t *testing.T, pool bool) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+			PoolMessages: pool,
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	offerer := newClient()
+	defer offerer.Close()
+	answerer := newClient()
+	defer answerer.Close()
+	stranger := newClient()
+	defer stranger.Close()
+
+	topic := TopicId(5)
+	answererId := answerer.CurrentId()
+	offererId := offerer.CurrentId()
+	offer := NewSession(offerer, answererId, topic)
+	answer := NewSession(answerer, PeerId{}, topic)
+	assert.Error(t, answer.Send([]byte("Too soon")), "Sending before remote is known should fail")
+
+	if !assert.NoError(t, offer.Send([]byte(Hello)), "Offerer should be able to send") {
+		return
+	}
+	body, err := answer.Receive()
+	if assert.NoError(t, err, "Answerer should receive") {
+		assert.Equal(t, Hello, string(body))
+	}
+	assert.Equal(t, offererId, answer.Remote(), "Answerer should have bound to offerer")
+
+	// Traffic from other peers on the same topic is ignored
+	stranger.Out(topic) <- Message(offererId, []byte("Intruder"))
+	time.Sleep(100 * time.Millisecond)
+	if !assert.NoError(t, answer.Send([]byte(HelloYourself)), "Answerer should be able to reply") {
+		return
+	}
+	body, err = offer.Receive()
+	if assert.NoError(t, err, "Offerer should receive") {
+		assert.Equal(t, HelloYourself, string(body))
+	}
+
+	// Received bodies stay valid after later receives, even when pooling
+	if !assert.NoError(t, answer.Send([]byte("Another"))) {
+		return
+	}
+	_, err = offer.Receive()
+	if assert.NoError(t, err, "Offerer should receive again") {
+		assert.Equal(t, HelloYourself, string(body), "Earlier body should be unchanged")
+	}
+
+	offerer.Close()
+	_, err = offer.Receive()
+	assert.Error(t, err, "Receive on closed client should fail")
+	assert.Equal(t, ErrClientClosed, offer.Send([]byte(Hello)), "Send on closed client should fail")
+}
+
+func TestSecuredPeer(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	var sent [][]byte
+	var sentMutex sync.Mutex
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+			Intercept: func(to PeerId, body []byte) ([]byte, bool) {
+				sentMutex.Lock()
+				sent = append(sent, body)
+				sentMutex.Unlock()
+				return body, true
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	newKey := func() *ecdh.PrivateKey {
+		key, err := NewSecureKey()
+		if err != nil {
+			t.Fatalf("Unable to generate key: %s", err)
+		}
+		return key
+	}
+	offerer := newClient()
+	defer offerer.Close()
+	answerer := newClient()
+	defer answerer.Close()
+	offererKey := newKey()
+	answererKey := newKey()
+
+	topic := TopicId(5)
+	offerSession := NewSession(offerer, answerer.CurrentId(), topic)
+	offer, err := NewSecuredPeer(offerSession, offererKey, answererKey.PublicKey())
+	if err != nil {
+		t.Fatalf("Unable to secure offer: %s", err)
+	}
+	answer, err := NewSecuredPeer(NewSession(answerer, PeerId{}, topic), answererKey, offererKey.PublicKey())
+	if err != nil {
+		t.Fatalf("Unable to secure answer: %s", err)
+	}
+
+	// Messages that aren't encrypted with the right keys are ignored
+	assert.NoError(t, offerSession.Send([]byte("Not encrypted")))
+	wrongKey, err := NewSecuredPeer(offerSession, newKey(), answererKey.PublicKey())
+	if err != nil {
+		t.Fatalf("Unable to secure with wrong key: %s", err)
+	}
+	assert.NoError(t, wrongKey.Send([]byte("Wrong key")))
+	assert.NoError(t, offer.Send([]byte(Hello)))
+	body, err := answer.Receive()
+	if assert.NoError(t, err, "Answerer should receive") {
+		assert.Equal(t, Hello, string(body))
+	}
+
+	assert.NoError(t, answer.Send([]byte(HelloYourself)))
+	body, err = offer.Receive()
+	if assert.NoError(t, err, "Offerer should receive") {
+		assert.Equal(t, HelloYourself, string(body))
+	}
+
+	sentMutex.Lock()
+	for _, b := range sent[2:] {
+		assert.False(t, bytes.Contains(b, []byte("Hello")), "Server should only have seen ciphertext")
+	}
+	sentMutex.Unlock()
+	assert.Error(t, offer.Send(make([]byte, MaxDataLength)), "Encrypted message exceeding maximum size should fail")
+}
+
+func TestFrameReadTimeout(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{FrameReadTimeout: 250 * time.Millisecond})
+	defer stop()
+
+	conn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Unable to dial server: %s", err)
+	}
+	defer conn.Close()
+	reader := framed.NewReader(conn)
+	_, err = reader.ReadFrame()
+	if !assert.NoError(t, err, "Should have received id frame") {
+		return
+	}
+
+	// Send a length prefix and part of the frame, then stall
+	_, err = conn.Write([]byte{100, 0, 1})
+	if !assert.NoError(t, err, "Should be able to write partial frame") {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "Server should have disconnected stalled sender")
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	pkfile, certfile, _ := writeTestCert(t)
+	listener, err := Listen("localhost:0", pkfile, certfile)
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer listener.Close()
+	go (&Server{HandshakeTimeout: 250 * time.Millisecond}).Serve(listener)
+
+	// Connect over TCP, but never start the TLS handshake
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to dial server: %s", err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "Server should have disconnected stalled handshake")
+	assert.True(t, time.Since(start) < 2*time.Second, "Server should have disconnected within HandshakeTimeout")
+}
+
+func TestDisconnect(t *testing.T) {
+	server := &Server{}
+	serverAddr, stop := startServer(t, server)
+	defer stop()
+
+	disconnected := make(chan error, 1)
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", serverAddr)
+		},
+		OnDisconnect: func(err error) {
+			disconnected <- err
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+
+	id := client.CurrentId()
+	peers := server.Peers()
+	if assert.Len(t, peers, 1, "Should have one connected peer") {
+		assert.Equal(t, id, peers[0].Id)
+		assert.False(t, peers[0].ConnectedAt.IsZero(), "Should know when peer connected")
+	}
+
+	assert.NoError(t, server.Disconnect(id), "Disconnecting connected peer should succeed")
+	assert.Error(t, server.Disconnect(id), "Disconnecting unknown peer should fail")
+	assert.Empty(t, server.Peers(), "Disconnected peer should no longer be listed")
+	var disconnectedErr *DisconnectedError
+	if assert.True(t, errors.As(<-disconnected, &disconnectedErr), "Should have gotten DisconnectedError") {
+		assert.Equal(t, CloseKicked, disconnectedErr.Reason, "Should have been kicked")
+	}
+}
+
+func TestMode(t *testing.T) {
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+
+	newClient := func(mode Mode) *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", serverAddr)
+			},
+			Mode: mode,
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	publisher := newClient(SendOnly)
+	defer publisher.Close()
+	subscriber := newClient(ReceiveOnly)
+	defer subscriber.Close()
+
+	panics := func(f func()) (didPanic bool) {
+		defer func() {
+			didPanic = recover() != nil
+		}()
+		f()
+		return
+	}
+	assert.True(t, panics(func() { publisher.In(TestTopic) }), "Send only client should not be able to receive")
+	assert.True(t, panics(func() { subscriber.Out(TestTopic) }), "Receive only client should not be able to send")
+	assert.Error(t, subscriber.SendFrom(TestTopic, publisher.CurrentId(), strings.NewReader(Hello), len(Hello)))
+
+	pub := NewSession(publisher, subscriber.CurrentId(), TestTopic)
+	sub := NewSession(subscriber, publisher.CurrentId(), TestTopic)
+	_, err := pub.Receive()
+	assert.Error(t, err, "Send only session should not be able to receive")
+	assert.Error(t, sub.Send([]byte(Hello)), "Receive only session should not be able to send")
+
+	assert.NoError(t, pub.Send([]byte(Hello)))
+	body, err := sub.Receive()
+	if assert.NoError(t, err) {
+		assert.Equal(t, Hello, string(body))
+	}
+}
+
+func TestInsecureFallback(t *testing.T) {
+	// Plaintext server, so TLS handshakes fail
+	serverAddr, stop := startServer(t, &Server{})
+	defer stop()
+	cert, _, err := GenerateSelfSignedCert("waddell")
+	if err != nil {
+		t.Fatalf("Unable to generate cert: %s", err)
+	}
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", serverAddr)
+	}
+
+	_, err = NewClient(&ClientConfig{
+		Dial:       dial,
+		ServerCert: string(cert),
+	})
+	assert.Error(t, err, "Without fallback, connecting should fail")
+
+	client, err := NewClient(&ClientConfig{
+		Dial:                 dial,
+		ServerCert:           string(cert),
+		InsecureFallbackDial: dial,
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client with fallback: %s", err)
+	}
+	defer client.Close()
+	info := client.Info()
+	assert.False(t, info.Secure, "Connection should be reported as insecure")
+	assert.Equal(t, client.CurrentId(), info.Id)
+	assert.Equal(t, ProtocolVersion, info.ProtocolVersion)
+	assert.Equal(t, serverAddr, info.RemoteAddr.String())
+}
+
+func TestIsolateByServerName(t *testing.T) {
+	certs := make(map[string]*tls.Certificate)
+	certPEMs := make(map[string]string)
+	for _, host := range []string{"tenant-a", "tenant-b"} {
+		certPEM, keyPEM, err := GenerateSelfSignedCert(host)
+		if err != nil {
+			t.Fatalf("Unable to generate cert: %s", err)
+		}
+		keyPair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatalf("Unable to load key pair: %s", err)
+		}
+		certs[host] = &keyPair
+		certPEMs[host] = string(certPEM)
+	}
+	listener, err := ListenTLS("localhost:0", &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert := certs[hello.ServerName]
+			if cert == nil {
+				return nil, fmt.Errorf("Unknown server name %s", hello.ServerName)
+			}
+			return cert, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer func() {
+		listener.Close()
+		// Wait a short time to let sockets finish closing
+		time.Sleep(250 * time.Millisecond)
+	}()
+	server := &Server{IsolateByServerName: true}
+	go server.Serve(listener)
+
+	newClient := func(host string) *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", listener.Addr().String())
+			},
+			ServerCert: certPEMs[host],
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client to %s: %s", host, err)
+		}
+		return client
+	}
+	a1 := newClient("tenant-a")
+	defer a1.Close()
+	a2 := newClient("tenant-a")
+	defer a2.Close()
+	b := newClient("tenant-b")
+	defer b.Close()
+
+	info := server.Peer(a1.CurrentId())
+	if assert.NotNil(t, info, "Should have found peer") {
+		assert.Equal(t, "tenant-a", info.ServerName)
 	}
+	assert.Nil(t, server.Peer(randomPeerId()), "Unknown peer should not be found")
+
+	err = b.SendWithReceipt(TestTopic, a2.CurrentId(), 5*time.Second, []byte(Hello))
+	if assert.Error(t, err, "Other tenant should not be able to send") {
+		dropped, ok := err.(*DroppedError)
+		if assert.True(t, ok, "Should have gotten DroppedError, not %v", err) {
+			assert.Equal(t, DropRecipientNotConnected, dropped.Reason, "Peers of other tenants should look disconnected")
+		}
+	}
+	in := a2.In(TestTopic)
+	a1.Out(TestTopic) <- Message(a2.CurrentId(), []byte(HelloYourself))
+	msg := <-in
+	assert.Equal(t, HelloYourself, string(msg.Body), "Same tenant should be able to send")
+	assert.Equal(t, a1.CurrentId(), msg.From)
 }
 
-func TestTopicIdTruncation(t *testing.T) {
-	orig := TopicId(5)
-	_, err := readTopicId(orig.toBytes()[:1])
-	assert.Error(t, err)
+func TestHTTP2(t *testing.T) {
+	listener := NewHTTPListener()
+	defer listener.Close()
+	go (&Server{}).Serve(listener)
+	hs := httptest.NewUnstartedServer(listener)
+	hs.EnableHTTP2 = true
+	hs.StartTLS()
+	defer hs.Close()
+
+	// HTTP/1.1 can't stream both ways, so it's rejected
+	tlsConfig := hs.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	http1Client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	_, err := DialHTTP2(hs.URL, http1Client)()
+	assert.Error(t, err, "Dialing over HTTP/1.1 should fail")
+	http1Client.CloseIdleConnections()
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: DialHTTP2(hs.URL, hs.Client()),
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect client over HTTP/2: %s", err)
+		}
+		return client
+	}
+	a := newClient()
+	defer a.Close()
+	b := newClient()
+	defer b.Close()
+	assert.True(t, a.Info().Secure, "HTTP/2 over TLS should be reported as secure")
+
+	inA := a.In(TestTopic)
+	inB := b.In(TestTopic)
+	a.Out(TestTopic) <- Message(b.CurrentId(), []byte(Hello))
+	msg := <-inB
+	assert.Equal(t, Hello, string(msg.Body))
+	assert.Equal(t, a.CurrentId(), msg.From)
+	b.Out(TestTopic) <- Message(msg.From, []byte(HelloYourself))
+	msg = <-inA
+	assert.Equal(t, HelloYourself, string(msg.Body))
+	assert.Equal(t, b.CurrentId(), msg.From)
 }
 
-func TestBadDialerWithNoReconnect(t *testing.T) {
-	cfg := &ClientConfig{
-		ReconnectAttempts: 0,
-		Dial: func() (net.Conn, error) {
-			return nil, fmt.Errorf("I won't dial, no way!")
+func TestTLSConfig(t *testing.T) {
+	certPEM, keyPEM, err := GenerateSelfSignedCert("waddell")
+	if err != nil {
+		t.Fatalf("Unable to generate cert: %s", err)
+	}
+	keyPair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("Unable to load key pair: %s", err)
+	}
+	listener, err := ListenTLS("localhost:0", &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
+		MinVersion:   tls.VersionTLS13,
+	})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer func() {
+		listener.Close()
+		// Wait a short time to let sockets finish closing
+		time.Sleep(250 * time.Millisecond)
+	}()
+	go (&Server{}).Serve(listener)
+	serverAddr := listener.Addr().String()
+
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", serverAddr)
+	}
+
+	_, err = NewClient(&ClientConfig{
+		Dial:       dial,
+		ServerCert: string(certPEM),
+		TLSConfig:  &tls.Config{MaxVersion: tls.VersionTLS12},
+	})
+	assert.Error(t, err, "Client limited to TLS 1.2 should not be able to connect")
+
+	clientConfig := &tls.Config{MinVersion: tls.VersionTLS13}
+	client, err := NewClient(&ClientConfig{
+		Dial:       dial,
+		ServerCert: string(certPEM),
+		TLSConfig:  clientConfig,
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client with TLS 1.3: %s", err)
+	}
+	defer client.Close()
+	assert.True(t, client.Info().Secure, "Connection should be secure")
+	assert.Nil(t, clientConfig.RootCAs, "Supplied TLSConfig should not be modified")
+}
+
+func TestGetClientCertificate(t *testing.T) {
+	newKeyPair := func(host string) ([]byte, tls.Certificate) {
+		certPEM, keyPEM, err := GenerateSelfSignedCert(host)
+		if err != nil {
+			t.Fatalf("Unable to generate cert: %s", err)
+		}
+		keyPair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatalf("Unable to load key pair: %s", err)
+		}
+		return certPEM, keyPair
+	}
+	certPEM, serverKeyPair := newKeyPair("waddell")
+	_, firstClientKeyPair := newKeyPair("client1")
+	_, secondClientKeyPair := newKeyPair("client2")
+
+	clientCerts := make(chan []byte, 10)
+	listener, err := ListenTLS("localhost:0", &tls.Config{
+		Certificates: []tls.Certificate{serverKeyPair},
+		ClientAuth:   tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			clientCerts <- rawCerts[0]
+			return nil
 		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
 	}
-	client, err := NewClient(cfg)
-	assert.Error(t, err, "Connecting with no reconnect attempts should have failed")
-	if err == nil {
-		client.Close()
+	defer func() {
+		listener.Close()
+		// Wait a short time to let sockets finish closing
+		time.Sleep(250 * time.Millisecond)
+	}()
+	go (&Server{}).Serve(listener)
+	serverAddr := listener.Addr().String()
+
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", serverAddr)
+	}
+	_, err = NewClient(&ClientConfig{
+		Dial:              dial,
+		ServerCert:        string(certPEM),
+		ReconnectAttempts: 1,
+	})
+	assert.Error(t, err, "Client without certificate should not be able to connect")
+
+	var current atomic.Value
+	current.Store(&firstClientKeyPair)
+	client, err := NewClient(&ClientConfig{
+		Dial:       dial,
+		ServerCert: string(certPEM),
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return current.Load().(*tls.Certificate), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
 	}
+	defer client.Close()
+	expectCert := func(expected tls.Certificate, msg string) {
+		for {
+			select {
+			case cert := <-clientCerts:
+				if bytes.Equal(expected.Certificate[0], cert) {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal(msg)
+			}
+		}
+	}
+	expectCert(firstClientKeyPair, "Server should have seen first certificate")
+
+	// Rotated certificate is used on the next connection
+	current.Store(&secondClientKeyPair)
+	assert.NoError(t, client.Reconnect())
+	assert.NoError(t, client.SendKeepAlive())
+	expectCert(secondClientKeyPair, "Server should have seen rotated certificate after reconnecting")
 }
 
-func TestBadDialerWithMultipleReconnect(t *testing.T) {
-	cfg := &ClientConfig{
-		ReconnectAttempts: 2,
+func TestTLSCloseNotify(t *testing.T) {
+	oldTimeout := gracefulCloseTimeout
+	gracefulCloseTimeout = 5 * time.Second
+	defer func() {
+		gracefulCloseTimeout = oldTimeout
+	}()
+
+	certPEM, keyPEM, err := GenerateSelfSignedCert("waddell")
+	if err != nil {
+		t.Fatalf("Unable to generate cert: %s", err)
+	}
+	keyPair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("Unable to load key pair: %s", err)
+	}
+	listener, err := ListenTLS("localhost:0", &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
+	})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer func() {
+		listener.Close()
+		// Wait a short time to let sockets finish closing
+		time.Sleep(250 * time.Millisecond)
+	}()
+	server := &Server{}
+	go server.Serve(listener)
+	serverAddr := listener.Addr().String()
+
+	// Closing the client only waits until the server answers its close_notify
+	client, err := NewClient(&ClientConfig{
 		Dial: func() (net.Conn, error) {
-			return nil, fmt.Errorf("I won't dial, no way!")
+			return net.Dial("tcp", serverAddr)
 		},
+		ServerCert: string(certPEM),
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect client: %s", err)
 	}
 	start := time.Now()
-	client, err := NewClient(cfg)
-	defer client.Close()
-	delta := time.Now().Sub(start)
-	assert.Error(t, err, "Connecting with 2 reconnect attempts should have failed")
-	expectedDelta := reconnectDelayInterval * 3
-	assert.True(t, delta >= expectedDelta, fmt.Sprintf("Reconnecting didn't wait long enough. Should have waited %s, only waited %s", expectedDelta, delta))
+	client.Close()
+	assert.True(t, time.Since(start) < gracefulCloseTimeout/2, "Server should have answered close_notify right away")
+
+	// Shutting down sends close_notify to peers
+	clientConfig := &tls.Config{ServerName: "waddell", InsecureSkipVerify: true}
+	raw, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	conn := tls.Client(&eofConn{Conn: raw}, clientConfig)
+	defer conn.Close()
+	reader := framed.NewReader(conn)
+	_, err = reader.ReadFrame()
+	if !assert.NoError(t, err, "Should have received peer id") {
+		return
+	}
+	server.Shutdown()
+	for err == nil {
+		_, err = reader.ReadFrame()
+	}
+	assert.Equal(t, io.EOF, err)
+	assert.False(t, truncated(conn), "Server should have sent close_notify")
+
+	// Connections cut without close_notify are truncated
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		raw, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn := tls.Server(raw, &tls.Config{Certificates: []tls.Certificate{keyPair}})
+		conn.Handshake()
+		raw.Close()
+	}()
+	raw, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	conn = tls.Client(&eofConn{Conn: raw}, clientConfig)
+	defer conn.Close()
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.True(t, truncated(conn), "Connection closed without close_notify should be truncated")
 }
 
 func TestPeersPlainText(t *testing.T) {
@@ -150,13 +3814,7 @@ func doTestPeers(t *testing.T, useTLS bool) {
 	certfile := ""
 	cert := ""
 	if useTLS {
-		pkfile = "waddell_test_pk.pem"
-		certfile = "waddell_test_cert.pem"
-		certBytes, err := ioutil.ReadFile(certfile)
-		if err != nil {
-			log.Fatalf("Unable to read cert from file: %s", err)
-		}
-		cert = string(certBytes)
+		pkfile, certfile, cert = writeTestCert(t)
 	}
 
 	listener, err := Listen("localhost:0", pkfile, certfile)
@@ -315,6 +3973,328 @@ func doTestPeers(t *testing.T, useTLS bool) {
 	assert.Equal(t, NumPeers, idCallbackTriggered, "IdCallback should have been called once for each connected peer")
 }
 
+func BenchmarkReceive(b *testing.B) {
+	doBenchmarkReceive(b, false, false)
+}
+
+func BenchmarkReceiveReuseBuffers(b *testing.B) {
+	doBenchmarkReceive(b, true, false)
+}
+
+func BenchmarkReceivePoolMessages(b *testing.B) {
+	doBenchmarkReceive(b, false, true)
+}
+
+func doBenchmarkReceive(b *testing.B, reuseBuffers bool, poolMessages bool) {
+	listener, err := Listen("localhost:0", "", "")
+	if err != nil {
+		b.Fatalf("Unable to listen: %s", err)
+	}
+	defer listener.Close()
+	go (&Server{}).Serve(listener)
+
+	client, err := NewClient(&ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", listener.Addr().String())
+		},
+		ReuseBuffers: reuseBuffers,
+		PoolMessages: poolMessages,
+	})
+	if err != nil {
+		b.Fatalf("Unable to connect client: %s", err)
+	}
+	defer client.Close()
+
+	in := client.In(TestTopic)
+	out := client.Out(TestTopic)
+	body := make([]byte, 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		out <- Message(client.CurrentId(), body)
+		(<-in).Release()
+	}
+}
+
+func BenchmarkRelayBursts(b *testing.B) {
+	doBenchmarkRelayBursts(b, 0)
+}
+
+func BenchmarkRelayBurstsCoalesced(b *testing.B) {
+	doBenchmarkRelayBursts(b, time.Millisecond)
+}
+
+// doBenchmarkRelayBursts measures relaying bursts of small messages to a single
+// recipient and reports the number of writes (i.e. syscalls) that the server
+// needs per message.
+func doBenchmarkRelayBursts(b *testing.B, coalesceWindow time.Duration) {
+	listener, err := Listen("localhost:0", "", "")
+	if err != nil {
+		b.Fatalf("Unable to listen: %s", err)
+	}
+	defer listener.Close()
+	counting := &countingListener{Listener: listener}
+	go (&Server{CoalesceWindow: coalesceWindow}).Serve(counting)
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", listener.Addr().String())
+			},
+		})
+		if err != nil {
+			b.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+	sender := newClient()
+	defer sender.Close()
+	receiver := newClient()
+	defer receiver.Close()
+	in := receiver.In(TestTopic)
+	out := sender.Out(TestTopic)
+	to := receiver.CurrentId()
+
+	burst := 10
+	body := make([]byte, 64)
+	before := counting.writes()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < burst; j++ {
+			out <- Message(to, body)
+		}
+		for j := 0; j < burst; j++ {
+			<-in
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(counting.writes()-before)/float64(b.N*burst), "writes/msg")
+}
+
+func BenchmarkMemoryPerConnection(b *testing.B) {
+	doBenchmarkMemoryPerConnection(b, 0)
+}
+
+func BenchmarkMemoryPerConnectionAdaptive(b *testing.B) {
+	doBenchmarkMemoryPerConnection(b, 512)
+}
+
+// doBenchmarkMemoryPerConnection measures the server's memory footprint with
+// 10,000 connections that mostly echo small messages, with every 100th
+// connection echoing a large one, and reports the heap in use per connection
+// once traffic has quieted down.
+func doBenchmarkMemoryPerConnection(b *testing.B, minReadBuffer int) {
+	numConns := 10000
+	listener := newPipeListener()
+	defer listener.Close()
+	go (&Server{Echo: true, MinReadBuffer: minReadBuffer, ReadBufferShrinkAfter: 100 * time.Millisecond}).Serve(listener)
+
+	heapInUse := func() uint64 {
+		runtime.GC()
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return stats.HeapInuse
+	}
+	before := heapInUse()
+	conns := make([]*framed.Writer, 0, numConns)
+	for i := 0; i < numConns; i++ {
+		conn, err := listener.Dial()
+		if err != nil {
+			b.Fatalf("Unable to dial: %s", err)
+		}
+		defer conn.Close()
+		go func() {
+			// Discard whatever the server sends
+			buf := make([]byte, 256)
+			for {
+				_, err := conn.Read(buf)
+				if err != nil {
+					return
+				}
+			}
+		}()
+		conns = append(conns, framed.NewWriter(conn))
+	}
+
+	small := make([]byte, 64)
+	large := make([]byte, 60000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j, conn := range conns {
+			body := small
+			if j%100 == 0 {
+				body = large
+			}
+			_, err := conn.WritePieces(EchoId.toBytes(), TestTopic.toBytes(), body)
+			if err != nil {
+				b.Fatalf("Unable to write: %s", err)
+			}
+		}
+	}
+	b.StopTimer()
+	time.Sleep(250 * time.Millisecond)
+	b.ReportMetric(float64(heapInUse()-before)/float64(numConns), "B/conn")
+}
+
+// pipeListener is a net.Listener for in-memory connections, which allows
+// benchmarking more connections than there are file descriptors.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("Listener closed")
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("Listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "pipe", Net: "pipe"}
+}
+
+func BenchmarkLatencyWithFlooder(b *testing.B) {
+	doBenchmarkLatencyWithFlooder(b, 0)
+}
+
+func BenchmarkLatencyWithFlooderFairRelay(b *testing.B) {
+	doBenchmarkLatencyWithFlooder(b, 1)
+}
+
+// doBenchmarkLatencyWithFlooder measures the round trip latency of light peers
+// while another peer floods the server.
+func doBenchmarkLatencyWithFlooder(b *testing.B, fairRelayConcurrency int) {
+	listener, err := Listen("localhost:0", "", "")
+	if err != nil {
+		b.Fatalf("Unable to listen: %s", err)
+	}
+	defer listener.Close()
+	go (&Server{FairRelayConcurrency: fairRelayConcurrency}).Serve(listener)
+
+	newClient := func() *Client {
+		client, err := NewClient(&ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", listener.Addr().String())
+			},
+		})
+		if err != nil {
+			b.Fatalf("Unable to connect client: %s", err)
+		}
+		return client
+	}
+
+	// The flooder floods a sink that does nothing but read
+	sink, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatalf("Unable to dial sink: %s", err)
+	}
+	defer sink.Close()
+	idFrame, err := framed.NewReader(sink).ReadFrame()
+	if err != nil {
+		b.Fatalf("Unable to read sink id: %s", err)
+	}
+	sinkId, err := readPeerId(idFrame)
+	if err != nil {
+		b.Fatalf("Unable to parse sink id: %s", err)
+	}
+	go io.Copy(ioutil.Discard, sink)
+	flooder := newClient()
+	defer flooder.Close()
+	stopFlooding := make(chan bool)
+	defer close(stopFlooding)
+	go func() {
+		out := flooder.Out(TestTopic)
+		body := make([]byte, 8192)
+		for {
+			select {
+			case <-stopFlooding:
+				return
+			case out <- Message(sinkId, body):
+			}
+		}
+	}()
+
+	numLight := 10
+	ins := make([]<-chan *MessageIn, 0, numLight)
+	outs := make([]chan<- *MessageOut, 0, numLight)
+	ids := make([]PeerId, 0, numLight)
+	for i := 0; i < numLight; i++ {
+		client := newClient()
+		defer client.Close()
+		ins = append(ins, client.In(TestTopic))
+		outs = append(outs, client.Out(TestTopic))
+		ids = append(ids, client.CurrentId())
+	}
+	body := make([]byte, 64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Light peers take turns sending a message to themselves
+		j := i % numLight
+		outs[j] <- Message(ids[j], body)
+		<-ins[j]
+	}
+}
+
+// writeTestCert writes a freshly generated self-signed cert and its private key
+// to temporary files, returning the paths of the key and cert files and the
+// PEM-encoded cert.
+func writeTestCert(t *testing.T) (string, string, string) {
+	certPEM, keyPEM, err := GenerateSelfSignedCert("waddell")
+	if err != nil {
+		t.Fatalf("Unable to generate cert: %s", err)
+	}
+	dir := t.TempDir()
+	pkfile := filepath.Join(dir, "pk.pem")
+	certfile := filepath.Join(dir, "cert.pem")
+	if err := ioutil.WriteFile(pkfile, keyPEM, 0600); err != nil {
+		t.Fatalf("Unable to write private key: %s", err)
+	}
+	if err := ioutil.WriteFile(certfile, certPEM, 0644); err != nil {
+		t.Fatalf("Unable to write cert: %s", err)
+	}
+	return pkfile, certfile, string(certPEM)
+}
+
+// startServer starts the given server on a random local port, returning its
+// address and a function for stopping it.
+func startServer(t *testing.T, server *Server) (string, func()) {
+	listener, err := Listen("localhost:0", "", "")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	go server.Serve(listener)
+	return listener.Addr().String(), func() {
+		listener.Close()
+		// Wait a short time to let sockets finish closing
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
 func largeData() []byte {
 	b := make([]byte, 60000)
 	for i := 0; i < len(b); i++ {